@@ -0,0 +1,385 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/stager/backend"
+)
+
+const DefaultRetryAfter = 30 * time.Second
+
+// Limits cap the number of stagings in flight, and what each organization and
+// space may use of them. Zero means no limit.
+type Limits struct {
+	MaxInFlight             int
+	MaxInFlightPerLifecycle map[string]int
+
+	OrganizationQuota Quota
+	SpaceQuota        Quota
+}
+
+// Quota caps the stagings a tenant has in flight and the memory and disk they
+// ask for in total. Zero means no limit.
+type Quota struct {
+	MaxInFlight int `json:"max_in_flight"`
+	MaxMemoryMB int `json:"max_memory_mb"`
+	MaxDiskMB   int `json:"max_disk_mb"`
+}
+
+func (q Quota) isZero() bool {
+	return q == Quota{}
+}
+
+// Tenant identifies who a staging is for. The CC sends it alongside the
+// staging request; stagings without a tenant are not held to the quotas.
+type Tenant struct {
+	OrganizationGuid string `json:"organization_guid,omitempty"`
+	SpaceGuid        string `json:"space_guid,omitempty"`
+}
+
+// Staging is what Admit needs to know about a staging request.
+type Staging struct {
+	Guid      string
+	Lifecycle string
+	Tenant    Tenant
+	MemoryMB  int
+	DiskMB    int
+}
+
+// CapacityError is returned by Admit when a staging would exceed one of the
+// limits on stagings in flight.
+type CapacityError struct {
+	// Lifecycle is empty when the global limit was hit.
+	Lifecycle  string
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *CapacityError) Error() string {
+	if e.Lifecycle == "" {
+		return fmt.Sprintf("too many stagings in flight (limit %d)", e.Limit)
+	}
+	return fmt.Sprintf("too many %s stagings in flight (limit %d)", e.Lifecycle, e.Limit)
+}
+
+// QuotaError is returned by Admit when a staging would take its organization
+// or space over quota. RetryAfter is zero when the staging does not fit in
+// the quota even on its own.
+type QuotaError struct {
+	// Scope is "organization" or "space".
+	Scope string
+	Guid  string
+	// Resource is "stagings", "memory" or "disk".
+	Resource   string
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	switch e.Resource {
+	case "memory":
+		return fmt.Sprintf("%s %s is over its staging memory quota (limit %d MB)", e.Scope, e.Guid, e.Limit)
+	case "disk":
+		return fmt.Sprintf("%s %s is over its staging disk quota (limit %d MB)", e.Scope, e.Guid, e.Limit)
+	default:
+		return fmt.Sprintf("%s %s has too many stagings in flight (limit %d)", e.Scope, e.Guid, e.Limit)
+	}
+}
+
+type usage struct {
+	stagings int
+	memoryMB int
+	diskMB   int
+}
+
+// Controller admits stagings while they fit under the limits and tracks them
+// from the staging request until Diego calls back.
+type Controller struct {
+	limits     Limits
+	retryAfter time.Duration
+
+	released chan struct{}
+
+	lock          sync.Mutex
+	stagings      map[string]Staging
+	counts        map[string]int
+	organizations map[string]usage
+	spaces        map[string]usage
+
+	// sequence numbers the stagings in the order they were added, so that
+	// Reconcile can tell those added while the tasks were being listed.
+	sequence   uint64
+	admittedAt map[string]uint64
+}
+
+func NewController(limits Limits, retryAfter time.Duration) *Controller {
+	controller := &Controller{
+		limits:     limits,
+		retryAfter: retryAfter,
+		released:   make(chan struct{}, 1),
+	}
+	controller.reset()
+	return controller
+}
+
+// Admit reserves room for the staging, or returns a *CapacityError or a
+// *QuotaError. A staging that is already in flight is always admitted, so
+// that the CC can retry a request whose response it lost.
+//
+// The returned cancel func gives the room back if the staging could not be
+// handed to Diego after all; it leaves stagings that were already in flight
+// alone.
+func (c *Controller) Admit(staging Staging) (cancel func(), err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.stagings[staging.Guid]; ok {
+		return func() {}, nil
+	}
+
+	if c.limits.MaxInFlight > 0 && len(c.stagings) >= c.limits.MaxInFlight {
+		return nil, &CapacityError{Limit: c.limits.MaxInFlight, RetryAfter: c.retryAfter}
+	}
+
+	if limit := c.limits.MaxInFlightPerLifecycle[staging.Lifecycle]; limit > 0 && c.counts[staging.Lifecycle] >= limit {
+		return nil, &CapacityError{Lifecycle: staging.Lifecycle, Limit: limit, RetryAfter: c.retryAfter}
+	}
+
+	if staging.Tenant.OrganizationGuid != "" {
+		err := c.checkQuota("organization", staging.Tenant.OrganizationGuid, c.limits.OrganizationQuota, c.organizations[staging.Tenant.OrganizationGuid], staging)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if staging.Tenant.SpaceGuid != "" {
+		err := c.checkQuota("space", staging.Tenant.SpaceGuid, c.limits.SpaceQuota, c.spaces[staging.Tenant.SpaceGuid], staging)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.add(staging)
+
+	return func() { c.Release(staging.Guid) }, nil
+}
+
+// Fits returns a *QuotaError if the staging does not fit in the quotas of its
+// tenant even when nothing else is in flight.
+func (c *Controller) Fits(staging Staging) error {
+	if staging.Tenant.OrganizationGuid != "" {
+		err := c.checkQuota("organization", staging.Tenant.OrganizationGuid, c.limits.OrganizationQuota, usage{}, staging)
+		if err != nil {
+			return err
+		}
+	}
+
+	if staging.Tenant.SpaceGuid != "" {
+		return c.checkQuota("space", staging.Tenant.SpaceGuid, c.limits.SpaceQuota, usage{}, staging)
+	}
+
+	return nil
+}
+
+// Released is signalled after stagings have been released, for those waiting
+// for room.
+func (c *Controller) Released() <-chan struct{} {
+	return c.released
+}
+
+// Release frees the room held by the staging. Releasing a staging that is not
+// in flight has no effect.
+func (c *Controller) Release(stagingGuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.remove(stagingGuid) {
+		c.signalReleased()
+	}
+}
+
+// InFlight returns the number of stagings in flight for the lifecycle, or in
+// total when lifecycle is empty.
+func (c *Controller) InFlight(lifecycle string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if lifecycle == "" {
+		return len(c.stagings)
+	}
+	return c.counts[lifecycle]
+}
+
+// InFlightByLifecycle returns the number of stagings in flight per lifecycle,
+// including the lifecycles that have had stagings in flight and have none
+// left.
+func (c *Controller) InFlightByLifecycle() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	counts := make(map[string]int, len(c.counts))
+	for lifecycle, count := range c.counts {
+		counts[lifecycle] = count
+	}
+	return counts
+}
+
+// Mark returns the mark to take before listing the tasks that are passed to
+// Reconcile.
+func (c *Controller) Mark() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.sequence
+}
+
+// Reconcile makes the stagings in flight match the staging tasks that Diego
+// has not completed yet, so that stagings started before the stager
+// (re)started count against the limits, and stagings whose callback never
+// arrived give their room back. Tasks are admitted even when they exceed the
+// limits. Stagings admitted after mark are kept, as their tasks may have been
+// created after the tasks were listed.
+func (c *Controller) Reconcile(tasks []receptor.TaskResponse, mark uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	unfinished := map[string]struct{}{}
+
+	for _, task := range tasks {
+		if task.State == receptor.TaskStateCompleted || task.State == receptor.TaskStateResolving {
+			continue
+		}
+
+		var annotation backend.StagingTaskAnnotation
+		err := json.Unmarshal([]byte(task.Annotation), &annotation)
+		if err != nil {
+			continue
+		}
+
+		unfinished[task.TaskGuid] = struct{}{}
+		if _, ok := c.stagings[task.TaskGuid]; ok {
+			continue
+		}
+
+		c.add(Staging{
+			Guid:      task.TaskGuid,
+			Lifecycle: annotation.Lifecycle,
+			Tenant: Tenant{
+				OrganizationGuid: annotation.OrganizationGuid,
+				SpaceGuid:        annotation.SpaceGuid,
+			},
+			MemoryMB: task.MemoryMB,
+			DiskMB:   task.DiskMB,
+		})
+	}
+
+	released := false
+	for guid := range c.stagings {
+		if _, ok := unfinished[guid]; ok || c.admittedAt[guid] > mark {
+			continue
+		}
+
+		released = c.remove(guid) || released
+	}
+
+	if released {
+		c.signalReleased()
+	}
+}
+
+func (c *Controller) checkQuota(scope, guid string, quota Quota, used usage, staging Staging) error {
+	if quota.isZero() {
+		return nil
+	}
+
+	check := func(resource string, limit, inUse, requested int) error {
+		if limit <= 0 || inUse+requested <= limit {
+			return nil
+		}
+
+		quotaErr := &QuotaError{Scope: scope, Guid: guid, Resource: resource, Limit: limit}
+		if requested <= limit {
+			quotaErr.RetryAfter = c.retryAfter
+		}
+		return quotaErr
+	}
+
+	err := check("stagings", quota.MaxInFlight, used.stagings, 1)
+	if err != nil {
+		return err
+	}
+
+	err = check("memory", quota.MaxMemoryMB, used.memoryMB, staging.MemoryMB)
+	if err != nil {
+		return err
+	}
+
+	return check("disk", quota.MaxDiskMB, used.diskMB, staging.DiskMB)
+}
+
+func (c *Controller) add(staging Staging) {
+	c.sequence++
+	c.admittedAt[staging.Guid] = c.sequence
+	c.stagings[staging.Guid] = staging
+	c.counts[staging.Lifecycle]++
+	c.organizations[staging.Tenant.OrganizationGuid] = c.organizations[staging.Tenant.OrganizationGuid].plus(staging)
+	c.spaces[staging.Tenant.SpaceGuid] = c.spaces[staging.Tenant.SpaceGuid].plus(staging)
+}
+
+func (c *Controller) remove(stagingGuid string) bool {
+	staging, ok := c.stagings[stagingGuid]
+	if !ok {
+		return false
+	}
+
+	delete(c.stagings, stagingGuid)
+	delete(c.admittedAt, stagingGuid)
+	c.counts[staging.Lifecycle]--
+	subtract(c.organizations, staging.Tenant.OrganizationGuid, staging)
+	subtract(c.spaces, staging.Tenant.SpaceGuid, staging)
+
+	return true
+}
+
+func (c *Controller) signalReleased() {
+	select {
+	case c.released <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Controller) reset() {
+	c.admittedAt = make(map[string]uint64)
+	c.stagings = make(map[string]Staging)
+	c.counts = make(map[string]int)
+	c.organizations = make(map[string]usage)
+	c.spaces = make(map[string]usage)
+}
+
+func (u usage) plus(staging Staging) usage {
+	return usage{
+		stagings: u.stagings + 1,
+		memoryMB: u.memoryMB + staging.MemoryMB,
+		diskMB:   u.diskMB + staging.DiskMB,
+	}
+}
+
+// subtract takes the staging off the usage of the tenant, forgetting tenants
+// that have nothing left in flight.
+func subtract(usages map[string]usage, tenantGuid string, staging Staging) {
+	u := usages[tenantGuid]
+	if u.stagings <= 1 {
+		delete(usages, tenantGuid)
+		return
+	}
+
+	usages[tenantGuid] = usage{
+		stagings: u.stagings - 1,
+		memoryMB: u.memoryMB - staging.MemoryMB,
+		diskMB:   u.diskMB - staging.DiskMB,
+	}
+}
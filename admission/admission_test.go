@@ -0,0 +1,289 @@
+package admission_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/stager/admission"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Controller", func() {
+	var (
+		limits     admission.Limits
+		controller *admission.Controller
+	)
+
+	BeforeEach(func() {
+		limits = admission.Limits{
+			MaxInFlight:             3,
+			MaxInFlightPerLifecycle: map[string]int{"docker": 1},
+		}
+	})
+
+	JustBeforeEach(func() {
+		controller = admission.NewController(limits, 10*time.Second)
+	})
+
+	admit := func(stagingGuid, lifecycle string) error {
+		_, err := controller.Admit(admission.Staging{Guid: stagingGuid, Lifecycle: lifecycle})
+		return err
+	}
+
+	It("admits stagings up to the global limit", func() {
+		Ω(admit("guid-1", "buildpack")).Should(Succeed())
+		Ω(admit("guid-2", "buildpack")).Should(Succeed())
+		Ω(admit("guid-3", "buildpack")).Should(Succeed())
+
+		err := admit("guid-4", "buildpack")
+		Ω(err).Should(Equal(&admission.CapacityError{Limit: 3, RetryAfter: 10 * time.Second}))
+		Ω(controller.InFlight("")).Should(Equal(3))
+	})
+
+	It("admits stagings up to the limit of their lifecycle", func() {
+		Ω(admit("guid-1", "docker")).Should(Succeed())
+
+		err := admit("guid-2", "docker")
+		Ω(err).Should(Equal(&admission.CapacityError{Lifecycle: "docker", Limit: 1, RetryAfter: 10 * time.Second}))
+
+		Ω(admit("guid-3", "buildpack")).Should(Succeed())
+	})
+
+	It("admits a staging that is already in flight again", func() {
+		Ω(admit("guid-1", "docker")).Should(Succeed())
+		Ω(admit("guid-1", "docker")).Should(Succeed())
+		Ω(controller.InFlight("docker")).Should(Equal(1))
+	})
+
+	It("gives the room back when the admission is cancelled", func() {
+		cancel, err := controller.Admit(admission.Staging{Guid: "guid-1", Lifecycle: "docker"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		cancelAgain, err := controller.Admit(admission.Staging{Guid: "guid-1", Lifecycle: "docker"})
+		Ω(err).ShouldNot(HaveOccurred())
+		cancelAgain()
+		Ω(controller.InFlight("docker")).Should(Equal(1))
+
+		cancel()
+		Ω(controller.InFlight("docker")).Should(Equal(0))
+	})
+
+	It("signals when stagings are released", func() {
+		Ω(admit("guid-1", "docker")).Should(Succeed())
+		Consistently(controller.Released()).ShouldNot(Receive())
+
+		controller.Release("guid-1")
+		Eventually(controller.Released()).Should(Receive())
+	})
+
+	It("makes room when a staging is released", func() {
+		Ω(admit("guid-1", "docker")).Should(Succeed())
+		controller.Release("guid-1")
+		controller.Release("guid-1")
+
+		Ω(controller.InFlight("docker")).Should(Equal(0))
+		Ω(admit("guid-2", "docker")).Should(Succeed())
+	})
+
+	It("counts the stagings in flight per lifecycle, down to zero", func() {
+		Ω(admit("guid-1", "docker")).Should(Succeed())
+		Ω(admit("guid-2", "buildpack")).Should(Succeed())
+		controller.Release("guid-1")
+
+		Ω(controller.InFlightByLifecycle()).Should(Equal(map[string]int{"docker": 0, "buildpack": 1}))
+	})
+
+	Context("without limits", func() {
+		BeforeEach(func() {
+			limits = admission.Limits{}
+		})
+
+		It("admits every staging", func() {
+			for _, guid := range []string{"guid-1", "guid-2", "guid-3", "guid-4"} {
+				Ω(admit(guid, "docker")).Should(Succeed())
+			}
+		})
+	})
+
+	Describe("Reconcile", func() {
+		It("replaces the stagings in flight with the unfinished tasks", func() {
+			Ω(admit("gone-guid", "buildpack")).Should(Succeed())
+
+			controller.Reconcile([]receptor.TaskResponse{
+				{TaskGuid: "pending-guid", State: receptor.TaskStatePending, Annotation: `{"lifecycle": "docker"}`},
+				{TaskGuid: "running-guid", State: receptor.TaskStateRunning, Annotation: `{"lifecycle": "buildpack"}`},
+				{TaskGuid: "completed-guid", State: receptor.TaskStateCompleted, Annotation: `{"lifecycle": "buildpack"}`},
+				{TaskGuid: "bogus-guid", State: receptor.TaskStateRunning, Annotation: `bogus`},
+			}, controller.Mark())
+
+			Ω(controller.InFlight("")).Should(Equal(2))
+			Ω(controller.InFlight("docker")).Should(Equal(1))
+			Ω(controller.InFlight("buildpack")).Should(Equal(1))
+
+			err := admit("new-guid", "docker")
+			Ω(err).Should(BeAssignableToTypeOf(&admission.CapacityError{}))
+
+			controller.Release("pending-guid")
+			Ω(admit("new-guid", "docker")).Should(Succeed())
+		})
+
+		It("gives back the room of stagings whose task is gone", func() {
+			Ω(admit("gone-guid", "docker")).Should(Succeed())
+			Ω(admit("running-guid", "buildpack")).Should(Succeed())
+
+			controller.Reconcile([]receptor.TaskResponse{
+				{TaskGuid: "running-guid", State: receptor.TaskStateRunning, Annotation: `{"lifecycle": "buildpack"}`},
+			}, controller.Mark())
+
+			Ω(controller.InFlight("")).Should(Equal(1))
+			Ω(controller.InFlight("docker")).Should(Equal(0))
+			Ω(controller.Released()).Should(Receive())
+			Ω(admit("new-guid", "docker")).Should(Succeed())
+		})
+
+		It("keeps stagings admitted after the mark, whose tasks may not have been listed", func() {
+			mark := controller.Mark()
+			Ω(admit("new-guid", "docker")).Should(Succeed())
+
+			controller.Reconcile([]receptor.TaskResponse{}, mark)
+
+			Ω(controller.InFlight("docker")).Should(Equal(1))
+		})
+
+		Context("with an organization quota", func() {
+			BeforeEach(func() {
+				limits.OrganizationQuota = admission.Quota{MaxMemoryMB: 1536}
+			})
+
+			It("counts the tasks against the quotas of their tenants", func() {
+				controller.Reconcile([]receptor.TaskResponse{
+					{TaskGuid: "running-guid", State: receptor.TaskStateRunning, Annotation: `{"lifecycle": "buildpack", "organization_guid": "org-guid"}`, MemoryMB: 1024},
+				}, controller.Mark())
+
+				_, err := controller.Admit(admission.Staging{
+					Guid:      "new-guid",
+					Lifecycle: "buildpack",
+					Tenant:    admission.Tenant{OrganizationGuid: "org-guid"},
+					MemoryMB:  1024,
+				})
+				Ω(err).Should(BeAssignableToTypeOf(&admission.QuotaError{}))
+			})
+		})
+	})
+
+	Describe("tenant quotas", func() {
+		var tenant admission.Tenant
+
+		staging := func(stagingGuid string, memoryMB, diskMB int) admission.Staging {
+			return admission.Staging{
+				Guid:      stagingGuid,
+				Lifecycle: "buildpack",
+				Tenant:    tenant,
+				MemoryMB:  memoryMB,
+				DiskMB:    diskMB,
+			}
+		}
+
+		BeforeEach(func() {
+			limits = admission.Limits{
+				OrganizationQuota: admission.Quota{MaxInFlight: 2, MaxMemoryMB: 4096},
+				SpaceQuota:        admission.Quota{MaxDiskMB: 6144},
+			}
+			tenant = admission.Tenant{OrganizationGuid: "org-guid", SpaceGuid: "space-guid"}
+		})
+
+		It("caps the stagings an organization has in flight", func() {
+			_, err := controller.Admit(staging("guid-1", 1024, 1024))
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = controller.Admit(staging("guid-2", 1024, 1024))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = controller.Admit(staging("guid-3", 1024, 1024))
+			Ω(err).Should(Equal(&admission.QuotaError{
+				Scope:      "organization",
+				Guid:       "org-guid",
+				Resource:   "stagings",
+				Limit:      2,
+				RetryAfter: 10 * time.Second,
+			}))
+			Ω(err.Error()).Should(Equal("organization org-guid has too many stagings in flight (limit 2)"))
+		})
+
+		It("caps the memory an organization's stagings ask for", func() {
+			_, err := controller.Admit(staging("guid-1", 3072, 1024))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = controller.Admit(staging("guid-2", 2048, 1024))
+			Ω(err).Should(Equal(&admission.QuotaError{
+				Scope:      "organization",
+				Guid:       "org-guid",
+				Resource:   "memory",
+				Limit:      4096,
+				RetryAfter: 10 * time.Second,
+			}))
+		})
+
+		It("caps the disk a space's stagings ask for", func() {
+			_, err := controller.Admit(staging("guid-1", 1024, 4096))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = controller.Admit(staging("guid-2", 1024, 4096))
+			Ω(err).Should(Equal(&admission.QuotaError{
+				Scope:      "space",
+				Guid:       "space-guid",
+				Resource:   "disk",
+				Limit:      6144,
+				RetryAfter: 10 * time.Second,
+			}))
+			Ω(err.Error()).Should(Equal("space space-guid is over its staging disk quota (limit 6144 MB)"))
+		})
+
+		It("does not ask for a retry when the staging can never fit", func() {
+			_, err := controller.Admit(staging("guid-1", 8192, 1024))
+			Ω(err).Should(BeAssignableToTypeOf(&admission.QuotaError{}))
+			Ω(err.(*admission.QuotaError).RetryAfter).Should(BeZero())
+		})
+
+		It("gives the quota back when a staging is released", func() {
+			_, err := controller.Admit(staging("guid-1", 4096, 1024))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			controller.Release("guid-1")
+
+			_, err = controller.Admit(staging("guid-2", 4096, 1024))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("keeps tenants apart", func() {
+			_, err := controller.Admit(staging("guid-1", 4096, 1024))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			tenant = admission.Tenant{OrganizationGuid: "other-org-guid", SpaceGuid: "other-space-guid"}
+			_, err = controller.Admit(staging("guid-2", 4096, 1024))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("tells whether a staging fits in the quotas on its own", func() {
+			_, err := controller.Admit(staging("guid-1", 4096, 1024))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(controller.Fits(staging("guid-2", 4096, 1024))).Should(Succeed())
+
+			err = controller.Fits(staging("guid-3", 1024, 8192))
+			Ω(err).Should(Equal(&admission.QuotaError{
+				Scope:    "space",
+				Guid:     "space-guid",
+				Resource: "disk",
+				Limit:    6144,
+			}))
+		})
+
+		It("does not hold stagings without a tenant to the quotas", func() {
+			tenant = admission.Tenant{}
+			_, err := controller.Admit(staging("guid-1", 8192, 8192))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+	})
+})
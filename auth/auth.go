@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/pivotal-golang/lager"
+)
+
+const realm = "stager"
+
+// Authenticator decides whether a request comes from an allowed caller.
+//
+//go:generate counterfeiter -o fakes/fake_authenticator.go . Authenticator
+type Authenticator interface {
+	Authenticate(req *http.Request) bool
+}
+
+// Wrap returns a handler that serves only the requests accepted by
+// authenticator, and responds 401 Unauthorized to the others. A nil
+// authenticator accepts every request.
+func Wrap(logger lager.Logger, authenticator Authenticator, handler http.Handler) http.Handler {
+	if authenticator == nil {
+		return handler
+	}
+
+	logger = logger.Session("auth")
+
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !authenticator.Authenticate(req) {
+			logger.Info("unauthorized", lager.Data{
+				"method":      req.Method,
+				"path":        req.URL.Path,
+				"remote-addr": req.RemoteAddr,
+			})
+			resp.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+type basicAuthenticator struct {
+	username []byte
+	password []byte
+}
+
+// NewBasicAuthenticator accepts requests carrying the given HTTP basic auth
+// credentials.
+func NewBasicAuthenticator(username, password string) Authenticator {
+	return &basicAuthenticator{
+		username: []byte(username),
+		password: []byte(password),
+	}
+}
+
+func (a *basicAuthenticator) Authenticate(req *http.Request) bool {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	usernameMatches := subtle.ConstantTimeCompare([]byte(username), a.username) == 1
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), a.password) == 1
+
+	return usernameMatches && passwordMatches
+}
+
+type clientCertAuthenticator struct {
+	clientCAs *x509.CertPool
+}
+
+// NewClientCertAuthenticator accepts requests made over TLS with a client
+// certificate issued by one of clientCAs. The server must request client
+// certificates for this to accept anything.
+func NewClientCertAuthenticator(clientCAs *x509.CertPool) Authenticator {
+	return &clientCertAuthenticator{clientCAs: clientCAs}
+}
+
+func (a *clientCertAuthenticator) Authenticate(req *http.Request) bool {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := req.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         a.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	return err == nil
+}
+
+type anyAuthenticator []Authenticator
+
+// Any accepts requests accepted by any of authenticators.
+func Any(authenticators ...Authenticator) Authenticator {
+	return anyAuthenticator(authenticators)
+}
+
+func (authenticators anyAuthenticator) Authenticate(req *http.Request) bool {
+	for _, authenticator := range authenticators {
+		if authenticator.Authenticate(req) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,192 @@
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/auth"
+	"github.com/cloudfoundry-incubator/stager/auth/fakes"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Auth", func() {
+	var req *http.Request
+
+	BeforeEach(func() {
+		var err error
+		req, err = http.NewRequest("PUT", "/v1/staging/a-staging-guid", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	Describe("Wrap", func() {
+		var (
+			authenticator *fakes.FakeAuthenticator
+			served        bool
+			handler       http.Handler
+		)
+
+		BeforeEach(func() {
+			authenticator = &fakes.FakeAuthenticator{}
+			served = false
+			handler = auth.Wrap(lagertest.NewTestLogger("test"), authenticator, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				served = true
+			}))
+		})
+
+		It("serves authenticated requests", func() {
+			authenticator.AuthenticateReturns(true)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			Ω(served).Should(BeTrue())
+			Ω(authenticator.AuthenticateArgsForCall(0)).Should(Equal(req))
+		})
+
+		It("rejects unauthenticated requests", func() {
+			authenticator.AuthenticateReturns(false)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			Ω(served).Should(BeFalse())
+			Ω(recorder.Code).Should(Equal(http.StatusUnauthorized))
+			Ω(recorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="stager"`))
+		})
+
+		Context("without an authenticator", func() {
+			It("serves every request", func() {
+				handler := auth.Wrap(lagertest.NewTestLogger("test"), nil, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+					served = true
+				}))
+
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+				Ω(served).Should(BeTrue())
+			})
+		})
+	})
+
+	Describe("NewBasicAuthenticator", func() {
+		var authenticator auth.Authenticator
+
+		BeforeEach(func() {
+			authenticator = auth.NewBasicAuthenticator("cc", "secret")
+		})
+
+		It("accepts matching credentials", func() {
+			req.SetBasicAuth("cc", "secret")
+			Ω(authenticator.Authenticate(req)).Should(BeTrue())
+		})
+
+		It("rejects a wrong password", func() {
+			req.SetBasicAuth("cc", "guess")
+			Ω(authenticator.Authenticate(req)).Should(BeFalse())
+		})
+
+		It("rejects a wrong username", func() {
+			req.SetBasicAuth("someone", "secret")
+			Ω(authenticator.Authenticate(req)).Should(BeFalse())
+		})
+
+		It("rejects requests without credentials", func() {
+			Ω(authenticator.Authenticate(req)).Should(BeFalse())
+		})
+	})
+
+	Describe("NewClientCertAuthenticator", func() {
+		var (
+			ca            *x509.Certificate
+			caKey         *ecdsa.PrivateKey
+			authenticator auth.Authenticator
+		)
+
+		BeforeEach(func() {
+			ca, caKey = newCertificate(nil, nil, true)
+
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(ca)
+			authenticator = auth.NewClientCertAuthenticator(clientCAs)
+		})
+
+		It("accepts client certificates issued by the CA", func() {
+			clientCert, _ := newCertificate(ca, caKey, false)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert}}
+
+			Ω(authenticator.Authenticate(req)).Should(BeTrue())
+		})
+
+		It("rejects client certificates issued by another CA", func() {
+			otherCA, otherCAKey := newCertificate(nil, nil, true)
+			clientCert, _ := newCertificate(otherCA, otherCAKey, false)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert}}
+
+			Ω(authenticator.Authenticate(req)).Should(BeFalse())
+		})
+
+		It("rejects TLS requests without a client certificate", func() {
+			req.TLS = &tls.ConnectionState{}
+			Ω(authenticator.Authenticate(req)).Should(BeFalse())
+		})
+
+		It("rejects plain HTTP requests", func() {
+			Ω(authenticator.Authenticate(req)).Should(BeFalse())
+		})
+	})
+
+	Describe("Any", func() {
+		It("accepts requests accepted by one of the authenticators", func() {
+			rejecting := &fakes.FakeAuthenticator{}
+			accepting := &fakes.FakeAuthenticator{}
+			accepting.AuthenticateReturns(true)
+
+			Ω(auth.Any(rejecting, accepting).Authenticate(req)).Should(BeTrue())
+			Ω(auth.Any(rejecting).Authenticate(req)).Should(BeFalse())
+		})
+	})
+})
+
+func newCertificate(issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Ω(err).ShouldNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "stager-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	return cert, key
+}
@@ -0,0 +1,54 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/stager/auth"
+)
+
+type FakeAuthenticator struct {
+	AuthenticateStub        func(req *http.Request) bool
+	authenticateMutex       sync.RWMutex
+	authenticateArgsForCall []struct {
+		req *http.Request
+	}
+	authenticateReturns struct {
+		result1 bool
+	}
+}
+
+func (fake *FakeAuthenticator) Authenticate(req *http.Request) bool {
+	fake.authenticateMutex.Lock()
+	fake.authenticateArgsForCall = append(fake.authenticateArgsForCall, struct {
+		req *http.Request
+	}{req})
+	fake.authenticateMutex.Unlock()
+	if fake.AuthenticateStub != nil {
+		return fake.AuthenticateStub(req)
+	} else {
+		return fake.authenticateReturns.result1
+	}
+}
+
+func (fake *FakeAuthenticator) AuthenticateCallCount() int {
+	fake.authenticateMutex.RLock()
+	defer fake.authenticateMutex.RUnlock()
+	return len(fake.authenticateArgsForCall)
+}
+
+func (fake *FakeAuthenticator) AuthenticateArgsForCall(i int) *http.Request {
+	fake.authenticateMutex.RLock()
+	defer fake.authenticateMutex.RUnlock()
+	return fake.authenticateArgsForCall[i].req
+}
+
+func (fake *FakeAuthenticator) AuthenticateReturns(result1 bool) {
+	fake.AuthenticateStub = nil
+	fake.authenticateReturns = struct {
+		result1 bool
+	}{result1}
+}
+
+var _ auth.Authenticator = new(FakeAuthenticator)
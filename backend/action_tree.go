@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+)
+
+// FormatActionTree renders the action as an indented tree, one action per
+// line, for people reviewing what a staging task will do. URLs are redacted.
+func FormatActionTree(action models.Action, redactor Redactor) string {
+	var buf bytes.Buffer
+	writeActionTree(&buf, action, 0, redactor)
+	return buf.String()
+}
+
+func writeActionTree(buf *bytes.Buffer, action models.Action, depth int, redactor Redactor) {
+	indent := strings.Repeat("  ", depth)
+
+	switch a := action.(type) {
+	case *models.SerialAction:
+		fmt.Fprintf(buf, "%sSerial\n", indent)
+		for _, child := range a.Actions {
+			writeActionTree(buf, child, depth+1, redactor)
+		}
+
+	case *models.ParallelAction:
+		fmt.Fprintf(buf, "%sParallel\n", indent)
+		for _, child := range a.Actions {
+			writeActionTree(buf, child, depth+1, redactor)
+		}
+
+	case *models.EmitProgressAction:
+		fmt.Fprintf(buf, "%sEmitProgress start=%q success=%q failure=%q\n", indent, a.StartMessage, a.SuccessMessage, a.FailureMessagePrefix)
+		writeActionTree(buf, a.Action, depth+1, redactor)
+
+	case *models.TimeoutAction:
+		fmt.Fprintf(buf, "%sTimeout %s\n", indent, a.Timeout)
+		writeActionTree(buf, a.Action, depth+1, redactor)
+
+	case *models.TryAction:
+		fmt.Fprintf(buf, "%sTry\n", indent)
+		writeActionTree(buf, a.Action, depth+1, redactor)
+
+	case *models.DownloadAction:
+		fmt.Fprintf(buf, "%sDownload%s %s -> %s", indent, artifactSuffix(a.Artifact), redactor.RedactURL(a.From), a.To)
+		if a.CacheKey != "" {
+			fmt.Fprintf(buf, " (cache key %s)", a.CacheKey)
+		}
+		buf.WriteString("\n")
+
+	case *models.UploadAction:
+		fmt.Fprintf(buf, "%sUpload%s %s -> %s\n", indent, artifactSuffix(a.Artifact), a.From, redactor.RedactURL(a.To))
+
+	case *models.RunAction:
+		args := make([]string, len(a.Args))
+		for i, arg := range a.Args {
+			args[i] = redactor.RedactURL(arg)
+		}
+		fmt.Fprintf(buf, "%sRun %s\n", indent, strings.TrimSpace(a.Path+" "+strings.Join(args, " ")))
+
+	case nil:
+		fmt.Fprintf(buf, "%s(no action)\n", indent)
+
+	default:
+		fmt.Fprintf(buf, "%s%T\n", indent, action)
+	}
+}
+
+func artifactSuffix(artifact string) string {
+	if artifact == "" {
+		return ""
+	}
+	return fmt.Sprintf(" %q", artifact)
+}
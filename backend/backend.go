@@ -21,6 +21,21 @@ const (
 
 type FailureReasonSanitizer func(string) *cc_messages.StagingError
 
+// StagingTaskAnnotation is attached to every staging task. It is a superset
+// of cc_messages.StagingTaskAnnotation, carrying what the stager needs to
+// describe a staging without asking the CC, and the trace context that lets
+// the completion callback join the trace of the staging request.
+//
+// The organization and space the staging is for are kept so that tenant
+// quotas survive a restart of the stager.
+type StagingTaskAnnotation struct {
+	Lifecycle        string            `json:"lifecycle"`
+	AppId            string            `json:"app_id,omitempty"`
+	OrganizationGuid string            `json:"organization_guid,omitempty"`
+	SpaceGuid        string            `json:"space_guid,omitempty"`
+	TraceContext     map[string]string `json:"trace_context,omitempty"`
+}
+
 //go:generate counterfeiter -o fake_backend/fake_backend.go . Backend
 type Backend interface {
 	BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (receptor.TaskCreateRequest, error)
@@ -31,6 +46,15 @@ var ErrNoCompilerDefined = errors.New(diego_errors.NO_COMPILER_DEFINED_MESSAGE)
 var ErrMissingAppId = errors.New(diego_errors.MISSING_APP_ID_MESSAGE)
 var ErrMissingAppBitsDownloadUri = errors.New(diego_errors.MISSING_APP_BITS_DOWNLOAD_URI_MESSAGE)
 var ErrMissingLifecycleData = errors.New(diego_errors.MISSING_LIFECYCLE_DATA_MESSAGE)
+var ErrNoFileServerURL = errors.New("compiler is a path on the file server, but no file server URL is configured")
+
+// DockerCredentials authenticate the docker builder against a private
+// registry.
+type DockerCredentials struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
 
 type Config struct {
 	TaskDomain     string
@@ -39,10 +63,61 @@ type Config struct {
 	Lifecycles     map[string]string
 	SkipCertVerify bool
 	Sanitizer      FailureReasonSanitizer
+	ImageRegistry  string
+
+	// DockerRegistryCredentials are named credentials that docker staging
+	// requests may refer to instead of sending a user and password.
+	DockerRegistryCredentials map[string]DockerCredentials
+
+	// ImageRegistryCredentials names the DockerRegistryCredentials the
+	// dockerfile lifecycle pushes to ImageRegistry with.
+	ImageRegistryCredentials string
+
+	// Redactor scrubs requests and tasks before they are logged.
+	Redactor Redactor
+
+	// CallbackUsername and CallbackPassword, when set, are embedded in the
+	// completion callback URL so that Diego authenticates its callbacks.
+	CallbackUsername string
+	CallbackPassword string
+
+	// CallbackSigner, when set, signs the completion callback URL of every
+	// staging task.
+	CallbackSigner *CallbackSigner
+
+	// StagingTimeout bounds stagings whose request carries no timeout. Zero
+	// means DefaultStagingTimeout.
+	StagingTimeout time.Duration
 }
 
 func (c Config) CallbackURL(stagingGuid string) string {
-	return fmt.Sprintf("%s/v1/staging/%s/completed", c.StagerURL, stagingGuid)
+	callbackURL := fmt.Sprintf("%s/v1/staging/%s/completed", c.StagerURL, stagingGuid)
+	if c.CallbackUsername == "" && c.CallbackSigner == nil {
+		return callbackURL
+	}
+
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return callbackURL
+	}
+
+	if c.CallbackUsername != "" {
+		u.User = url.UserPassword(c.CallbackUsername, c.CallbackPassword)
+	}
+
+	if c.CallbackSigner != nil {
+		u.RawQuery = c.CallbackSigner.Sign(stagingGuid).Encode()
+	}
+
+	return u.String()
+}
+
+func (c Config) defaultStagingTimeout() time.Duration {
+	if c.StagingTimeout > 0 {
+		return c.StagingTimeout
+	}
+
+	return DefaultStagingTimeout
 }
 
 func max(x, y uint64) uint64 {
@@ -40,7 +40,7 @@ func NewTraditionalBackend(config Config, logger lager.Logger) Backend {
 
 func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (receptor.TaskCreateRequest, error) {
 	logger := backend.logger.Session("build-recipe")
-	logger.Info("staging-request", lager.Data{"Request": request})
+	logger.Info("staging-request", lager.Data{"Request": backend.config.Redactor.Redact(request)})
 
 	if request.LifecycleData == nil {
 		return receptor.TaskCreateRequest{}, ErrMissingLifecycleData
@@ -52,12 +52,12 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 		return receptor.TaskCreateRequest{}, err
 	}
 
-	err = backend.validateRequest(request, lifecycleData)
+	err = validateBuildpackRequest(request, lifecycleData)
 	if err != nil {
 		return receptor.TaskCreateRequest{}, err
 	}
 
-	compilerURL, err := backend.compilerDownloadURL(request)
+	compilerURL, err := compilerDownloadURL(backend.config, request.Lifecycle+"/"+request.Stack)
 	if err != nil {
 		return receptor.TaskCreateRequest{}, err
 	}
@@ -71,7 +71,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 
 	builderConfig := buildpack_app_lifecycle.NewLifecycleBuilderConfig(buildpacksOrder, skipDetect, backend.config.SkipCertVerify)
 
-	timeout := traditionalTimeout(request, backend.logger)
+	timeout := traditionalTimeout(request, backend.config.defaultStagingTimeout(), backend.logger)
 
 	actions := []models.Action{}
 
@@ -128,7 +128,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	downloadNames = append(downloadNames, fmt.Sprintf("buildpacks (%s)", strings.Join(buildpackNames, ", ")))
 
 	//Download buildpack artifacts cache
-	downloadURL, err := backend.buildArtifactsDownloadURL(lifecycleData)
+	downloadURL, err := buildArtifactsDownloadURL(lifecycleData)
 	if err != nil {
 		return receptor.TaskCreateRequest{}, err
 	}
@@ -173,7 +173,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	//Upload Droplet
 	uploadActions := []models.Action{}
 	uploadNames := []string{}
-	uploadURL, err := backend.dropletUploadURL(request, lifecycleData)
+	uploadURL, err := dropletUploadURL(backend.config, request, lifecycleData)
 	if err != nil {
 		return receptor.TaskCreateRequest{}, err
 	}
@@ -189,7 +189,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	uploadNames = append(uploadNames, "droplet")
 
 	//Upload Buildpack Artifacts Cache
-	uploadURL, err = backend.buildArtifactsUploadURL(request, lifecycleData)
+	uploadURL, err = buildArtifactsUploadURL(backend.config, request, lifecycleData)
 	if err != nil {
 		return receptor.TaskCreateRequest{}, err
 	}
@@ -208,8 +208,9 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 	uploadMsg := fmt.Sprintf("Uploading %s...", strings.Join(uploadNames, ", "))
 	actions = append(actions, models.EmitProgressFor(models.Parallel(uploadActions...), uploadMsg, "Uploading complete", "Uploading failed"))
 
-	annotationJson, _ := json.Marshal(cc_messages.StagingTaskAnnotation{
+	annotationJson, _ := json.Marshal(StagingTaskAnnotation{
 		Lifecycle: TraditionalLifecycleName,
+		AppId:     request.AppId,
 	})
 
 	task := receptor.TaskCreateRequest{
@@ -230,7 +231,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 		EnvironmentVariables:  []receptor.EnvironmentVariable{{"LANG", DefaultLANG}},
 	}
 
-	logger.Debug("staging-task-request", lager.Data{"TaskCreateRequest": task})
+	logger.Debug("staging-task-request", lager.Data{"TaskCreateRequest": backend.config.Redactor.Redact(task)})
 
 	return task, nil
 }
@@ -238,7 +239,7 @@ func (backend *traditionalBackend) BuildRecipe(stagingGuid string, request cc_me
 func (backend *traditionalBackend) BuildStagingResponse(taskResponse receptor.TaskResponse) (cc_messages.StagingResponseForCC, error) {
 	var response cc_messages.StagingResponseForCC
 
-	var annotation cc_messages.StagingTaskAnnotation
+	var annotation StagingTaskAnnotation
 	err := json.Unmarshal([]byte(taskResponse.Annotation), &annotation)
 	if err != nil {
 		return cc_messages.StagingResponseForCC{}, err
@@ -272,9 +273,9 @@ func (backend *traditionalBackend) BuildStagingResponse(taskResponse receptor.Ta
 	return response, nil
 }
 
-func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.StagingRequestFromCC) (*url.URL, error) {
-	compilerPath, ok := backend.config.Lifecycles[request.Lifecycle+"/"+request.Stack]
-	if !ok {
+func compilerDownloadURL(config Config, lifecycleKey string) (*url.URL, error) {
+	compilerPath := config.Lifecycles[lifecycleKey]
+	if compilerPath == "" {
 		return nil, ErrNoCompilerDefined
 	}
 
@@ -287,9 +288,11 @@ func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.Stagi
 	case "http", "https":
 		return parsed, nil
 	case "":
-		break
+		if config.FileServerURL == "" {
+			return nil, ErrNoFileServerURL
+		}
 	default:
-		return nil, errors.New("wTF")
+		return nil, &UnknownSchemeError{Scheme: parsed.Scheme}
 	}
 
 	staticPath, err := routes.FileServerRoutes.CreatePathForRoute(routes.FS_STATIC, nil)
@@ -297,7 +300,7 @@ func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.Stagi
 		return nil, fmt.Errorf("couldn't generate the compiler download path: %s", err)
 	}
 
-	urlString := urljoiner.Join(backend.config.FileServerURL, staticPath, compilerPath)
+	urlString := urljoiner.Join(config.FileServerURL, staticPath, compilerPath)
 
 	url, err := url.ParseRequestURI(urlString)
 	if err != nil {
@@ -307,7 +310,7 @@ func (backend *traditionalBackend) compilerDownloadURL(request cc_messages.Stagi
 	return url, nil
 }
 
-func (backend *traditionalBackend) dropletUploadURL(request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
+func dropletUploadURL(config Config, request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
 	path, err := routes.FileServerRoutes.CreatePathForRoute(routes.FS_UPLOAD_DROPLET, rata.Params{
 		"guid": request.AppId,
 	})
@@ -315,7 +318,7 @@ func (backend *traditionalBackend) dropletUploadURL(request cc_messages.StagingR
 		return nil, fmt.Errorf("couldn't generate droplet upload URL: %s", err)
 	}
 
-	urlString := urljoiner.Join(backend.config.FileServerURL, path)
+	urlString := urljoiner.Join(config.FileServerURL, path)
 
 	u, err := url.ParseRequestURI(urlString)
 	if err != nil {
@@ -329,7 +332,7 @@ func (backend *traditionalBackend) dropletUploadURL(request cc_messages.StagingR
 	return u, nil
 }
 
-func (backend *traditionalBackend) buildArtifactsUploadURL(request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
+func buildArtifactsUploadURL(config Config, request cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
 	path, err := routes.FileServerRoutes.CreatePathForRoute(routes.FS_UPLOAD_BUILD_ARTIFACTS, rata.Params{
 		"app_guid": request.AppId,
 	})
@@ -337,7 +340,7 @@ func (backend *traditionalBackend) buildArtifactsUploadURL(request cc_messages.S
 		return nil, fmt.Errorf("couldn't generate build artifacts cache upload URL: %s", err)
 	}
 
-	urlString := urljoiner.Join(backend.config.FileServerURL, path)
+	urlString := urljoiner.Join(config.FileServerURL, path)
 
 	u, err := url.ParseRequestURI(urlString)
 	if err != nil {
@@ -351,7 +354,7 @@ func (backend *traditionalBackend) buildArtifactsUploadURL(request cc_messages.S
 	return u, nil
 }
 
-func (backend *traditionalBackend) buildArtifactsDownloadURL(buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
+func buildArtifactsDownloadURL(buildpackData cc_messages.BuildpackStagingData) (*url.URL, error) {
 	urlString := buildpackData.BuildArtifactsCacheDownloadUri
 	if urlString == "" {
 		return nil, nil
@@ -365,7 +368,7 @@ func (backend *traditionalBackend) buildArtifactsDownloadURL(buildpackData cc_me
 	return url, nil
 }
 
-func (backend *traditionalBackend) validateRequest(stagingRequest cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) error {
+func validateBuildpackRequest(stagingRequest cc_messages.StagingRequestFromCC, buildpackData cc_messages.BuildpackStagingData) error {
 	if len(stagingRequest.AppId) == 0 {
 		return ErrMissingAppId
 	}
@@ -377,15 +380,15 @@ func (backend *traditionalBackend) validateRequest(stagingRequest cc_messages.St
 	return nil
 }
 
-func traditionalTimeout(request cc_messages.StagingRequestFromCC, logger lager.Logger) time.Duration {
+func traditionalTimeout(request cc_messages.StagingRequestFromCC, defaultTimeout time.Duration, logger lager.Logger) time.Duration {
 	if request.Timeout > 0 {
 		return time.Duration(request.Timeout) * time.Second
 	} else {
 		logger.Info("overriding requested timeout", lager.Data{
 			"requested-timeout": request.Timeout,
-			"default-timeout":   DefaultStagingTimeout,
+			"default-timeout":   defaultTimeout,
 			"app-id":            request.AppId,
 		})
-		return DefaultStagingTimeout
+		return defaultTimeout
 	}
 }
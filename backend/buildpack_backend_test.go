@@ -242,13 +242,14 @@ var _ = Describe("TraditionalBackend", func() {
 		Ω(desiredTask.ResultFile).To(Equal("/tmp/result.json"))
 		Ω(desiredTask.Privileged).Should(BeTrue())
 
-		var annotation cc_messages.StagingTaskAnnotation
+		var annotation backend.StagingTaskAnnotation
 
 		err = json.Unmarshal([]byte(desiredTask.Annotation), &annotation)
 		Ω(err).ShouldNot(HaveOccurred())
 
-		Ω(annotation).Should(Equal(cc_messages.StagingTaskAnnotation{
+		Ω(annotation).Should(Equal(backend.StagingTaskAnnotation{
 			Lifecycle: "buildpack",
+			AppId:     appId,
 		}))
 
 		actions := actionsFromDesiredTask(desiredTask)
@@ -342,13 +343,14 @@ var _ = Describe("TraditionalBackend", func() {
 			Ω(desiredTask.LogSource).To(Equal(backend.TaskLogSource))
 			Ω(desiredTask.ResultFile).To(Equal("/tmp/result.json"))
 
-			var annotation cc_messages.StagingTaskAnnotation
+			var annotation backend.StagingTaskAnnotation
 
 			err = json.Unmarshal([]byte(desiredTask.Annotation), &annotation)
 			Ω(err).ShouldNot(HaveOccurred())
 
-			Ω(annotation).Should(Equal(cc_messages.StagingTaskAnnotation{
+			Ω(annotation).Should(Equal(backend.StagingTaskAnnotation{
 				Lifecycle: "buildpack",
+				AppId:     appId,
 			}))
 
 			actions := actionsFromDesiredTask(desiredTask)
@@ -418,6 +420,22 @@ var _ = Describe("TraditionalBackend", func() {
 			})
 		})
 
+		Context("when a 0 timeout is specified and a staging timeout is configured", func() {
+			BeforeEach(func() {
+				timeout = 0
+				config.StagingTimeout = 20 * time.Minute
+				traditional = backend.NewTraditionalBackend(config, lagertest.NewTestLogger("test"))
+			})
+
+			It("uses the configured timeout", func() {
+				desiredTask, err := traditional.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				timeoutAction := desiredTask.Action
+				Ω(timeoutAction.(*models.TimeoutAction).Timeout).Should(Equal(20 * time.Minute))
+			})
+		})
+
 		Context("when a negative timeout is specified in the staging request from CC", func() {
 			BeforeEach(func() {
 				timeout = -3
@@ -505,7 +523,7 @@ var _ = Describe("TraditionalBackend", func() {
 
 		It("returns an error", func() {
 			_, err := traditional.BuildRecipe(stagingGuid, stagingRequest)
-			Ω(err).Should(HaveOccurred())
+			Ω(err).Should(Equal(&backend.UnknownSchemeError{Scheme: "ftp"}))
 		})
 	})
 
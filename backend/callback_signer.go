@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+)
+
+const (
+	CallbackExpiresParam   = "expires"
+	CallbackSignatureParam = "signature"
+)
+
+var ErrMissingCallbackSignature = errors.New("callback URL is not signed")
+var ErrInvalidCallbackSignature = errors.New("callback URL signature does not match")
+var ErrExpiredCallbackSignature = errors.New("callback URL signature has expired")
+
+// CallbackSigner signs completion callback URLs with a per-task HMAC token,
+// so that only the callback of the task the stager created is accepted for a
+// staging guid. Signatures expire after ttl, which must outlast the longest
+// staging plus Diego's callback retries. Queued stagings are signed again
+// when their task is created, so the time spent in the queue does not count.
+type CallbackSigner struct {
+	key   []byte
+	ttl   time.Duration
+	clock clock.Clock
+}
+
+func NewCallbackSigner(key []byte, ttl time.Duration, clock clock.Clock) *CallbackSigner {
+	return &CallbackSigner{
+		key:   key,
+		ttl:   ttl,
+		clock: clock,
+	}
+}
+
+// Sign returns the query parameters that authorize a callback for
+// stagingGuid until the signer's ttl elapses.
+func (s *CallbackSigner) Sign(stagingGuid string) url.Values {
+	expires := strconv.FormatInt(s.clock.Now().Add(s.ttl).Unix(), 10)
+
+	return url.Values{
+		CallbackExpiresParam:   {expires},
+		CallbackSignatureParam: {s.signature(stagingGuid, expires)},
+	}
+}
+
+// SignURL returns callbackURL with its signature replaced by one that
+// authorizes a callback for stagingGuid until the signer's ttl elapses. A URL
+// that cannot be parsed is returned as is.
+func (s *CallbackSigner) SignURL(stagingGuid, callbackURL string) string {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return callbackURL
+	}
+
+	query := u.Query()
+	for key, values := range s.Sign(stagingGuid) {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// Verify checks that query carries an unexpired signature for stagingGuid.
+func (s *CallbackSigner) Verify(stagingGuid string, query url.Values) error {
+	expires := query.Get(CallbackExpiresParam)
+	signature := query.Get(CallbackSignatureParam)
+	if expires == "" || signature == "" {
+		return ErrMissingCallbackSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(s.signature(stagingGuid, expires))) {
+		return ErrInvalidCallbackSignature
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidCallbackSignature
+	}
+
+	if s.clock.Now().After(time.Unix(expiresAt, 0)) {
+		return ErrExpiredCallbackSignature
+	}
+
+	return nil
+}
+
+func (s *CallbackSigner) signature(stagingGuid, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(stagingGuid))
+	mac.Write([]byte{0})
+	mac.Write([]byte(expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
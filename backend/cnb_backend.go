@@ -0,0 +1,338 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/buildpack_app_lifecycle"
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	CNBLifecycleName = "cnb"
+
+	CNBLayersDir = "/tmp/layers"
+	CNBGroupPath = CNBLayersDir + "/group.toml"
+	CNBPlanPath  = CNBLayersDir + "/plan.toml"
+)
+
+// The traditional builder fetches custom buildpack URLs itself; the CNB
+// detector only sees buildpacks the task has already downloaded.
+var ErrCustomBuildpackNotSupported = errors.New("custom buildpacks are not supported for cnb staging")
+
+// CNBStagingResult is written by the CNB lifecycle's exporter to the task's
+// result file.
+type CNBStagingResult struct {
+	Buildpacks        []CNBBuildpack    `json:"buildpacks"`
+	ProcessTypes      map[string]string `json:"process_types"`
+	ExecutionMetadata string            `json:"execution_metadata"`
+}
+
+// CNBBuildpack is one buildpack of the group the detector selected, in the
+// order they ran. Key is empty for buildpacks that were not in the staging
+// request, such as those the lifecycle bundle provides itself.
+type CNBBuildpack struct {
+	Key     string `json:"key"`
+	ID      string `json:"id"`
+	Version string `json:"version"`
+}
+
+// cnbBackend stages apps with Cloud Native Buildpacks. It accepts the same
+// lifecycle data as the traditional backend, and lays out the app, the
+// buildpacks and the build artifacts cache in the same places, so both can
+// share buildpack caches on a cell. The CNB lifecycle bundle configured for
+// "cnb/<stack>" provides the detector, restorer, builder and exporter phases.
+type cnbBackend struct {
+	config Config
+	logger lager.Logger
+}
+
+func NewCNBBackend(config Config, logger lager.Logger) Backend {
+	return &cnbBackend{
+		config: config,
+		logger: logger.Session("cnb"),
+	}
+}
+
+func (backend *cnbBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (receptor.TaskCreateRequest, error) {
+	logger := backend.logger.Session("build-recipe")
+	logger.Info("staging-request", lager.Data{"Request": backend.config.Redactor.Redact(request)})
+
+	if request.LifecycleData == nil {
+		return receptor.TaskCreateRequest{}, ErrMissingLifecycleData
+	}
+
+	var lifecycleData cc_messages.BuildpackStagingData
+	err := json.Unmarshal(*request.LifecycleData, &lifecycleData)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	err = validateBuildpackRequest(request, lifecycleData)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	for _, buildpack := range lifecycleData.Buildpacks {
+		if buildpack.Name == cc_messages.CUSTOM_BUILDPACK {
+			return receptor.TaskCreateRequest{}, ErrCustomBuildpackNotSupported
+		}
+	}
+
+	lifecycleURL, err := compilerDownloadURL(backend.config, CNBLifecycleName+"/"+request.Stack)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	buildpacksOrder := []string{}
+	for _, buildpack := range lifecycleData.Buildpacks {
+		buildpacksOrder = append(buildpacksOrder, buildpack.Key)
+	}
+
+	skipDetect := len(lifecycleData.Buildpacks) == 1 && lifecycleData.Buildpacks[0].SkipDetect
+
+	builderConfig := buildpack_app_lifecycle.NewLifecycleBuilderConfig(buildpacksOrder, skipDetect, backend.config.SkipCertVerify)
+	lifecycleDir := path.Dir(builderConfig.ExecutablePath)
+	buildpacksDir := path.Dir(builderConfig.BuildpackPath(""))
+
+	timeout := traditionalTimeout(request, backend.config.defaultStagingTimeout(), backend.logger)
+
+	actions := []models.Action{}
+
+	//Download app package
+	actions = append(actions, &models.DownloadAction{
+		Artifact: "app package",
+		From:     lifecycleData.AppBitsDownloadUri,
+		To:       builderConfig.BuildDir(),
+	})
+
+	downloadActions := []models.Action{}
+	downloadNames := []string{}
+
+	//Download CNB lifecycle
+	downloadActions = append(
+		downloadActions,
+		models.EmitProgressFor(
+			&models.DownloadAction{
+				From:     lifecycleURL.String(),
+				To:       lifecycleDir,
+				CacheKey: fmt.Sprintf("cnb-lifecycle-%s", request.Stack),
+			},
+			"",
+			"",
+			"Failed to set up staging environment",
+		),
+	)
+
+	//Download buildpacks
+	buildpackNames := []string{}
+	for _, buildpack := range lifecycleData.Buildpacks {
+		buildpackNames = append(buildpackNames, buildpack.Name)
+		downloadActions = append(
+			downloadActions,
+			&models.DownloadAction{
+				Artifact: buildpack.Name,
+				From:     buildpack.Url,
+				To:       builderConfig.BuildpackPath(buildpack.Key),
+				CacheKey: buildpack.Key,
+			},
+		)
+	}
+
+	downloadNames = append(downloadNames, fmt.Sprintf("buildpacks (%s)", strings.Join(buildpackNames, ", ")))
+
+	//Download build artifacts cache
+	downloadURL, err := buildArtifactsDownloadURL(lifecycleData)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	if downloadURL != nil {
+		downloadActions = append(
+			downloadActions,
+			models.Try(
+				&models.DownloadAction{
+					Artifact: "build artifacts cache",
+					From:     downloadURL.String(),
+					To:       builderConfig.BuildArtifactsCacheDir(),
+				},
+			),
+		)
+		downloadNames = append(downloadNames, "build artifacts cache")
+	}
+
+	downloadMsg := fmt.Sprintf("Downloading %s...", strings.Join(downloadNames, ", "))
+	actions = append(actions, models.EmitProgressFor(models.Parallel(downloadActions...), downloadMsg, "Downloaded buildpacks", "Downloading buildpacks failed"))
+
+	fileDescriptorLimit := uint64(request.FileDescriptors)
+	env := request.Environment.BBSEnvironment()
+
+	phase := func(name string, args ...string) models.Action {
+		return &models.RunAction{
+			Path: path.Join(lifecycleDir, name),
+			Args: args,
+			Env:  env,
+			ResourceLimits: models.ResourceLimits{
+				Nofile: &fileDescriptorLimit,
+			},
+		}
+	}
+
+	//Run CNB lifecycle phases
+	actions = append(
+		actions,
+		models.EmitProgressFor(
+			models.Serial(
+				phase("detector",
+					"-app="+builderConfig.BuildDir(),
+					"-buildpacks="+buildpacksDir,
+					"-buildpackOrder="+strings.Join(buildpacksOrder, ","),
+					fmt.Sprintf("-skipDetect=%t", skipDetect),
+					"-group="+CNBGroupPath,
+					"-plan="+CNBPlanPath,
+				),
+				phase("restorer",
+					"-cacheDir="+builderConfig.BuildArtifactsCacheDir(),
+					"-group="+CNBGroupPath,
+					"-layers="+CNBLayersDir,
+				),
+				phase("builder",
+					"-app="+builderConfig.BuildDir(),
+					"-buildpacks="+buildpacksDir,
+					"-group="+CNBGroupPath,
+					"-plan="+CNBPlanPath,
+					"-layers="+CNBLayersDir,
+				),
+				phase("exporter",
+					"-app="+builderConfig.BuildDir(),
+					"-group="+CNBGroupPath,
+					"-layers="+CNBLayersDir,
+					"-outputBuildArtifactsCache="+builderConfig.OutputBuildArtifactsCache(),
+					"-outputDroplet="+builderConfig.OutputDroplet(),
+					"-outputMetadata="+builderConfig.OutputMetadata(),
+				),
+			),
+			"Staging...",
+			"Staging complete",
+			"Staging failed",
+		),
+	)
+
+	//Upload droplet
+	uploadActions := []models.Action{}
+	uploadNames := []string{}
+	uploadURL, err := dropletUploadURL(backend.config, request, lifecycleData)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	uploadActions = append(
+		uploadActions,
+		&models.UploadAction{
+			Artifact: "droplet",
+			From:     builderConfig.OutputDroplet(),
+			To:       addTimeoutParamToURL(*uploadURL, timeout).String(),
+		},
+	)
+	uploadNames = append(uploadNames, "droplet")
+
+	//Upload build artifacts cache
+	uploadURL, err = buildArtifactsUploadURL(backend.config, request, lifecycleData)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	uploadActions = append(uploadActions,
+		models.Try(
+			&models.UploadAction{
+				Artifact: "build artifacts cache",
+				From:     builderConfig.OutputBuildArtifactsCache(),
+				To:       addTimeoutParamToURL(*uploadURL, timeout).String(),
+			},
+		),
+	)
+	uploadNames = append(uploadNames, "build artifacts cache")
+
+	uploadMsg := fmt.Sprintf("Uploading %s...", strings.Join(uploadNames, ", "))
+	actions = append(actions, models.EmitProgressFor(models.Parallel(uploadActions...), uploadMsg, "Uploading complete", "Uploading failed"))
+
+	annotationJson, _ := json.Marshal(StagingTaskAnnotation{
+		Lifecycle: CNBLifecycleName,
+		AppId:     request.AppId,
+	})
+
+	task := receptor.TaskCreateRequest{
+		TaskGuid:              stagingGuid,
+		Domain:                backend.config.TaskDomain,
+		Stack:                 request.Stack,
+		ResultFile:            builderConfig.OutputMetadata(),
+		MemoryMB:              request.MemoryMB,
+		DiskMB:                request.DiskMB,
+		CPUWeight:             StagingTaskCpuWeight,
+		Action:                models.Timeout(models.Serial(actions...), timeout),
+		LogGuid:               request.LogGuid,
+		LogSource:             TaskLogSource,
+		CompletionCallbackURL: backend.config.CallbackURL(stagingGuid),
+		EgressRules:           request.EgressRules,
+		Annotation:            string(annotationJson),
+		Privileged:            false,
+		EnvironmentVariables:  []receptor.EnvironmentVariable{{"LANG", DefaultLANG}},
+	}
+
+	logger.Debug("staging-task-request", lager.Data{"TaskCreateRequest": backend.config.Redactor.Redact(task)})
+
+	return task, nil
+}
+
+func (backend *cnbBackend) BuildStagingResponse(taskResponse receptor.TaskResponse) (cc_messages.StagingResponseForCC, error) {
+	var response cc_messages.StagingResponseForCC
+
+	var annotation StagingTaskAnnotation
+	err := json.Unmarshal([]byte(taskResponse.Annotation), &annotation)
+	if err != nil {
+		return cc_messages.StagingResponseForCC{}, err
+	}
+
+	if taskResponse.Failed {
+		response.Error = backend.config.Sanitizer(taskResponse.FailureReason)
+	} else {
+		var result CNBStagingResult
+		err := json.Unmarshal([]byte(taskResponse.Result), &result)
+		if err != nil {
+			return cc_messages.StagingResponseForCC{}, err
+		}
+
+		// Every buildpack of the group contributed to the droplet, but the CC
+		// records one. As with the final buildpack of a traditional
+		// multi-buildpack staging, that is the last buildpack of the group
+		// that came from the staging request: it runs after the others and
+		// provides the start command.
+		buildpackResponse := cc_messages.BuildpackStagingResponse{}
+		detected := []string{}
+		for _, buildpack := range result.Buildpacks {
+			detected = append(detected, fmt.Sprintf("%s@%s", buildpack.ID, buildpack.Version))
+			if buildpack.Key != "" {
+				buildpackResponse.BuildpackKey = buildpack.Key
+			}
+		}
+		buildpackResponse.DetectedBuildpack = strings.Join(detected, ", ")
+
+		lifecycleDataJSON, err := json.Marshal(buildpackResponse)
+		if err != nil {
+			return cc_messages.StagingResponseForCC{}, err
+		}
+		lifecycleData := json.RawMessage(lifecycleDataJSON)
+
+		response.ExecutionMetadata = result.ExecutionMetadata
+		response.DetectedStartCommand = result.ProcessTypes
+		response.LifecycleData = &lifecycleData
+	}
+
+	return response, nil
+}
@@ -0,0 +1,322 @@
+package backend_test
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+var _ = Describe("CNBBackend", func() {
+	var (
+		cnb            backend.Backend
+		config         backend.Config
+		stagingRequest cc_messages.StagingRequestFromCC
+		stagingGuid    string
+		timeout        int
+		buildpacks     []cc_messages.Buildpack
+		appBitsURI     string
+	)
+
+	BeforeEach(func() {
+		config = backend.Config{
+			TaskDomain:    "config-task-domain",
+			StagerURL:     "http://the-stager.example.com",
+			FileServerURL: "http://file-server.com",
+			Lifecycles: map[string]string{
+				"cnb/rabbit_hole":       "cnb-lifecycle.tgz",
+				"buildpack/rabbit_hole": "rabbit-hole-compiler",
+			},
+			Sanitizer: func(msg string) *cc_messages.StagingError {
+				return &cc_messages.StagingError{Message: msg + " was totally sanitized"}
+			},
+		}
+
+		stagingGuid = "a-staging-guid"
+		timeout = 900
+		appBitsURI = "http://example-uri.com/bunny"
+		buildpacks = []cc_messages.Buildpack{
+			{Name: "zfirst", Key: "zfirst-buildpack", Url: "first-buildpack-url"},
+			{Name: "asecond", Key: "asecond-buildpack", Url: "second-buildpack-url"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		cnb = backend.NewCNBBackend(config, lagertest.NewTestLogger("test"))
+
+		lifecycleDataJSON, err := json.Marshal(cc_messages.BuildpackStagingData{
+			AppBitsDownloadUri:             appBitsURI,
+			BuildArtifactsCacheDownloadUri: "http://example-uri.com/bunny-droppings",
+			BuildArtifactsCacheUploadUri:   "http://example-uri.com/bunny-uppings",
+			Buildpacks:                     buildpacks,
+			DropletUploadUri:               "http://example-uri.com/droplet-upload",
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		lifecycleData := json.RawMessage(lifecycleDataJSON)
+
+		stagingRequest = cc_messages.StagingRequestFromCC{
+			AppId:           "bunny",
+			LogGuid:         "bunny",
+			Stack:           "rabbit_hole",
+			FileDescriptors: 512,
+			MemoryMB:        2048,
+			DiskMB:          3072,
+			Environment:     cc_messages.Environment{{"VCAP_APPLICATION", "foo"}},
+			Timeout:         timeout,
+			Lifecycle:       "cnb",
+			LifecycleData:   &lifecycleData,
+		}
+	})
+
+	Describe("request validation", func() {
+		Context("with a missing app bits download uri", func() {
+			BeforeEach(func() {
+				appBitsURI = ""
+			})
+
+			It("returns an error", func() {
+				_, err := cnb.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrMissingAppBitsDownloadUri))
+			})
+		})
+
+		Context("with a custom buildpack", func() {
+			BeforeEach(func() {
+				buildpacks = []cc_messages.Buildpack{
+					{Name: cc_messages.CUSTOM_BUILDPACK, Key: "http://github.com/some/buildpack", Url: "http://github.com/some/buildpack"},
+				}
+			})
+
+			It("returns an error", func() {
+				_, err := cnb.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrCustomBuildpackNotSupported))
+			})
+		})
+
+		Context("when no CNB lifecycle is configured for the stack", func() {
+			BeforeEach(func() {
+				delete(config.Lifecycles, "cnb/rabbit_hole")
+			})
+
+			It("returns an error", func() {
+				_, err := cnb.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrNoCompilerDefined))
+			})
+		})
+	})
+
+	It("creates a staging task in the configured domain", func() {
+		desiredTask, err := cnb.BuildRecipe(stagingGuid, stagingRequest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(desiredTask.Domain).Should(Equal("config-task-domain"))
+		Ω(desiredTask.TaskGuid).Should(Equal(stagingGuid))
+		Ω(desiredTask.Stack).Should(Equal("rabbit_hole"))
+		Ω(desiredTask.ResultFile).Should(Equal("/tmp/result.json"))
+		Ω(desiredTask.MemoryMB).Should(Equal(2048))
+		Ω(desiredTask.DiskMB).Should(Equal(3072))
+		Ω(desiredTask.CompletionCallbackURL).Should(Equal("http://the-stager.example.com/v1/staging/a-staging-guid/completed"))
+
+		var annotation backend.StagingTaskAnnotation
+		err = json.Unmarshal([]byte(desiredTask.Annotation), &annotation)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(annotation).Should(Equal(backend.StagingTaskAnnotation{
+			Lifecycle: "cnb",
+			AppId:     "bunny",
+		}))
+	})
+
+	It("downloads the app, the CNB lifecycle and the buildpacks using the traditional layout", func() {
+		desiredTask, err := cnb.BuildRecipe(stagingGuid, stagingRequest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		actions := actionsFromDesiredTask(desiredTask)
+		Ω(actions).Should(HaveLen(4))
+
+		Ω(actions[0]).Should(Equal(&models.DownloadAction{
+			Artifact: "app package",
+			From:     "http://example-uri.com/bunny",
+			To:       "/tmp/app",
+		}))
+
+		Ω(actions[1]).Should(Equal(models.EmitProgressFor(
+			models.Parallel(
+				models.EmitProgressFor(
+					&models.DownloadAction{
+						From:     "http://file-server.com/v1/static/cnb-lifecycle.tgz",
+						To:       "/tmp/lifecycle",
+						CacheKey: "cnb-lifecycle-rabbit_hole",
+					},
+					"",
+					"",
+					"Failed to set up staging environment",
+				),
+				&models.DownloadAction{
+					Artifact: "zfirst",
+					From:     "first-buildpack-url",
+					To:       "/tmp/buildpacks/0fe7d5fc3f73b0ab8682a664da513fbd",
+					CacheKey: "zfirst-buildpack",
+				},
+				&models.DownloadAction{
+					Artifact: "asecond",
+					From:     "second-buildpack-url",
+					To:       "/tmp/buildpacks/58015c32d26f0ad3418f87dd9bf47797",
+					CacheKey: "asecond-buildpack",
+				},
+				models.Try(
+					&models.DownloadAction{
+						Artifact: "build artifacts cache",
+						From:     "http://example-uri.com/bunny-droppings",
+						To:       "/tmp/cache",
+					},
+				),
+			),
+			"Downloading buildpacks (zfirst, asecond), build artifacts cache...",
+			"Downloaded buildpacks",
+			"Downloading buildpacks failed",
+		)))
+	})
+
+	It("runs the detector, restorer, builder and exporter phases in order", func() {
+		desiredTask, err := cnb.BuildRecipe(stagingGuid, stagingRequest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		actions := actionsFromDesiredTask(desiredTask)
+		emitProgressAction, ok := actions[2].(*models.EmitProgressAction)
+		Ω(ok).Should(BeTrue())
+		Ω(emitProgressAction.StartMessage).Should(Equal("Staging..."))
+
+		phases := emitProgressAction.Action.(*models.SerialAction).Actions
+		Ω(phases).Should(HaveLen(4))
+
+		paths := []string{}
+		for _, phase := range phases {
+			runAction := phase.(*models.RunAction)
+			Ω(runAction.Env).Should(Equal([]models.EnvironmentVariable{{"VCAP_APPLICATION", "foo"}}))
+			paths = append(paths, runAction.Path)
+		}
+
+		Ω(paths).Should(Equal([]string{
+			"/tmp/lifecycle/detector",
+			"/tmp/lifecycle/restorer",
+			"/tmp/lifecycle/builder",
+			"/tmp/lifecycle/exporter",
+		}))
+
+		Ω(phases[0].(*models.RunAction).Args).Should(ContainElement("-buildpackOrder=zfirst-buildpack,asecond-buildpack"))
+		Ω(phases[1].(*models.RunAction).Args).Should(ContainElement("-cacheDir=/tmp/cache"))
+		Ω(phases[3].(*models.RunAction).Args).Should(ContainElement("-outputDroplet=/tmp/droplet"))
+		Ω(phases[3].(*models.RunAction).Args).Should(ContainElement("-outputMetadata=/tmp/result.json"))
+	})
+
+	It("uploads the droplet and the build artifacts cache", func() {
+		desiredTask, err := cnb.BuildRecipe(stagingGuid, stagingRequest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		actions := actionsFromDesiredTask(desiredTask)
+		Ω(actions[3]).Should(Equal(models.EmitProgressFor(
+			models.Parallel(
+				&models.UploadAction{
+					Artifact: "droplet",
+					From:     "/tmp/droplet",
+					To:       "http://file-server.com/v1/droplet/bunny?" + models.CcDropletUploadUriKey + "=http%3A%2F%2Fexample-uri.com%2Fdroplet-upload" + "&" + models.CcTimeoutKey + "=" + fmt.Sprintf("%d", timeout),
+				},
+				models.Try(
+					&models.UploadAction{
+						Artifact: "build artifacts cache",
+						From:     "/tmp/output-cache",
+						To:       "http://file-server.com/v1/build_artifacts/bunny?" + models.CcBuildArtifactsUploadUriKey + "=http%3A%2F%2Fexample-uri.com%2Fbunny-uppings" + "&" + models.CcTimeoutKey + "=" + fmt.Sprintf("%d", timeout),
+					},
+				),
+			),
+			"Uploading droplet, build artifacts cache...",
+			"Uploading complete",
+			"Uploading failed",
+		)))
+	})
+
+	Describe("BuildStagingResponse", func() {
+		var taskResponse receptor.TaskResponse
+
+		BeforeEach(func() {
+			taskResponse = receptor.TaskResponse{
+				Annotation: `{"lifecycle": "cnb"}`,
+				Result: `{
+					"buildpacks": [
+						{"key": "zfirst-buildpack", "id": "org.example.first", "version": "1.0.0"},
+						{"key": "asecond-buildpack", "id": "org.example.second", "version": "2.0.0"}
+					],
+					"process_types": {"web": "./start"},
+					"execution_metadata": "metadata"
+				}`,
+			}
+		})
+
+		It("maps the exporter's result into the response for the CC", func() {
+			response, err := cnb.BuildStagingResponse(taskResponse)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(response.ExecutionMetadata).Should(Equal("metadata"))
+			Ω(response.DetectedStartCommand).Should(Equal(map[string]string{"web": "./start"}))
+			Ω(response.LifecycleData).ShouldNot(BeNil())
+			Ω([]byte(*response.LifecycleData)).Should(MatchJSON(`{
+				"buildpack_key": "asecond-buildpack",
+				"detected_buildpack": "org.example.first@1.0.0, org.example.second@2.0.0"
+			}`))
+		})
+
+		Context("when the group ends with a buildpack that was not in the staging request", func() {
+			BeforeEach(func() {
+				taskResponse.Result = `{
+					"buildpacks": [
+						{"key": "zfirst-buildpack", "id": "org.example.first", "version": "1.0.0"},
+						{"id": "org.example.procfile", "version": "0.1.0"}
+					],
+					"process_types": {"web": "./start"}
+				}`
+			})
+
+			It("reports the last buildpack of the group that was requested", func() {
+				response, err := cnb.BuildStagingResponse(taskResponse)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω([]byte(*response.LifecycleData)).Should(MatchJSON(`{
+					"buildpack_key": "zfirst-buildpack",
+					"detected_buildpack": "org.example.first@1.0.0, org.example.procfile@0.1.0"
+				}`))
+			})
+		})
+
+		Context("when the task failed", func() {
+			BeforeEach(func() {
+				taskResponse.Failed = true
+				taskResponse.FailureReason = "some-failure-reason"
+			})
+
+			It("sanitizes the failure reason", func() {
+				response, err := cnb.BuildStagingResponse(taskResponse)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response).Should(Equal(cc_messages.StagingResponseForCC{
+					Error: &cc_messages.StagingError{Message: "some-failure-reason was totally sanitized"},
+				}))
+			})
+		})
+
+		Context("when the result is invalid", func() {
+			BeforeEach(func() {
+				taskResponse.Result = "invalid-json"
+			})
+
+			It("returns an error", func() {
+				_, err := cnb.BuildStagingResponse(taskResponse)
+				Ω(err).Should(BeAssignableToTypeOf(&json.SyntaxError{}))
+			})
+		})
+	})
+})
@@ -3,8 +3,6 @@ package backend
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
-	"net/url"
 	"path"
 	"time"
 
@@ -12,8 +10,6 @@ import (
 	"github.com/cloudfoundry-incubator/receptor"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/cloudfoundry-incubator/runtime-schema/models"
-	"github.com/cloudfoundry-incubator/runtime-schema/routes"
-	"github.com/cloudfoundry/gunk/urljoiner"
 	"github.com/pivotal-golang/lager"
 )
 
@@ -21,9 +17,29 @@ const (
 	DockerLifecycleName         = "docker"
 	DockerBuilderExecutablePath = "/tmp/docker_app_lifecycle/builder"
 	DockerBuilderOutputPath     = "/tmp/docker-result/result.json"
+
+	DockerUserEnvKey     = "CF_DOCKER_USER"
+	DockerPasswordEnvKey = "CF_DOCKER_PASSWORD"
+	DockerEmailEnvKey    = "CF_DOCKER_EMAIL"
 )
 
 var ErrMissingDockerImageUrl = errors.New("missing docker image download url")
+var ErrUnknownDockerCredentials = errors.New("unknown docker registry credentials")
+var ErrConflictingDockerCredentials = errors.New("docker registry credentials must be given either by name or by user and password, not both")
+var ErrIncompleteDockerCredentials = errors.New("docker registry credentials require both a user and a password")
+
+// DockerStagingData is the lifecycle data the CC sends for the docker
+// lifecycle. Besides the image, it may carry the credentials needed to pull
+// it from a private registry, either inline or as the name of credentials
+// held in Config.DockerRegistryCredentials.
+type DockerStagingData struct {
+	cc_messages.DockerStagingData
+
+	DockerUser        string `json:"docker_user,omitempty"`
+	DockerPassword    string `json:"docker_password,omitempty"`
+	DockerEmail       string `json:"docker_email,omitempty"`
+	DockerCredentials string `json:"docker_credentials,omitempty"`
+}
 
 type dockerBackend struct {
 	config Config
@@ -39,9 +55,13 @@ func NewDockerBackend(config Config, logger lager.Logger) Backend {
 
 func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (receptor.TaskCreateRequest, error) {
 	logger := backend.logger.Session("build-recipe")
-	logger.Info("staging-request", lager.Data{"Request": request})
+	logger.Info("staging-request", lager.Data{"Request": backend.config.Redactor.Redact(request)})
 
-	var lifecycleData cc_messages.DockerStagingData
+	if request.LifecycleData == nil {
+		return receptor.TaskCreateRequest{}, ErrMissingLifecycleData
+	}
+
+	var lifecycleData DockerStagingData
 	err := json.Unmarshal(*request.LifecycleData, &lifecycleData)
 	if err != nil {
 		return receptor.TaskCreateRequest{}, err
@@ -52,7 +72,12 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 		return receptor.TaskCreateRequest{}, err
 	}
 
-	compilerURL, err := backend.compilerDownloadURL()
+	credentials, err := backend.registryCredentials(lifecycleData)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	compilerURL, err := compilerDownloadURL(backend.config, DockerLifecycleName)
 	if err != nil {
 		return receptor.TaskCreateRequest{}, err
 	}
@@ -94,8 +119,9 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 		),
 	)
 
-	annotationJson, _ := json.Marshal(cc_messages.StagingTaskAnnotation{
+	annotationJson, _ := json.Marshal(StagingTaskAnnotation{
 		Lifecycle: DockerLifecycleName,
+		AppId:     request.AppId,
 	})
 
 	task := receptor.TaskCreateRequest{
@@ -105,16 +131,17 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 		Stack:                 request.Stack,
 		MemoryMB:              request.MemoryMB,
 		DiskMB:                request.DiskMB,
-		Action:                models.Timeout(models.Serial(actions...), dockerTimeout(request, backend.logger)),
+		Action:                models.Timeout(models.Serial(actions...), dockerTimeout(request, backend.config.defaultStagingTimeout(), backend.logger)),
 		CompletionCallbackURL: backend.config.CallbackURL(stagingGuid),
 		LogGuid:               request.LogGuid,
 		LogSource:             TaskLogSource,
 		Annotation:            string(annotationJson),
 		EgressRules:           request.EgressRules,
 		Privileged:            false,
+		EnvironmentVariables:  credentials.environment(),
 	}
 
-	logger.Debug("staging-task-request", lager.Data{"TaskCreateRequest": task})
+	logger.Debug("staging-task-request", lager.Data{"TaskCreateRequest": backend.config.Redactor.Redact(task)})
 
 	return task, nil
 }
@@ -122,7 +149,7 @@ func (backend *dockerBackend) BuildRecipe(stagingGuid string, request cc_message
 func (backend *dockerBackend) BuildStagingResponse(taskResponse receptor.TaskResponse) (cc_messages.StagingResponseForCC, error) {
 	var response cc_messages.StagingResponseForCC
 
-	var annotation cc_messages.StagingTaskAnnotation
+	var annotation StagingTaskAnnotation
 	err := json.Unmarshal([]byte(taskResponse.Annotation), &annotation)
 	if err != nil {
 		return cc_messages.StagingResponseForCC{}, err
@@ -144,42 +171,55 @@ func (backend *dockerBackend) BuildStagingResponse(taskResponse receptor.TaskRes
 	return response, nil
 }
 
-func (backend *dockerBackend) compilerDownloadURL() (*url.URL, error) {
-	lifecycleFilename := backend.config.Lifecycles["docker"]
-	if lifecycleFilename == "" {
-		return nil, ErrNoCompilerDefined
+func (backend *dockerBackend) registryCredentials(dockerData DockerStagingData) (*DockerCredentials, error) {
+	inline := dockerData.DockerUser != "" || dockerData.DockerPassword != "" || dockerData.DockerEmail != ""
+
+	if dockerData.DockerCredentials != "" {
+		if inline {
+			return nil, ErrConflictingDockerCredentials
+		}
+
+		credentials, ok := backend.config.DockerRegistryCredentials[dockerData.DockerCredentials]
+		if !ok {
+			return nil, ErrUnknownDockerCredentials
+		}
+
+		return &credentials, nil
 	}
 
-	parsed, err := url.Parse(lifecycleFilename)
-	if err != nil {
-		return nil, errors.New("couldn't parse compiler URL")
+	if !inline {
+		return nil, nil
 	}
 
-	switch parsed.Scheme {
-	case "http", "https":
-		return parsed, nil
-	case "":
-		break
-	default:
-		return nil, fmt.Errorf("unknown scheme: '%s'", parsed.Scheme)
+	if dockerData.DockerUser == "" || dockerData.DockerPassword == "" {
+		return nil, ErrIncompleteDockerCredentials
 	}
 
-	staticPath, err := routes.FileServerRoutes.CreatePathForRoute(routes.FS_STATIC, nil)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't generate the compiler download path: %s", err)
+	return &DockerCredentials{
+		User:     dockerData.DockerUser,
+		Password: dockerData.DockerPassword,
+		Email:    dockerData.DockerEmail,
+	}, nil
+}
+
+func (credentials *DockerCredentials) environment() []receptor.EnvironmentVariable {
+	if credentials == nil {
+		return nil
 	}
 
-	urlString := urljoiner.Join(backend.config.FileServerURL, staticPath, lifecycleFilename)
+	env := []receptor.EnvironmentVariable{
+		{Name: DockerUserEnvKey, Value: credentials.User},
+		{Name: DockerPasswordEnvKey, Value: credentials.Password},
+	}
 
-	url, err := url.ParseRequestURI(urlString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse compiler download URL: %s", err)
+	if credentials.Email != "" {
+		env = append(env, receptor.EnvironmentVariable{Name: DockerEmailEnvKey, Value: credentials.Email})
 	}
 
-	return url, nil
+	return env
 }
 
-func (backend *dockerBackend) validateRequest(stagingRequest cc_messages.StagingRequestFromCC, dockerData cc_messages.DockerStagingData) error {
+func (backend *dockerBackend) validateRequest(stagingRequest cc_messages.StagingRequestFromCC, dockerData DockerStagingData) error {
 	if len(stagingRequest.AppId) == 0 {
 		return ErrMissingAppId
 	}
@@ -191,15 +231,15 @@ func (backend *dockerBackend) validateRequest(stagingRequest cc_messages.Staging
 	return nil
 }
 
-func dockerTimeout(request cc_messages.StagingRequestFromCC, logger lager.Logger) time.Duration {
+func dockerTimeout(request cc_messages.StagingRequestFromCC, defaultTimeout time.Duration, logger lager.Logger) time.Duration {
 	if request.Timeout > 0 {
 		return time.Duration(request.Timeout) * time.Second
 	} else {
 		logger.Info("overriding requested timeout", lager.Data{
 			"requested-timeout": request.Timeout,
-			"default-timeout":   DefaultStagingTimeout,
+			"default-timeout":   defaultTimeout,
 			"app-id":            request.AppId,
 		})
-		return DefaultStagingTimeout
+		return defaultTimeout
 	}
 }
@@ -12,7 +12,7 @@ import (
 	"github.com/cloudfoundry-incubator/stager/backend"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
 )
 
 var _ = Describe("DockerBackend", func() {
@@ -22,6 +22,7 @@ var _ = Describe("DockerBackend", func() {
 		runAction             models.Action
 		config                backend.Config
 		docker                backend.Backend
+		logger                *lagertest.TestLogger
 
 		stagingGuid     string
 		appId           string
@@ -31,6 +32,11 @@ var _ = Describe("DockerBackend", func() {
 		diskMB          int
 		timeout         int
 		egressRules     []models.SecurityGroupRule
+
+		dockerUser        string
+		dockerPassword    string
+		dockerEmail       string
+		dockerCredentials string
 	)
 
 	BeforeEach(func() {
@@ -43,6 +49,11 @@ var _ = Describe("DockerBackend", func() {
 
 		stagingGuid = "a-staging-guid"
 
+		dockerUser = ""
+		dockerPassword = ""
+		dockerEmail = ""
+		dockerCredentials = ""
+
 		stagerURL := "http://the-stager.example.com"
 
 		config = backend.Config{
@@ -59,10 +70,15 @@ var _ = Describe("DockerBackend", func() {
 			Sanitizer: func(msg string) *cc_messages.StagingError {
 				return &cc_messages.StagingError{Message: msg + " was totally sanitized"}
 			},
+			DockerRegistryCredentials: map[string]backend.DockerCredentials{
+				"private-registry": {
+					User:     "named-user",
+					Password: "named-password",
+				},
+			},
 		}
 
-		logger := lager.NewLogger("fakelogger")
-		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.DEBUG))
+		logger = lagertest.NewTestLogger("fakelogger")
 
 		docker = backend.NewDockerBackend(config, logger)
 
@@ -117,8 +133,14 @@ var _ = Describe("DockerBackend", func() {
 	})
 
 	JustBeforeEach(func() {
-		dockerStagingData := cc_messages.DockerStagingData{
-			DockerImageUrl: dockerImageUrl,
+		dockerStagingData := backend.DockerStagingData{
+			DockerStagingData: cc_messages.DockerStagingData{
+				DockerImageUrl: dockerImageUrl,
+			},
+			DockerUser:        dockerUser,
+			DockerPassword:    dockerPassword,
+			DockerEmail:       dockerEmail,
+			DockerCredentials: dockerCredentials,
 		}
 		lifecycleDataJSON, err := json.Marshal(dockerStagingData)
 		Ω(err).ShouldNot(HaveOccurred())
@@ -192,13 +214,14 @@ var _ = Describe("DockerBackend", func() {
 		Ω(desiredTask.ResultFile).To(Equal("/tmp/docker-result/result.json"))
 		Ω(desiredTask.Privileged).Should(BeFalse())
 
-		var annotation cc_messages.StagingTaskAnnotation
+		var annotation backend.StagingTaskAnnotation
 
 		err = json.Unmarshal([]byte(desiredTask.Annotation), &annotation)
 		Ω(err).ShouldNot(HaveOccurred())
 
-		Ω(annotation).Should(Equal(cc_messages.StagingTaskAnnotation{
+		Ω(annotation).Should(Equal(backend.StagingTaskAnnotation{
 			Lifecycle: "docker",
+			AppId:     appId,
 		}))
 
 		actions := actionsFromDesiredTask(desiredTask)
@@ -211,6 +234,114 @@ var _ = Describe("DockerBackend", func() {
 		Ω(desiredTask.EgressRules).Should(ConsistOf(egressRules))
 	})
 
+	It("does not pass registry credentials to the builder when none are given", func() {
+		desiredTask, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(desiredTask.EnvironmentVariables).Should(BeEmpty())
+	})
+
+	Describe("registry credentials", func() {
+		Context("when a user, password and email are given", func() {
+			BeforeEach(func() {
+				dockerUser = "inline-user"
+				dockerPassword = "inline-password"
+				dockerEmail = "inline@example.com"
+			})
+
+			It("passes them to the builder through the task environment", func() {
+				desiredTask, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(desiredTask.EnvironmentVariables).Should(Equal([]receptor.EnvironmentVariable{
+					{Name: "CF_DOCKER_USER", Value: "inline-user"},
+					{Name: "CF_DOCKER_PASSWORD", Value: "inline-password"},
+					{Name: "CF_DOCKER_EMAIL", Value: "inline@example.com"},
+				}))
+			})
+
+			It("does not pass them on the builder's command line", func() {
+				desiredTask, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				actions := actionsFromDesiredTask(desiredTask)
+				Ω(actions[1]).Should(Equal(runAction))
+			})
+
+			It("never logs them", func() {
+				_, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				contents := string(logger.Buffer().Contents())
+				Ω(contents).Should(ContainSubstring("staging-request"))
+				Ω(contents).Should(ContainSubstring("staging-task-request"))
+				Ω(contents).ShouldNot(ContainSubstring("inline-user"))
+				Ω(contents).ShouldNot(ContainSubstring("inline-password"))
+				Ω(contents).ShouldNot(ContainSubstring("inline@example.com"))
+				Ω(contents).Should(ContainSubstring("busybox"))
+			})
+		})
+
+		Context("when only a user is given", func() {
+			BeforeEach(func() {
+				dockerUser = "inline-user"
+			})
+
+			It("returns an error", func() {
+				_, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrIncompleteDockerCredentials))
+			})
+		})
+
+		Context("when named credentials are referenced", func() {
+			BeforeEach(func() {
+				dockerCredentials = "private-registry"
+			})
+
+			It("passes the configured credentials to the builder", func() {
+				desiredTask, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(desiredTask.EnvironmentVariables).Should(Equal([]receptor.EnvironmentVariable{
+					{Name: "CF_DOCKER_USER", Value: "named-user"},
+					{Name: "CF_DOCKER_PASSWORD", Value: "named-password"},
+				}))
+			})
+
+			It("never logs them", func() {
+				_, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				contents := string(logger.Buffer().Contents())
+				Ω(contents).ShouldNot(ContainSubstring("named-user"))
+				Ω(contents).ShouldNot(ContainSubstring("named-password"))
+			})
+
+			Context("when the credentials are not configured", func() {
+				BeforeEach(func() {
+					dockerCredentials = "unknown-registry"
+				})
+
+				It("returns an error", func() {
+					_, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+					Ω(err).Should(Equal(backend.ErrUnknownDockerCredentials))
+				})
+			})
+
+			Context("when inline credentials are given as well", func() {
+				BeforeEach(func() {
+					dockerUser = "inline-user"
+					dockerPassword = "inline-password"
+				})
+
+				It("returns an error", func() {
+					_, err := docker.BuildRecipe(stagingGuid, stagingRequest)
+					Ω(err).Should(Equal(backend.ErrConflictingDockerCredentials))
+				})
+			})
+		})
+	})
+
 	It("gives the task a callback URL to call it back", func() {
 		desiredTask, err := docker.BuildRecipe(stagingGuid, stagingRequest)
 		Ω(err).ShouldNot(HaveOccurred())
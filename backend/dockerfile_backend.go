@@ -0,0 +1,247 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	DockerfileLifecycleName         = "dockerfile"
+	DockerfileBuilderExecutablePath = "/tmp/dockerfile_app_lifecycle/builder"
+	DockerfileBuilderOutputPath     = "/tmp/dockerfile-result/result.json"
+	DockerfileAppDir                = "/tmp/app"
+	DefaultDockerfilePath           = "Dockerfile"
+)
+
+var ErrNoImageRegistry = errors.New("no image registry configured for dockerfile staging")
+var ErrInvalidDockerfilePath = errors.New("dockerfile path must be relative to the app root")
+
+// DockerfileStagingData is the lifecycle data the CC sends for the
+// dockerfile lifecycle.
+type DockerfileStagingData struct {
+	AppBitsDownloadUri string `json:"app_bits_download_uri"`
+	DockerfilePath     string `json:"dockerfile_path,omitempty"`
+}
+
+// DockerfileStagingResult is written by the dockerfile builder to the task's
+// result file.
+type DockerfileStagingResult struct {
+	DockerImage          string            `json:"docker_image"`
+	DockerImageDigest    string            `json:"docker_image_digest"`
+	ExecutionMetadata    string            `json:"execution_metadata"`
+	DetectedStartCommand map[string]string `json:"detected_start_command"`
+}
+
+// DockerfileStagingResponse is returned to the CC as the lifecycle data of a
+// successful dockerfile staging.
+type DockerfileStagingResponse struct {
+	DockerImage       string `json:"docker_image"`
+	DockerImageDigest string `json:"docker_image_digest"`
+}
+
+// dockerfileBackend builds an image from the Dockerfile in the app bits with
+// an unprivileged (rootless) image builder and pushes it to
+// Config.ImageRegistry, authenticating with Config.ImageRegistryCredentials.
+type dockerfileBackend struct {
+	config Config
+	logger lager.Logger
+}
+
+func NewDockerfileBackend(config Config, logger lager.Logger) Backend {
+	return &dockerfileBackend{
+		config: config,
+		logger: logger.Session("dockerfile"),
+	}
+}
+
+func (backend *dockerfileBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (receptor.TaskCreateRequest, error) {
+	logger := backend.logger.Session("build-recipe")
+	logger.Info("staging-request", lager.Data{"Request": backend.config.Redactor.Redact(request)})
+
+	if request.LifecycleData == nil {
+		return receptor.TaskCreateRequest{}, ErrMissingLifecycleData
+	}
+
+	var lifecycleData DockerfileStagingData
+	err := json.Unmarshal(*request.LifecycleData, &lifecycleData)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	err = backend.validateRequest(request, lifecycleData)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	credentials, err := backend.registryCredentials()
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	compilerURL, err := compilerDownloadURL(backend.config, DockerfileLifecycleName)
+	if err != nil {
+		return receptor.TaskCreateRequest{}, err
+	}
+
+	dockerfilePath := lifecycleData.DockerfilePath
+	if dockerfilePath == "" {
+		dockerfilePath = DefaultDockerfilePath
+	}
+
+	actions := []models.Action{}
+
+	//Download app package
+	actions = append(actions, &models.DownloadAction{
+		Artifact: "app package",
+		From:     lifecycleData.AppBitsDownloadUri,
+		To:       DockerfileAppDir,
+	})
+
+	//Download builder
+	actions = append(
+		actions,
+		models.EmitProgressFor(
+			&models.DownloadAction{
+				From:     compilerURL.String(),
+				To:       path.Dir(DockerfileBuilderExecutablePath),
+				CacheKey: "builder-dockerfile",
+			},
+			"",
+			"",
+			"Failed to set up dockerfile environment",
+		),
+	)
+
+	fileDescriptorLimit := uint64(request.FileDescriptors)
+
+	//Build and push image
+	actions = append(
+		actions,
+		models.EmitProgressFor(
+			&models.RunAction{
+				Path: DockerfileBuilderExecutablePath,
+				Args: []string{
+					"-contextDir", DockerfileAppDir,
+					"-dockerfile", path.Join(DockerfileAppDir, dockerfilePath),
+					"-imageRef", backend.imageRef(stagingGuid, request),
+					"-outputMetadataJSONFilename", DockerfileBuilderOutputPath,
+				},
+				Env: request.Environment.BBSEnvironment(),
+				ResourceLimits: models.ResourceLimits{
+					Nofile: &fileDescriptorLimit,
+				},
+			},
+			"Building image...",
+			"Image built and pushed",
+			"Building image failed",
+		),
+	)
+
+	annotationJson, _ := json.Marshal(StagingTaskAnnotation{
+		Lifecycle: DockerfileLifecycleName,
+		AppId:     request.AppId,
+	})
+
+	task := receptor.TaskCreateRequest{
+		TaskGuid:              stagingGuid,
+		ResultFile:            DockerfileBuilderOutputPath,
+		Domain:                backend.config.TaskDomain,
+		Stack:                 request.Stack,
+		MemoryMB:              request.MemoryMB,
+		DiskMB:                request.DiskMB,
+		CPUWeight:             StagingTaskCpuWeight,
+		Action:                models.Timeout(models.Serial(actions...), dockerTimeout(request, backend.config.defaultStagingTimeout(), backend.logger)),
+		CompletionCallbackURL: backend.config.CallbackURL(stagingGuid),
+		LogGuid:               request.LogGuid,
+		LogSource:             TaskLogSource,
+		Annotation:            string(annotationJson),
+		EgressRules:           request.EgressRules,
+		Privileged:            false,
+		EnvironmentVariables:  credentials.environment(),
+	}
+
+	logger.Debug("staging-task-request", lager.Data{"TaskCreateRequest": backend.config.Redactor.Redact(task)})
+
+	return task, nil
+}
+
+func (backend *dockerfileBackend) BuildStagingResponse(taskResponse receptor.TaskResponse) (cc_messages.StagingResponseForCC, error) {
+	var response cc_messages.StagingResponseForCC
+
+	var annotation StagingTaskAnnotation
+	err := json.Unmarshal([]byte(taskResponse.Annotation), &annotation)
+	if err != nil {
+		return cc_messages.StagingResponseForCC{}, err
+	}
+
+	if taskResponse.Failed {
+		response.Error = backend.config.Sanitizer(taskResponse.FailureReason)
+	} else {
+		var result DockerfileStagingResult
+		err := json.Unmarshal([]byte(taskResponse.Result), &result)
+		if err != nil {
+			return cc_messages.StagingResponseForCC{}, err
+		}
+
+		lifecycleDataJSON, err := json.Marshal(DockerfileStagingResponse{
+			DockerImage:       result.DockerImage,
+			DockerImageDigest: result.DockerImageDigest,
+		})
+		if err != nil {
+			return cc_messages.StagingResponseForCC{}, err
+		}
+		lifecycleData := json.RawMessage(lifecycleDataJSON)
+
+		response.ExecutionMetadata = result.ExecutionMetadata
+		response.DetectedStartCommand = result.DetectedStartCommand
+		response.LifecycleData = &lifecycleData
+	}
+
+	return response, nil
+}
+
+func (backend *dockerfileBackend) imageRef(stagingGuid string, request cc_messages.StagingRequestFromCC) string {
+	return fmt.Sprintf("%s/%s:%s", strings.TrimSuffix(backend.config.ImageRegistry, "/"), request.AppId, stagingGuid)
+}
+
+func (backend *dockerfileBackend) registryCredentials() (*DockerCredentials, error) {
+	if backend.config.ImageRegistryCredentials == "" {
+		return nil, nil
+	}
+
+	credentials, ok := backend.config.DockerRegistryCredentials[backend.config.ImageRegistryCredentials]
+	if !ok {
+		return nil, ErrUnknownDockerCredentials
+	}
+
+	return &credentials, nil
+}
+
+func (backend *dockerfileBackend) validateRequest(stagingRequest cc_messages.StagingRequestFromCC, dockerfileData DockerfileStagingData) error {
+	if len(stagingRequest.AppId) == 0 {
+		return ErrMissingAppId
+	}
+
+	if len(dockerfileData.AppBitsDownloadUri) == 0 {
+		return ErrMissingAppBitsDownloadUri
+	}
+
+	if backend.config.ImageRegistry == "" {
+		return ErrNoImageRegistry
+	}
+
+	dockerfilePath := path.Clean(dockerfileData.DockerfilePath)
+	if path.IsAbs(dockerfilePath) || dockerfilePath == ".." || strings.HasPrefix(dockerfilePath, "../") {
+		return ErrInvalidDockerfilePath
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+package backend_test
+
+import (
+	"encoding/json"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/runtime-schema/models"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+var _ = Describe("DockerfileBackend", func() {
+	var (
+		dockerfile     backend.Backend
+		config         backend.Config
+		stagingRequest cc_messages.StagingRequestFromCC
+		lifecycleData  backend.DockerfileStagingData
+		stagingGuid    string
+	)
+
+	BeforeEach(func() {
+		config = backend.Config{
+			TaskDomain:    "config-task-domain",
+			StagerURL:     "http://the-stager.example.com",
+			FileServerURL: "http://file-server.com",
+			ImageRegistry: "registry.example.com:5000/staged/",
+			Lifecycles: map[string]string{
+				"dockerfile": "dockerfile_app_lifecycle/dockerfile_app_lifecycle.tgz",
+			},
+			Sanitizer: func(msg string) *cc_messages.StagingError {
+				return &cc_messages.StagingError{Message: msg + " was totally sanitized"}
+			},
+		}
+
+		stagingGuid = "a-staging-guid"
+		lifecycleData = backend.DockerfileStagingData{
+			AppBitsDownloadUri: "http://example-uri.com/bunny",
+			DockerfilePath:     "build/Dockerfile",
+		}
+	})
+
+	JustBeforeEach(func() {
+		dockerfile = backend.NewDockerfileBackend(config, lagertest.NewTestLogger("test"))
+
+		lifecycleDataJSON, err := json.Marshal(lifecycleData)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		rawLifecycleData := json.RawMessage(lifecycleDataJSON)
+
+		stagingRequest = cc_messages.StagingRequestFromCC{
+			AppId:           "bunny",
+			LogGuid:         "log-guid",
+			Stack:           "rabbit_hole",
+			FileDescriptors: 512,
+			MemoryMB:        2048,
+			DiskMB:          3072,
+			Environment:     cc_messages.Environment{{"VCAP_APPLICATION", "foo"}},
+			Timeout:         900,
+			Lifecycle:       "dockerfile",
+			LifecycleData:   &rawLifecycleData,
+		}
+	})
+
+	Describe("request validation", func() {
+		Context("with a missing app bits download uri", func() {
+			BeforeEach(func() {
+				lifecycleData.AppBitsDownloadUri = ""
+			})
+
+			It("returns an error", func() {
+				_, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrMissingAppBitsDownloadUri))
+			})
+		})
+
+		Context("when no image registry is configured", func() {
+			BeforeEach(func() {
+				config.ImageRegistry = ""
+			})
+
+			It("returns an error", func() {
+				_, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrNoImageRegistry))
+			})
+		})
+
+		Context("when the dockerfile path leaves the app root", func() {
+			BeforeEach(func() {
+				lifecycleData.DockerfilePath = "build/../../Dockerfile"
+			})
+
+			It("returns an error", func() {
+				_, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrInvalidDockerfilePath))
+			})
+		})
+
+		Context("when the dockerfile lifecycle is missing", func() {
+			BeforeEach(func() {
+				delete(config.Lifecycles, "dockerfile")
+			})
+
+			It("returns an error", func() {
+				_, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrNoCompilerDefined))
+			})
+		})
+	})
+
+	It("creates an unprivileged staging task", func() {
+		desiredTask, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(desiredTask.Domain).Should(Equal("config-task-domain"))
+		Ω(desiredTask.TaskGuid).Should(Equal(stagingGuid))
+		Ω(desiredTask.ResultFile).Should(Equal("/tmp/dockerfile-result/result.json"))
+		Ω(desiredTask.Privileged).Should(BeFalse())
+
+		var annotation backend.StagingTaskAnnotation
+		err = json.Unmarshal([]byte(desiredTask.Annotation), &annotation)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(annotation).Should(Equal(backend.StagingTaskAnnotation{
+			Lifecycle: "dockerfile",
+			AppId:     "bunny",
+		}))
+	})
+
+	It("downloads the app bits and the builder, then builds and pushes the image", func() {
+		desiredTask, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fileDescriptorLimit := uint64(512)
+
+		actions := actionsFromDesiredTask(desiredTask)
+		Ω(actions).Should(Equal([]models.Action{
+			&models.DownloadAction{
+				Artifact: "app package",
+				From:     "http://example-uri.com/bunny",
+				To:       "/tmp/app",
+			},
+			models.EmitProgressFor(
+				&models.DownloadAction{
+					From:     "http://file-server.com/v1/static/dockerfile_app_lifecycle/dockerfile_app_lifecycle.tgz",
+					To:       "/tmp/dockerfile_app_lifecycle",
+					CacheKey: "builder-dockerfile",
+				},
+				"",
+				"",
+				"Failed to set up dockerfile environment",
+			),
+			models.EmitProgressFor(
+				&models.RunAction{
+					Path: "/tmp/dockerfile_app_lifecycle/builder",
+					Args: []string{
+						"-contextDir", "/tmp/app",
+						"-dockerfile", "/tmp/app/build/Dockerfile",
+						"-imageRef", "registry.example.com:5000/staged/bunny:a-staging-guid",
+						"-outputMetadataJSONFilename", "/tmp/dockerfile-result/result.json",
+					},
+					Env:            []models.EnvironmentVariable{{"VCAP_APPLICATION", "foo"}},
+					ResourceLimits: models.ResourceLimits{Nofile: &fileDescriptorLimit},
+				},
+				"Building image...",
+				"Image built and pushed",
+				"Building image failed",
+			),
+		}))
+	})
+
+	It("does not pass registry credentials to the builder when none are configured", func() {
+		desiredTask, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(desiredTask.EnvironmentVariables).Should(BeEmpty())
+	})
+
+	Context("when registry credentials are configured", func() {
+		BeforeEach(func() {
+			config.DockerRegistryCredentials = map[string]backend.DockerCredentials{
+				"staging-registry": {User: "push-user", Password: "push-password"},
+			}
+			config.ImageRegistryCredentials = "staging-registry"
+		})
+
+		It("passes them to the builder through the task environment", func() {
+			desiredTask, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(desiredTask.EnvironmentVariables).Should(Equal([]receptor.EnvironmentVariable{
+				{Name: "CF_DOCKER_USER", Value: "push-user"},
+				{Name: "CF_DOCKER_PASSWORD", Value: "push-password"},
+			}))
+		})
+
+		It("does not pass them on the builder's command line", func() {
+			desiredTask, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			actions := actionsFromDesiredTask(desiredTask)
+			runAction := actions[2].(*models.EmitProgressAction).Action.(*models.RunAction)
+			Ω(runAction.Args).ShouldNot(ContainElement("push-user"))
+			Ω(runAction.Args).ShouldNot(ContainElement("push-password"))
+		})
+
+		Context("when the named credentials are not configured", func() {
+			BeforeEach(func() {
+				config.ImageRegistryCredentials = "unknown-registry"
+			})
+
+			It("returns an error", func() {
+				_, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+				Ω(err).Should(Equal(backend.ErrUnknownDockerCredentials))
+			})
+		})
+	})
+
+	Context("when no dockerfile path is given", func() {
+		BeforeEach(func() {
+			lifecycleData.DockerfilePath = ""
+		})
+
+		It("builds the Dockerfile at the app root", func() {
+			desiredTask, err := dockerfile.BuildRecipe(stagingGuid, stagingRequest)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			actions := actionsFromDesiredTask(desiredTask)
+			runAction := actions[2].(*models.EmitProgressAction).Action.(*models.RunAction)
+			Ω(runAction.Args).Should(ContainElement("/tmp/app/Dockerfile"))
+		})
+	})
+
+	Describe("BuildStagingResponse", func() {
+		var taskResponse receptor.TaskResponse
+
+		BeforeEach(func() {
+			taskResponse = receptor.TaskResponse{
+				Annotation: `{"lifecycle": "dockerfile"}`,
+				Result: `{
+					"docker_image": "registry.example.com:5000/staged/bunny:a-staging-guid",
+					"docker_image_digest": "sha256:abc123",
+					"execution_metadata": "metadata",
+					"detected_start_command": {"web": "./start"}
+				}`,
+			}
+		})
+
+		It("returns the image reference and digest as lifecycle data", func() {
+			response, err := dockerfile.BuildStagingResponse(taskResponse)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(response.ExecutionMetadata).Should(Equal("metadata"))
+			Ω(response.DetectedStartCommand).Should(Equal(map[string]string{"web": "./start"}))
+			Ω([]byte(*response.LifecycleData)).Should(MatchJSON(`{
+				"docker_image": "registry.example.com:5000/staged/bunny:a-staging-guid",
+				"docker_image_digest": "sha256:abc123"
+			}`))
+		})
+
+		Context("when the task failed", func() {
+			BeforeEach(func() {
+				taskResponse.Failed = true
+				taskResponse.FailureReason = "push denied"
+			})
+
+			It("sanitizes the failure reason", func() {
+				response, err := dockerfile.BuildStagingResponse(taskResponse)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Error).Should(Equal(&cc_messages.StagingError{Message: "push denied was totally sanitized"}))
+				Ω(response.LifecycleData).Should(BeNil())
+			})
+		})
+	})
+})
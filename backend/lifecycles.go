@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidLifecycleKey = errors.New("key must be docker, dockerfile, buildpack/<stack> or cnb/<stack>")
+
+// UnknownSchemeError is returned for compilers given as URLs that are
+// neither http(s) nor a path on the file server.
+type UnknownSchemeError struct {
+	Scheme string
+}
+
+func (e *UnknownSchemeError) Error() string {
+	return fmt.Sprintf("unknown compiler URL scheme %q, expected http, https or a path on the file server", e.Scheme)
+}
+
+// LifecycleError describes what is wrong with one entry of
+// Config.Lifecycles.
+type LifecycleError struct {
+	Key string
+	Err error
+}
+
+func (e LifecycleError) Error() string {
+	return fmt.Sprintf("lifecycle %q: %s", e.Key, e.Err)
+}
+
+// LifecycleErrors lists every bad entry of Config.Lifecycles, ordered by key.
+type LifecycleErrors []LifecycleError
+
+func (errs LifecycleErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// ValidateLifecycles checks that every key of config.Lifecycles names a
+// lifecycle (and a stack, for the lifecycles that need one), and that its
+// compiler resolves to a download URL, so that a bad entry is found at boot
+// rather than by the first staging that needs it.
+func ValidateLifecycles(config Config) error {
+	var errs LifecycleErrors
+
+	for _, key := range sortedLifecycleKeys(config) {
+		err := validateLifecycleKey(key)
+		if err == nil {
+			_, err = compilerDownloadURL(config, key)
+		}
+
+		if err != nil {
+			errs = append(errs, LifecycleError{Key: key, Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// CheckLifecycleDownloads HEADs the compiler URL of every lifecycle and
+// fails unless each one answers with a 2xx.
+func CheckLifecycleDownloads(config Config, client *http.Client) error {
+	var errs LifecycleErrors
+
+	for _, key := range sortedLifecycleKeys(config) {
+		compilerURL, err := compilerDownloadURL(config, key)
+		if err != nil {
+			errs = append(errs, LifecycleError{Key: key, Err: err})
+			continue
+		}
+
+		redactedURL := config.Redactor.RedactURL(compilerURL.String())
+
+		resp, err := client.Head(compilerURL.String())
+		if err != nil {
+			// url.Error repeats the unredacted URL.
+			if urlErr, ok := err.(*url.Error); ok {
+				err = urlErr.Err
+			}
+			errs = append(errs, LifecycleError{Key: key, Err: fmt.Errorf("HEAD %s failed: %s", redactedURL, err)})
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			errs = append(errs, LifecycleError{Key: key, Err: fmt.Errorf("HEAD %s returned %d", redactedURL, resp.StatusCode)})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func validateLifecycleKey(key string) error {
+	parts := strings.Split(key, "/")
+
+	switch parts[0] {
+	case DockerLifecycleName, DockerfileLifecycleName:
+		if len(parts) == 1 {
+			return nil
+		}
+	case TraditionalLifecycleName, CNBLifecycleName:
+		if len(parts) == 2 && parts[1] != "" {
+			return nil
+		}
+	}
+
+	return ErrInvalidLifecycleKey
+}
+
+func sortedLifecycleKeys(config Config) []string {
+	keys := make([]string, 0, len(config.Lifecycles))
+	for key := range config.Lifecycles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,100 @@
+package backend_test
+
+import (
+	"net/http"
+
+	"github.com/cloudfoundry-incubator/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Lifecycles", func() {
+	var config backend.Config
+
+	BeforeEach(func() {
+		config = backend.Config{
+			FileServerURL: "http://file-server.com",
+			Lifecycles: map[string]string{
+				"buildpack/cflinuxfs2": "buildpack_app_lifecycle/buildpack_app_lifecycle.tgz",
+				"cnb/cflinuxfs3":       "https://lifecycles.example.com/cnb_app_lifecycle.tgz",
+				"docker":               "docker_app_lifecycle/docker_app_lifecycle.tgz",
+				"dockerfile":           "dockerfile_app_lifecycle/dockerfile_app_lifecycle.tgz",
+			},
+		}
+	})
+
+	Describe("ValidateLifecycles", func() {
+		It("accepts well-formed lifecycles", func() {
+			Ω(backend.ValidateLifecycles(config)).Should(Succeed())
+		})
+
+		It("reports every bad entry by key", func() {
+			config.Lifecycles["buildpack"] = "buildpack_app_lifecycle.tgz"
+			config.Lifecycles["docker/cflinuxfs2"] = "docker_app_lifecycle.tgz"
+			config.Lifecycles["windows/2012R2"] = "windows_app_lifecycle.tgz"
+			config.Lifecycles["buildpack/lucid64"] = "ftp://lifecycles.example.com/buildpack_app_lifecycle.tgz"
+			config.Lifecycles["cnb/cflinuxfs2"] = ""
+
+			err := backend.ValidateLifecycles(config)
+			Ω(err).Should(Equal(backend.LifecycleErrors{
+				{Key: "buildpack", Err: backend.ErrInvalidLifecycleKey},
+				{Key: "buildpack/lucid64", Err: &backend.UnknownSchemeError{Scheme: "ftp"}},
+				{Key: "cnb/cflinuxfs2", Err: backend.ErrNoCompilerDefined},
+				{Key: "docker/cflinuxfs2", Err: backend.ErrInvalidLifecycleKey},
+				{Key: "windows/2012R2", Err: backend.ErrInvalidLifecycleKey},
+			}))
+			Ω(err.Error()).Should(ContainSubstring(`lifecycle "buildpack/lucid64": unknown compiler URL scheme "ftp"`))
+		})
+
+		Context("without a file server URL", func() {
+			BeforeEach(func() {
+				config.FileServerURL = ""
+			})
+
+			It("rejects compilers given as paths on the file server", func() {
+				err := backend.ValidateLifecycles(config)
+				Ω(err).Should(Equal(backend.LifecycleErrors{
+					{Key: "buildpack/cflinuxfs2", Err: backend.ErrNoFileServerURL},
+					{Key: "docker", Err: backend.ErrNoFileServerURL},
+					{Key: "dockerfile", Err: backend.ErrNoFileServerURL},
+				}))
+			})
+		})
+	})
+
+	Describe("CheckLifecycleDownloads", func() {
+		var fileServer *ghttp.Server
+
+		BeforeEach(func() {
+			fileServer = ghttp.NewServer()
+			config.FileServerURL = fileServer.URL()
+			config.Lifecycles = map[string]string{
+				"buildpack/cflinuxfs2": "buildpack_app_lifecycle.tgz",
+				"docker":               "docker_app_lifecycle.tgz",
+			}
+		})
+
+		AfterEach(func() {
+			fileServer.Close()
+		})
+
+		It("HEADs every compiler on the file server", func() {
+			fileServer.RouteToHandler("HEAD", "/v1/static/buildpack_app_lifecycle.tgz", ghttp.RespondWith(http.StatusOK, nil))
+			fileServer.RouteToHandler("HEAD", "/v1/static/docker_app_lifecycle.tgz", ghttp.RespondWith(http.StatusOK, nil))
+
+			Ω(backend.CheckLifecycleDownloads(config, http.DefaultClient)).Should(Succeed())
+			Ω(fileServer.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("reports the compilers that are missing", func() {
+			fileServer.RouteToHandler("HEAD", "/v1/static/buildpack_app_lifecycle.tgz", ghttp.RespondWith(http.StatusOK, nil))
+			fileServer.RouteToHandler("HEAD", "/v1/static/docker_app_lifecycle.tgz", ghttp.RespondWith(http.StatusNotFound, nil))
+
+			err := backend.CheckLifecycleDownloads(config, http.DefaultClient)
+			Ω(err).Should(HaveOccurred())
+			Ω(err.(backend.LifecycleErrors)).Should(HaveLen(1))
+			Ω(err.Error()).Should(ContainSubstring(`lifecycle "docker": HEAD ` + fileServer.URL() + `/v1/static/docker_app_lifecycle.tgz returned 404`))
+		})
+	})
+})
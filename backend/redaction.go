@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+const RedactedValue = "REDACTED"
+
+// sensitiveKeyFragments mark JSON keys, URL query parameters and environment
+// variable names whose values are never logged.
+var sensitiveKeyFragments = []string{
+	"password",
+	"secret",
+	"token",
+	"credential",
+	"signature",
+	"accesskeyid",
+	"docker_user",
+	"docker_email",
+}
+
+// Redactor makes staging requests, tasks and responses safe to log.
+// Environment variable values are masked unless their names are allowlisted,
+// credentials are masked wherever they appear, and URLs, including URLs
+// nested in the query of other URLs, lose their signatures and passwords.
+//
+// The zero Redactor masks every environment variable.
+type Redactor struct {
+	safeEnvironmentVariables map[string]bool
+}
+
+func NewRedactor(safeEnvironmentVariables []string) Redactor {
+	safe := make(map[string]bool, len(safeEnvironmentVariables))
+	for _, name := range safeEnvironmentVariables {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			safe[name] = true
+		}
+	}
+
+	return Redactor{safeEnvironmentVariables: safe}
+}
+
+// Redact returns a redacted copy of v, shaped like its JSON encoding, for use
+// as lager.Data.
+func (r Redactor) Redact(v interface{}) interface{} {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return RedactedValue
+	}
+
+	return r.RedactJSON(payload)
+}
+
+// RedactJSON returns a redacted copy of the JSON document, for use as
+// lager.Data.
+func (r Redactor) RedactJSON(payload []byte) interface{} {
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&decoded)
+	if err != nil {
+		return RedactedValue
+	}
+
+	return r.redactValue("", decoded)
+}
+
+// RedactURL strips signatures, credentials and passwords from the URL. Values
+// that are not absolute URLs are returned unchanged.
+func (r Redactor) RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return rawURL
+	}
+
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), RedactedValue)
+		}
+	}
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key, values := range query {
+			for i, value := range values {
+				if isSensitiveKey(key) {
+					values[i] = RedactedValue
+				} else {
+					values[i] = r.RedactURL(value)
+				}
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
+
+func (r Redactor) redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if name, ok := environmentVariableName(v); ok {
+			if !r.safeEnvironmentVariables[name] || isSensitiveKey(name) {
+				v["value"] = RedactedValue
+			}
+			return v
+		}
+
+		for childKey, child := range v {
+			v[childKey] = r.redactValue(childKey, child)
+		}
+		return v
+
+	case []interface{}:
+		for i, child := range v {
+			v[i] = r.redactValue(key, child)
+		}
+		return v
+
+	case string:
+		if v != "" && isSensitiveKey(key) {
+			return RedactedValue
+		}
+		return r.RedactURL(v)
+	}
+
+	return value
+}
+
+// environmentVariableName recognizes the {"name": ..., "value": ...} shape
+// shared by cc_messages, receptor and models environment variables.
+func environmentVariableName(v map[string]interface{}) (string, bool) {
+	if len(v) != 2 {
+		return "", false
+	}
+
+	name, ok := v["name"].(string)
+	if !ok {
+		return "", false
+	}
+
+	_, ok = v["value"]
+	return name, ok
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	if key == "sig" {
+		return true
+	}
+
+	for _, fragment := range sensitiveKeyFragments {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+)
+
+// SanitizerRule turns task failure reasons matching Pattern into the staging
+// error reported to the CC, in place of the generic sanitized message.
+type SanitizerRule struct {
+	Pattern string `json:"pattern"`
+	Id      string `json:"id,omitempty"`
+	Message string `json:"message"`
+}
+
+type compiledSanitizerRule struct {
+	pattern *regexp.Regexp
+	err     cc_messages.StagingError
+}
+
+// NewSanitizer returns a sanitizer that applies the first rule matching a
+// failure reason, and fallback when none does. Rules without an Id report
+// cc_messages.STAGING_ERROR.
+func NewSanitizer(rules []SanitizerRule, fallback FailureReasonSanitizer) (FailureReasonSanitizer, error) {
+	if len(rules) == 0 {
+		return fallback, nil
+	}
+
+	compiled := make([]compiledSanitizerRule, 0, len(rules))
+	for i, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("sanitizer rule %d: %s", i, err)
+		}
+
+		if rule.Message == "" {
+			return nil, fmt.Errorf("sanitizer rule %d: message is required", i)
+		}
+
+		id := rule.Id
+		if id == "" {
+			id = cc_messages.STAGING_ERROR
+		}
+
+		compiled = append(compiled, compiledSanitizerRule{
+			pattern: pattern,
+			err:     cc_messages.StagingError{Id: id, Message: rule.Message},
+		})
+	}
+
+	return func(reason string) *cc_messages.StagingError {
+		for _, rule := range compiled {
+			if rule.pattern.MatchString(reason) {
+				stagingErr := rule.err
+				return &stagingErr
+			}
+		}
+
+		return fallback(reason)
+	}, nil
+}
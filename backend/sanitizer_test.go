@@ -0,0 +1,48 @@
+package backend_test
+
+import (
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewSanitizer", func() {
+	var fallback backend.FailureReasonSanitizer
+
+	BeforeEach(func() {
+		fallback = func(reason string) *cc_messages.StagingError {
+			return &cc_messages.StagingError{Id: "Fallback", Message: reason}
+		}
+	})
+
+	It("applies the first matching rule", func() {
+		sanitizer, err := backend.NewSanitizer([]backend.SanitizerRule{
+			{Pattern: "^exit status 222", Id: "NoAppDetectedError", Message: "no buildpack detected the app"},
+			{Pattern: "exit status", Message: "the builder failed"},
+		}, fallback)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(sanitizer("exit status 222")).Should(Equal(&cc_messages.StagingError{Id: "NoAppDetectedError", Message: "no buildpack detected the app"}))
+		Ω(sanitizer("builder: exit status 1")).Should(Equal(&cc_messages.StagingError{Id: cc_messages.STAGING_ERROR, Message: "the builder failed"}))
+	})
+
+	It("falls back when no rule matches", func() {
+		sanitizer, err := backend.NewSanitizer([]backend.SanitizerRule{
+			{Pattern: "exit status", Message: "the builder failed"},
+		}, fallback)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(sanitizer("out of memory")).Should(Equal(&cc_messages.StagingError{Id: "Fallback", Message: "out of memory"}))
+	})
+
+	It("rejects invalid patterns", func() {
+		_, err := backend.NewSanitizer([]backend.SanitizerRule{{Pattern: "(", Message: "oops"}}, fallback)
+		Ω(err).Should(MatchError(ContainSubstring("sanitizer rule 0")))
+	})
+
+	It("rejects rules without a message", func() {
+		_, err := backend.NewSanitizer([]backend.SanitizerRule{{Pattern: "exit status"}}, fallback)
+		Ω(err).Should(MatchError("sanitizer rule 0: message is required"))
+	})
+})
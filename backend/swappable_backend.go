@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"sync/atomic"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+)
+
+// SwappableBackend delegates to a Backend that can be replaced while
+// requests are being served, e.g. when the configuration is reloaded.
+// Requests already in a backend finish there; later ones go to the
+// replacement.
+type SwappableBackend struct {
+	current atomic.Value
+}
+
+// atomic.Value insists on a single concrete type, and the backends differ.
+type backendHolder struct {
+	Backend
+}
+
+func NewSwappableBackend(backend Backend) *SwappableBackend {
+	swappable := &SwappableBackend{}
+	swappable.Swap(backend)
+	return swappable
+}
+
+func (s *SwappableBackend) Swap(backend Backend) {
+	s.current.Store(backendHolder{backend})
+}
+
+func (s *SwappableBackend) BuildRecipe(stagingGuid string, request cc_messages.StagingRequestFromCC) (receptor.TaskCreateRequest, error) {
+	return s.load().BuildRecipe(stagingGuid, request)
+}
+
+func (s *SwappableBackend) BuildStagingResponse(taskResponse receptor.TaskResponse) (cc_messages.StagingResponseForCC, error) {
+	return s.load().BuildStagingResponse(taskResponse)
+}
+
+func (s *SwappableBackend) load() Backend {
+	return s.current.Load().(backendHolder).Backend
+}
@@ -0,0 +1,46 @@
+package backend_test
+
+import (
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/backend/fake_backend"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SwappableBackend", func() {
+	var (
+		original    *fake_backend.FakeBackend
+		replacement *fake_backend.FakeBackend
+		swappable   *backend.SwappableBackend
+	)
+
+	BeforeEach(func() {
+		original = &fake_backend.FakeBackend{}
+		original.BuildRecipeReturns(receptor.TaskCreateRequest{TaskGuid: "original"}, nil)
+		replacement = &fake_backend.FakeBackend{}
+		replacement.BuildRecipeReturns(receptor.TaskCreateRequest{TaskGuid: "replacement"}, nil)
+
+		swappable = backend.NewSwappableBackend(original)
+	})
+
+	It("delegates to the current backend", func() {
+		task, err := swappable.BuildRecipe("a-staging-guid", cc_messages.StagingRequestFromCC{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(task.TaskGuid).Should(Equal("original"))
+
+		_, err = swappable.BuildStagingResponse(receptor.TaskResponse{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(original.BuildStagingResponseCallCount()).Should(Equal(1))
+	})
+
+	It("delegates to the replacement once swapped", func() {
+		swappable.Swap(replacement)
+
+		task, err := swappable.BuildRecipe("a-staging-guid", cc_messages.StagingRequestFromCC{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(task.TaskGuid).Should(Equal("replacement"))
+		Ω(original.BuildRecipeCallCount()).Should(BeZero())
+	})
+})
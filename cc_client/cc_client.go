@@ -21,10 +21,12 @@ type CcClient interface {
 }
 
 type ccClient struct {
-	baseURI    string
-	username   string
-	password   string
-	httpClient *http.Client
+	baseURI        string
+	username       string
+	password       string
+	skipCertVerify bool
+	httpClient     *http.Client
+	tokenSource    *tokenSource
 }
 
 type BadResponseError struct {
@@ -35,44 +37,34 @@ func (b *BadResponseError) Error() string {
 	return fmt.Sprintf("Staging response POST failed with %d", b.StatusCode)
 }
 
-func NewCcClient(baseURI string, username string, password string, skipCertVerify bool) CcClient {
-	httpClient := &http.Client{
-		Timeout: stagingCompleteRequestTimeout,
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipCertVerify,
-				MinVersion:         tls.VersionTLS10,
-			},
-		},
+// NewCcClient returns a client that authenticates to the CC with basic auth,
+// unless an option such as WithOAuth2ClientCredentials says otherwise.
+func NewCcClient(baseURI string, username string, password string, skipCertVerify bool, options ...Option) CcClient {
+	cc := &ccClient{
+		baseURI:        baseURI,
+		username:       username,
+		password:       password,
+		skipCertVerify: skipCertVerify,
+		httpClient: newHTTPClient(&tls.Config{
+			InsecureSkipVerify: skipCertVerify,
+			MinVersion:         tls.VersionTLS10,
+		}),
 	}
 
-	return &ccClient{
-		baseURI:    baseURI,
-		username:   username,
-		password:   password,
-		httpClient: httpClient,
+	for _, option := range options {
+		option(cc)
 	}
+
+	return cc
 }
 
 func (cc *ccClient) StagingComplete(stagingGuid string, payload []byte, logger lager.Logger) error {
 	logger = logger.Session("cc-client")
-	logger.Info("delivering-staging-response", lager.Data{"payload": string(payload)})
+	// The payload carries droplet metadata and start commands the app may have
+	// secrets in, so only its size is logged.
+	logger.Info("delivering-staging-response", lager.Data{"staging-guid": stagingGuid, "payload-bytes": len(payload)})
 
-	request, err := http.NewRequest("POST", cc.stagingCompleteURI(stagingGuid), bytes.NewReader(payload))
-	if err != nil {
-		return err
-	}
-
-	request.SetBasicAuth(cc.username, cc.password)
-	request.Header.Set("content-type", "application/json")
-
-	response, err := cc.httpClient.Do(request)
+	response, err := cc.postStagingComplete(stagingGuid, payload, logger)
 	if err != nil {
 		logger.Error("deliver-staging-response-failed", err)
 		return err
@@ -88,23 +80,75 @@ func (cc *ccClient) StagingComplete(stagingGuid string, payload []byte, logger l
 	return nil
 }
 
+func (cc *ccClient) postStagingComplete(stagingGuid string, payload []byte, logger lager.Logger) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		request, err := http.NewRequest("POST", cc.stagingCompleteURI(stagingGuid), bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		request.Header.Set("content-type", "application/json")
+
+		if cc.tokenSource == nil {
+			request.SetBasicAuth(cc.username, cc.password)
+			return cc.httpClient.Do(request)
+		}
+
+		token, err := cc.tokenSource.Token(logger)
+		if err != nil {
+			return nil, err
+		}
+
+		request.Header.Set("authorization", "bearer "+token)
+
+		response, err := cc.httpClient.Do(request)
+		if err != nil || response.StatusCode != http.StatusUnauthorized || attempt > 1 {
+			return response, err
+		}
+
+		// The token may have been revoked or the CC's clock may run ahead of
+		// ours; try once more with a fresh one.
+		response.Body.Close()
+		cc.tokenSource.Invalidate(token)
+		logger.Info("retrying-with-fresh-token")
+	}
+}
+
 func IsRetryable(err error) bool {
 	if nerr, ok := err.(net.Error); ok {
 		return nerr.Temporary() || nerr.Timeout()
 	}
 
+	if terr, ok := err.(*TokenError); ok {
+		return terr.StatusCode >= http.StatusInternalServerError
+	}
+
 	if berr, ok := err.(*BadResponseError); ok {
-		switch berr.StatusCode {
-		case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
-			return true
-		default:
-			return false
-		}
+		return berr.StatusCode >= http.StatusInternalServerError || berr.StatusCode == http.StatusTooManyRequests
 	}
 
 	return false
 }
 
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout: stagingCompleteRequestTimeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConfig,
+		},
+	}
+}
+
+func (cc *ccClient) tlsConfig() *tls.Config {
+	return cc.httpClient.Transport.(*http.Transport).TLSClientConfig
+}
+
 func (cc *ccClient) stagingCompleteURI(stagingGuid string) string {
 	return fmt.Sprintf("%s/internal/staging/%s/completed", cc.baseURI, stagingGuid)
 }
@@ -6,12 +6,15 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/cloudfoundry-incubator/stager/cc_client"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"github.com/pivotal-golang/clock/fakeclock"
 	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
 )
 
 var _ = Describe("CC Client", func() {
@@ -67,6 +70,32 @@ var _ = Describe("CC Client", func() {
 		})
 	})
 
+	Describe("logging", func() {
+		var testLogger *lagertest.TestLogger
+
+		BeforeEach(func() {
+			testLogger = lagertest.NewTestLogger("test")
+
+			fakeCC.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", fmt.Sprintf("/internal/staging/%s/completed", stagingGuid)),
+					ghttp.RespondWith(200, `{}`),
+				),
+			)
+		})
+
+		It("never logs the payload", func() {
+			payload := []byte(`{"detected_start_command":{"web":"DB_PASSWORD=super-secret ./start"}}`)
+
+			err := ccClient.StagingComplete(stagingGuid, payload, testLogger)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			contents := string(testLogger.Buffer().Contents())
+			Ω(contents).Should(ContainSubstring("delivering-staging-response"))
+			Ω(contents).ShouldNot(ContainSubstring("super-secret"))
+		})
+	})
+
 	Describe("TLS certificate validation", func() {
 		BeforeEach(func() {
 			fakeCC = ghttp.NewTLSServer() // self-signed certificate
@@ -105,6 +134,123 @@ var _ = Describe("CC Client", func() {
 		})
 	})
 
+	Describe("OAuth2 client credentials", func() {
+		var (
+			fakeUAA   *ghttp.Server
+			fakeClock *fakeclock.FakeClock
+			payload   = []byte(`{ "key": "value" }`)
+		)
+
+		tokenHandler := func(token string, expiresIn int) http.HandlerFunc {
+			return ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/oauth/token"),
+				ghttp.VerifyBasicAuth("stager-client", "stager-secret"),
+				ghttp.VerifyContentType("application/x-www-form-urlencoded"),
+				func(w http.ResponseWriter, req *http.Request) {
+					Ω(req.FormValue("grant_type")).Should(Equal("client_credentials"))
+				},
+				ghttp.RespondWith(200, fmt.Sprintf(`{"access_token":"%s","token_type":"bearer","expires_in":%d}`, token, expiresIn)),
+			)
+		}
+
+		ccHandler := func(token string, status int) http.HandlerFunc {
+			return ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", fmt.Sprintf("/internal/staging/%s/completed", stagingGuid)),
+				ghttp.VerifyHeaderKV("Authorization", "bearer "+token),
+				ghttp.RespondWith(status, `{}`),
+			)
+		}
+
+		BeforeEach(func() {
+			fakeUAA = ghttp.NewServer()
+			fakeClock = fakeclock.NewFakeClock(time.Now())
+
+			ccClient = cc_client.NewCcClient(fakeCC.URL(), "username", "password", true,
+				cc_client.WithOAuth2ClientCredentials(fakeUAA.URL()+"/oauth/token", "stager-client", "stager-secret", nil, fakeClock),
+			)
+		})
+
+		AfterEach(func() {
+			fakeUAA.Close()
+		})
+
+		It("sends a bearer token instead of basic auth", func() {
+			fakeUAA.AppendHandlers(tokenHandler("token-1", 3600))
+			fakeCC.AppendHandlers(ghttp.CombineHandlers(
+				ccHandler("token-1", 200),
+				func(w http.ResponseWriter, req *http.Request) {
+					_, _, hasBasicAuth := req.BasicAuth()
+					Ω(hasBasicAuth).Should(BeFalse())
+				},
+			))
+
+			err := ccClient.StagingComplete(stagingGuid, payload, logger)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("reuses the token until shortly before it expires", func() {
+			fakeUAA.AppendHandlers(tokenHandler("token-1", 3600), tokenHandler("token-2", 3600))
+			fakeCC.AppendHandlers(ccHandler("token-1", 200), ccHandler("token-1", 200), ccHandler("token-2", 200))
+
+			Ω(ccClient.StagingComplete(stagingGuid, payload, logger)).Should(Succeed())
+
+			fakeClock.Increment(time.Hour - time.Minute)
+			Ω(ccClient.StagingComplete(stagingGuid, payload, logger)).Should(Succeed())
+
+			fakeClock.Increment(45 * time.Second)
+			Ω(ccClient.StagingComplete(stagingGuid, payload, logger)).Should(Succeed())
+
+			Ω(fakeUAA.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		Context("when the CC rejects the token", func() {
+			BeforeEach(func() {
+				fakeUAA.AppendHandlers(tokenHandler("token-1", 3600), tokenHandler("token-2", 3600))
+			})
+
+			It("retries once with a fresh token", func() {
+				fakeCC.AppendHandlers(ccHandler("token-1", 401), ccHandler("token-2", 200))
+
+				err := ccClient.StagingComplete(stagingGuid, payload, logger)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(fakeCC.ReceivedRequests()).Should(HaveLen(2))
+			})
+
+			It("gives up when the fresh token is rejected too", func() {
+				fakeCC.AppendHandlers(ccHandler("token-1", 401), ccHandler("token-2", 401))
+
+				err := ccClient.StagingComplete(stagingGuid, payload, logger)
+				Ω(err).Should(Equal(&cc_client.BadResponseError{http.StatusUnauthorized}))
+				Ω(fakeCC.ReceivedRequests()).Should(HaveLen(2))
+			})
+		})
+
+		Context("when the token endpoint fails", func() {
+			BeforeEach(func() {
+				fakeUAA.AppendHandlers(ghttp.RespondWith(503, `{}`))
+			})
+
+			It("returns a retryable error without calling the CC", func() {
+				err := ccClient.StagingComplete(stagingGuid, payload, logger)
+				Ω(err).Should(Equal(&cc_client.TokenError{http.StatusServiceUnavailable}))
+				Ω(cc_client.IsRetryable(err)).Should(BeTrue())
+				Ω(fakeCC.ReceivedRequests()).Should(BeEmpty())
+			})
+		})
+
+		Context("when the client credentials are rejected", func() {
+			BeforeEach(func() {
+				fakeUAA.AppendHandlers(ghttp.RespondWith(401, `{}`))
+			})
+
+			It("returns an error that is not retryable", func() {
+				err := ccClient.StagingComplete(stagingGuid, payload, logger)
+				Ω(err).Should(Equal(&cc_client.TokenError{http.StatusUnauthorized}))
+				Ω(cc_client.IsRetryable(err)).Should(BeFalse())
+			})
+		})
+	})
+
 	Describe("Error conditions", func() {
 		Context("when the request couldn't be completed", func() {
 			BeforeEach(func() {
@@ -179,6 +325,27 @@ var _ = Describe("CC Client", func() {
 					Ω(cc_client.IsRetryable(err)).To(BeTrue())
 				})
 			})
+
+			Context("when the response code is StatusInternalServerError", func() {
+				It("is retryable", func() {
+					err := &cc_client.BadResponseError{http.StatusInternalServerError}
+					Ω(cc_client.IsRetryable(err)).To(BeTrue())
+				})
+			})
+
+			Context("when the response code is StatusTooManyRequests", func() {
+				It("is retryable", func() {
+					err := &cc_client.BadResponseError{http.StatusTooManyRequests}
+					Ω(cc_client.IsRetryable(err)).To(BeTrue())
+				})
+			})
+
+			Context("when the response code is StatusForbidden", func() {
+				It("is not retryable", func() {
+					err := &cc_client.BadResponseError{http.StatusForbidden}
+					Ω(cc_client.IsRetryable(err)).To(BeFalse())
+				})
+			})
 		})
 
 		Context("general errors", func() {
@@ -0,0 +1,149 @@
+package cc_client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+)
+
+// tokenRefreshMargin is how long before its expiry a cached token is
+// replaced, so that it does not expire in flight.
+const tokenRefreshMargin = 30 * time.Second
+
+type TokenError struct {
+	StatusCode int
+}
+
+func (t *TokenError) Error() string {
+	return fmt.Sprintf("Fetching OAuth token failed with %d", t.StatusCode)
+}
+
+// Option configures a CcClient built by NewCcClient.
+type Option func(*ccClient)
+
+// WithOAuth2ClientCredentials authenticates to the CC with a bearer token
+// obtained from tokenURL with the OAuth2 client credentials grant, instead of
+// basic auth. The token is cached until shortly before it expires, and a
+// request rejected with 401 is retried once with a fresh token.
+//
+// The token endpoint is reached without the TLS settings of the CC: it is
+// verified against tokenCAs, or the system roots if tokenCAs is nil, and is
+// never presented the CC client certificate.
+func WithOAuth2ClientCredentials(tokenURL, clientID, clientSecret string, tokenCAs *x509.CertPool, clock clock.Clock) Option {
+	return func(cc *ccClient) {
+		cc.tokenSource = &tokenSource{
+			tokenURL:     tokenURL,
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			httpClient: newHTTPClient(&tls.Config{
+				RootCAs:            tokenCAs,
+				InsecureSkipVerify: cc.skipCertVerify,
+				MinVersion:         tls.VersionTLS10,
+			}),
+			clock: clock,
+		}
+	}
+}
+
+type tokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+	clock        clock.Clock
+
+	lock      sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Token returns the cached token, fetching a new one when there is none or
+// it is about to expire.
+func (t *tokenSource) Token(logger lager.Logger) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.token != "" && t.clock.Now().Before(t.refreshAt) {
+		return t.token, nil
+	}
+
+	return t.fetch(logger)
+}
+
+// Invalidate drops token from the cache, unless it has already been replaced.
+func (t *tokenSource) Invalidate(token string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.token == token {
+		t.token = ""
+	}
+}
+
+func (t *tokenSource) fetch(logger lager.Logger) (string, error) {
+	logger = logger.Session("fetch-token", lager.Data{"token-url": t.tokenURL})
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	request, err := http.NewRequest("POST", t.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	request.SetBasicAuth(t.clientID, t.clientSecret)
+	request.Header.Set("content-type", "application/x-www-form-urlencoded")
+	request.Header.Set("accept", "application/json")
+
+	response, err := t.httpClient.Do(request)
+	if err != nil {
+		logger.Error("failed", err)
+		return "", err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		err := &TokenError{response.StatusCode}
+		logger.Error("failed", err)
+		return "", err
+	}
+
+	var token tokenResponse
+	err = json.NewDecoder(response.Body).Decode(&token)
+	if err != nil {
+		logger.Error("failed-to-decode-token", err)
+		return "", err
+	}
+
+	if token.AccessToken == "" {
+		err := fmt.Errorf("token response from %s has no access token", t.tokenURL)
+		logger.Error("failed", err)
+		return "", err
+	}
+
+	expiresIn := time.Duration(token.ExpiresIn) * time.Second
+	margin := tokenRefreshMargin
+	if margin > expiresIn/2 {
+		margin = expiresIn / 2
+	}
+
+	t.token = token.AccessToken
+	t.refreshAt = t.clock.Now().Add(expiresIn - margin)
+
+	logger.Info("fetched", lager.Data{"expires-in": expiresIn.String()})
+	return t.token, nil
+}
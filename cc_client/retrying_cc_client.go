@@ -0,0 +1,109 @@
+package cc_client
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	DefaultMaxDeliveryAttempts = 5
+	DefaultDeliveryBaseBackoff = 500 * time.Millisecond
+	DefaultDeliveryMaxBackoff  = 8 * time.Second
+
+	// DefaultDeliveryMaxElapsed keeps a delivery well inside the outbox
+	// drainer's interval, so that a completion callback never blocks Diego for
+	// longer than it takes the drainer to pick the response up instead.
+	DefaultDeliveryMaxElapsed = 10 * time.Second
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// MaxElapsed bounds the total time spent on a delivery: no retry is
+	// started whose backoff would end after it. Zero means no bound.
+	MaxElapsed time.Duration
+}
+
+type retryingCcClient struct {
+	client CcClient
+	policy RetryPolicy
+	clock  clock.Clock
+}
+
+// NewRetryingCcClient wraps client so that retryable failures (see IsRetryable)
+// are retried with exponential backoff and jitter, up to policy.MaxAttempts
+// attempts in total and for no longer than policy.MaxElapsed.
+func NewRetryingCcClient(client CcClient, policy RetryPolicy, clock clock.Clock) CcClient {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+
+	if policy.MaxBackoff < policy.BaseBackoff {
+		policy.MaxBackoff = policy.BaseBackoff
+	}
+
+	return &retryingCcClient{
+		client: client,
+		policy: policy,
+		clock:  clock,
+	}
+}
+
+func (cc *retryingCcClient) StagingComplete(stagingGuid string, payload []byte, logger lager.Logger) error {
+	logger = logger.Session("retrying-cc-client", lager.Data{"staging-guid": stagingGuid})
+	start := cc.clock.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := cc.client.StagingComplete(stagingGuid, payload, logger)
+		if err == nil {
+			logger.Info("delivery-succeeded", lager.Data{"attempts": attempt})
+			return nil
+		}
+
+		if !IsRetryable(err) {
+			logger.Error("delivery-failed-not-retryable", err, lager.Data{"attempts": attempt})
+			return err
+		}
+
+		if attempt >= cc.policy.MaxAttempts {
+			logger.Error("delivery-failed-giving-up", err, lager.Data{"attempts": attempt})
+			return err
+		}
+
+		delay := cc.backoff(attempt)
+		if cc.policy.MaxElapsed > 0 && cc.clock.Now().Sub(start)+delay > cc.policy.MaxElapsed {
+			logger.Error("delivery-failed-out-of-time", err, lager.Data{"attempts": attempt})
+			return err
+		}
+
+		logger.Info("retrying-delivery", lager.Data{
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"error":   err.Error(),
+		})
+
+		timer := cc.clock.NewTimer(delay)
+		<-timer.C()
+	}
+}
+
+// backoff doubles the base backoff for every failed attempt, capped at the
+// maximum, and randomizes the upper half of the result so that stagers
+// retrying against the same CC spread out.
+func (cc *retryingCcClient) backoff(attempt int) time.Duration {
+	backoff := cc.policy.MaxBackoff
+	if attempt < 32 {
+		exponential := cc.policy.BaseBackoff << uint(attempt-1)
+		if exponential > 0 && exponential < backoff {
+			backoff = exponential
+		}
+	}
+
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
@@ -0,0 +1,165 @@
+package cc_client_test
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/cc_client"
+	"github.com/cloudfoundry-incubator/stager/cc_client/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+var _ = Describe("Retrying CC Client", func() {
+	var (
+		logger       *lagertest.TestLogger
+		fakeClock    *fakeclock.FakeClock
+		fakeCcClient *fakes.FakeCcClient
+		ccClient     cc_client.CcClient
+
+		policy   cc_client.RetryPolicy
+		errs     []error
+		errCh    chan error
+		attempts int
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test")
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		fakeCcClient = &fakes.FakeCcClient{}
+
+		policy = cc_client.RetryPolicy{
+			MaxAttempts: 3,
+			BaseBackoff: time.Second,
+			MaxBackoff:  4 * time.Second,
+		}
+
+		errs = nil
+		attempts = 0
+		fakeCcClient.StagingCompleteStub = func(string, []byte, lager.Logger) error {
+			attempts++
+			if attempts <= len(errs) {
+				return errs[attempts-1]
+			}
+			return nil
+		}
+	})
+
+	JustBeforeEach(func() {
+		ccClient = cc_client.NewRetryingCcClient(fakeCcClient, policy, fakeClock)
+
+		errCh = make(chan error, 1)
+		go func() {
+			errCh <- ccClient.StagingComplete("the-staging-guid", []byte(`{}`), logger)
+		}()
+	})
+
+	Context("when the first attempt succeeds", func() {
+		It("delivers the payload once", func() {
+			Eventually(errCh).Should(Receive(BeNil()))
+			Ω(fakeCcClient.StagingCompleteCallCount()).Should(Equal(1))
+
+			guid, payload, _ := fakeCcClient.StagingCompleteArgsForCall(0)
+			Ω(guid).Should(Equal("the-staging-guid"))
+			Ω(payload).Should(Equal([]byte(`{}`)))
+		})
+	})
+
+	Context("when an attempt fails with a retryable error", func() {
+		BeforeEach(func() {
+			errs = []error{&cc_client.BadResponseError{http.StatusServiceUnavailable}}
+		})
+
+		It("waits for the backoff before trying again", func() {
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			Consistently(errCh).ShouldNot(Receive())
+			Ω(fakeCcClient.StagingCompleteCallCount()).Should(Equal(1))
+
+			fakeClock.Increment(policy.BaseBackoff)
+
+			Eventually(errCh).Should(Receive(BeNil()))
+			Ω(fakeCcClient.StagingCompleteCallCount()).Should(Equal(2))
+		})
+
+		It("logs the attempts", func() {
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.Increment(policy.BaseBackoff)
+
+			Eventually(errCh).Should(Receive(BeNil()))
+			Ω(logger).Should(gbytes.Say("retrying-delivery"))
+			Ω(logger).Should(gbytes.Say(`"attempts":2`))
+		})
+	})
+
+	Context("when every attempt fails with a retryable error", func() {
+		var retryableErr error
+
+		BeforeEach(func() {
+			retryableErr = &cc_client.BadResponseError{http.StatusGatewayTimeout}
+			errs = []error{retryableErr, retryableErr, retryableErr, retryableErr}
+		})
+
+		It("gives up after the maximum number of attempts", func() {
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.Increment(policy.MaxBackoff)
+
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.Increment(policy.MaxBackoff)
+
+			Eventually(errCh).Should(Receive(Equal(retryableErr)))
+			Ω(fakeCcClient.StagingCompleteCallCount()).Should(Equal(3))
+			Ω(logger).Should(gbytes.Say("delivery-failed-giving-up"))
+		})
+	})
+
+	Context("when the next backoff would end after the maximum elapsed time", func() {
+		var retryableErr error
+
+		BeforeEach(func() {
+			policy.MaxAttempts = 10
+			policy.MaxElapsed = 3 * time.Second
+
+			retryableErr = &cc_client.BadResponseError{http.StatusServiceUnavailable}
+			errs = []error{retryableErr, retryableErr, retryableErr, retryableErr}
+		})
+
+		It("gives up without waiting for it", func() {
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.Increment(policy.MaxBackoff)
+
+			Eventually(errCh).Should(Receive(Equal(retryableErr)))
+			Ω(fakeCcClient.StagingCompleteCallCount()).Should(Equal(2))
+			Ω(logger).Should(gbytes.Say("delivery-failed-out-of-time"))
+		})
+	})
+
+	Context("when an attempt fails with an error that is not retryable", func() {
+		var badRequestErr error
+
+		BeforeEach(func() {
+			badRequestErr = &cc_client.BadResponseError{http.StatusBadRequest}
+			errs = []error{badRequestErr}
+		})
+
+		It("returns the error without retrying", func() {
+			Eventually(errCh).Should(Receive(Equal(badRequestErr)))
+			Ω(fakeCcClient.StagingCompleteCallCount()).Should(Equal(1))
+		})
+	})
+
+	Context("when a generic error is returned", func() {
+		BeforeEach(func() {
+			errs = []error{errors.New("boom")}
+		})
+
+		It("returns the error without retrying", func() {
+			Eventually(errCh).Should(Receive(MatchError("boom")))
+			Ω(fakeCcClient.StagingCompleteCallCount()).Should(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,207 @@
+package cc_client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pivotal-golang/lager"
+)
+
+var ErrIncompleteClientCertificate = errors.New("client certificate and key must be given together")
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion maps "1.0" through "1.3" to the crypto/tls constants.
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+
+	return v, nil
+}
+
+// WithMinTLSVersion sets the lowest TLS version the client negotiates with
+// the CC.
+func WithMinTLSVersion(version uint16) Option {
+	return func(cc *ccClient) {
+		cc.tlsConfig().MinVersion = version
+	}
+}
+
+// WithTLSFiles presents the client certificate of files to the CC and
+// verifies the CC against the CA bundle of files, picking up new versions of
+// the files as they are rotated. skipCertVerify still disables verification.
+func WithTLSFiles(files *TLSFiles) Option {
+	return func(cc *ccClient) {
+		tlsConfig := cc.tlsConfig()
+
+		if files.certFile != "" {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return files.clientCertificate(), nil
+			}
+		}
+
+		if files.caFile != "" && !tlsConfig.InsecureSkipVerify {
+			// RootCAs cannot be swapped on a live transport, so verification
+			// against the current CA bundle is done by hand.
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyConnection = files.verifyConnection
+		}
+	}
+}
+
+// TLSFiles holds a client certificate, its key and a CA bundle loaded from
+// disk. Each TLS handshake checks whether the files have changed and reloads
+// them if so; files that fail to load leave the previous version in use.
+type TLSFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	logger   lager.Logger
+
+	lock     sync.Mutex
+	modTimes map[string]time.Time
+	cert     *tls.Certificate
+	rootCAs  *x509.CertPool
+}
+
+// NewTLSFiles loads the files, failing if any of them cannot be used. Either
+// the certificate and key, or the CA bundle, may be left empty.
+func NewTLSFiles(certFile, keyFile, caFile string, logger lager.Logger) (*TLSFiles, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, ErrIncompleteClientCertificate
+	}
+
+	files := &TLSFiles{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		logger:   logger.Session("cc-tls-files"),
+		modTimes: map[string]time.Time{},
+	}
+
+	err := files.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (f *TLSFiles) clientCertificate() *tls.Certificate {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.reloadIfChanged()
+	return f.cert
+}
+
+func (f *TLSFiles) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("CC presented no certificate")
+	}
+
+	f.lock.Lock()
+	f.reloadIfChanged()
+	rootCAs := f.rootCAs
+	f.lock.Unlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         rootCAs,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+func (f *TLSFiles) reloadIfChanged() {
+	if !f.changed() {
+		return
+	}
+
+	err := f.load()
+	if err != nil {
+		f.logger.Error("failed-to-reload", err)
+		return
+	}
+
+	f.logger.Info("reloaded")
+}
+
+func (f *TLSFiles) changed() bool {
+	for _, file := range []string{f.certFile, f.keyFile, f.caFile} {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		if !info.ModTime().Equal(f.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *TLSFiles) load() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range []string{f.certFile, f.keyFile, f.caFile} {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if f.certFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &keyPair
+	}
+
+	var rootCAs *x509.CertPool
+	if f.caFile != "" {
+		caPEM, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in %s", f.caFile)
+		}
+	}
+
+	f.modTimes = modTimes
+	f.cert = cert
+	f.rootCAs = rootCAs
+	return nil
+}
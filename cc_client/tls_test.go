@@ -0,0 +1,323 @@
+package cc_client_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/cc_client"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+var _ = Describe("Mutual TLS", func() {
+	var (
+		dir         string
+		ca          *testCA
+		otherCA     *testCA
+		fakeCC      *ghttp.Server
+		stagingGuid string
+		logger      *lagertest.TestLogger
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cc-client-tls")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		ca = newTestCA()
+		otherCA = newTestCA()
+		stagingGuid = "the-staging-guid"
+		logger = lagertest.NewTestLogger("test")
+
+		serverCert := ca.issue(func(template *x509.Certificate) {
+			template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		})
+
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca.cert)
+
+		fakeCC = ghttp.NewUnstartedServer()
+		fakeCC.HTTPTestServer.TLS = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}
+		fakeCC.HTTPTestServer.Config.ErrorLog = log.New(ioutil.Discard, "", log.Flags())
+		fakeCC.HTTPTestServer.StartTLS()
+		fakeCC.RouteToHandler("POST", fmt.Sprintf("/internal/staging/%s/completed", stagingGuid), ghttp.RespondWith(200, `{}`))
+	})
+
+	AfterEach(func() {
+		fakeCC.Close()
+		os.RemoveAll(dir)
+	})
+
+	writeFile := func(name string, contents []byte) string {
+		path := filepath.Join(dir, name)
+		Ω(ioutil.WriteFile(path, contents, 0600)).Should(Succeed())
+		return path
+	}
+
+	writeClientCert := func(issuer *testCA) (string, string) {
+		cert := issuer.issue(func(template *x509.Certificate) {
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		})
+
+		keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return writeFile("client.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})),
+			writeFile("client.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	}
+
+	// Bump the modification time so that a rewrite within the same clock
+	// tick is still noticed.
+	touch := func(path string) {
+		future := time.Now().Add(time.Hour)
+		Ω(os.Chtimes(path, future, future)).Should(Succeed())
+	}
+
+	verifyClientCert := func() {
+		fakeCC.RouteToHandler("POST", fmt.Sprintf("/internal/staging/%s/completed", stagingGuid), ghttp.CombineHandlers(
+			ghttp.RespondWith(200, `{}`),
+			func(w http.ResponseWriter, req *http.Request) {
+				Ω(req.TLS.PeerCertificates).ShouldNot(BeEmpty())
+			},
+		))
+	}
+
+	newClient := func(files *cc_client.TLSFiles) cc_client.CcClient {
+		return cc_client.NewCcClient(fakeCC.URL(), "username", "password", false, cc_client.WithTLSFiles(files))
+	}
+
+	Describe("verifying the CC", func() {
+		It("trusts the CA bundle", func() {
+			files, err := cc_client.NewTLSFiles("", "", writeFile("ca.crt", ca.pem()), logger)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(newClient(files).StagingComplete(stagingGuid, []byte(`{}`), logger)).Should(Succeed())
+		})
+
+		It("rejects a CC whose certificate was issued by another CA", func() {
+			files, err := cc_client.NewTLSFiles("", "", writeFile("ca.crt", otherCA.pem()), logger)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(newClient(files).StagingComplete(stagingGuid, []byte(`{}`), logger)).ShouldNot(Succeed())
+		})
+
+		It("picks up a rotated CA bundle", func() {
+			caFile := writeFile("ca.crt", otherCA.pem())
+			files, err := cc_client.NewTLSFiles("", "", caFile, logger)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			client := newClient(files)
+			Ω(client.StagingComplete(stagingGuid, []byte(`{}`), logger)).ShouldNot(Succeed())
+
+			writeFile("ca.crt", ca.pem())
+			touch(caFile)
+
+			Ω(client.StagingComplete(stagingGuid, []byte(`{}`), logger)).Should(Succeed())
+		})
+	})
+
+	Describe("presenting a client certificate", func() {
+		BeforeEach(func() {
+			verifyClientCert()
+		})
+
+		It("presents the certificate to the CC", func() {
+			certFile, keyFile := writeClientCert(ca)
+			files, err := cc_client.NewTLSFiles(certFile, keyFile, writeFile("ca.crt", ca.pem()), logger)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(newClient(files).StagingComplete(stagingGuid, []byte(`{}`), logger)).Should(Succeed())
+		})
+
+		It("picks up a rotated certificate", func() {
+			certFile, keyFile := writeClientCert(otherCA)
+			files, err := cc_client.NewTLSFiles(certFile, keyFile, writeFile("ca.crt", ca.pem()), logger)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			client := newClient(files)
+			Ω(client.StagingComplete(stagingGuid, []byte(`{}`), logger)).ShouldNot(Succeed())
+
+			writeClientCert(ca)
+			touch(certFile)
+			touch(keyFile)
+
+			Ω(client.StagingComplete(stagingGuid, []byte(`{}`), logger)).Should(Succeed())
+		})
+	})
+
+	Describe("fetching OAuth tokens", func() {
+		var fakeUAA *ghttp.Server
+
+		BeforeEach(func() {
+			uaaCert := otherCA.issue(func(template *x509.Certificate) {
+				template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+				template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			})
+
+			fakeUAA = ghttp.NewUnstartedServer()
+			fakeUAA.HTTPTestServer.TLS = &tls.Config{
+				Certificates: []tls.Certificate{uaaCert},
+				ClientAuth:   tls.RequestClientCert,
+			}
+			fakeUAA.HTTPTestServer.Config.ErrorLog = log.New(ioutil.Discard, "", log.Flags())
+			fakeUAA.HTTPTestServer.StartTLS()
+			fakeUAA.RouteToHandler("POST", "/oauth/token", ghttp.CombineHandlers(
+				func(w http.ResponseWriter, req *http.Request) {
+					Ω(req.TLS.PeerCertificates).Should(BeEmpty())
+				},
+				ghttp.RespondWith(200, `{"access_token":"the-token","token_type":"bearer","expires_in":3600}`),
+			))
+
+			fakeCC.RouteToHandler("POST", fmt.Sprintf("/internal/staging/%s/completed", stagingGuid), ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("Authorization", "bearer the-token"),
+				ghttp.RespondWith(200, `{}`),
+			))
+		})
+
+		AfterEach(func() {
+			fakeUAA.Close()
+		})
+
+		newOAuthClient := func(tokenCAs *x509.CertPool) cc_client.CcClient {
+			certFile, keyFile := writeClientCert(ca)
+			files, err := cc_client.NewTLSFiles(certFile, keyFile, writeFile("ca.crt", ca.pem()), logger)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			return cc_client.NewCcClient(fakeCC.URL(), "username", "password", false,
+				cc_client.WithTLSFiles(files),
+				cc_client.WithOAuth2ClientCredentials(fakeUAA.URL()+"/oauth/token", "stager-client", "stager-secret", tokenCAs, fakeclock.NewFakeClock(time.Now())),
+			)
+		}
+
+		It("verifies the token endpoint against its own CAs without presenting the CC client certificate", func() {
+			tokenCAs := x509.NewCertPool()
+			tokenCAs.AddCert(otherCA.cert)
+
+			Ω(newOAuthClient(tokenCAs).StagingComplete(stagingGuid, []byte(`{}`), logger)).Should(Succeed())
+			Ω(fakeUAA.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("does not trust the CC CA bundle for the token endpoint", func() {
+			tokenCAs := x509.NewCertPool()
+			tokenCAs.AddCert(ca.cert)
+
+			Ω(newOAuthClient(tokenCAs).StagingComplete(stagingGuid, []byte(`{}`), logger)).ShouldNot(Succeed())
+			Ω(fakeUAA.ReceivedRequests()).Should(BeEmpty())
+		})
+	})
+
+	Describe("NewTLSFiles", func() {
+		It("requires the certificate and key together", func() {
+			certFile, _ := writeClientCert(ca)
+			_, err := cc_client.NewTLSFiles(certFile, "", "", logger)
+			Ω(err).Should(Equal(cc_client.ErrIncompleteClientCertificate))
+		})
+
+		It("fails when a file is missing", func() {
+			_, err := cc_client.NewTLSFiles("", "", filepath.Join(dir, "missing.crt"), logger)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("fails when the CA bundle has no certificates", func() {
+			_, err := cc_client.NewTLSFiles("", "", writeFile("ca.crt", []byte("not a certificate")), logger)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("minimum TLS version", func() {
+		BeforeEach(func() {
+			fakeCC.HTTPTestServer.TLS.MaxVersion = tls.VersionTLS12
+		})
+
+		It("refuses to negotiate below it", func() {
+			client := cc_client.NewCcClient(fakeCC.URL(), "username", "password", true, cc_client.WithMinTLSVersion(tls.VersionTLS13))
+			Ω(client.StagingComplete(stagingGuid, []byte(`{}`), logger)).ShouldNot(Succeed())
+		})
+	})
+
+	Describe("ParseTLSVersion", func() {
+		It("parses known versions", func() {
+			Ω(cc_client.ParseTLSVersion("1.2")).Should(Equal(uint16(tls.VersionTLS12)))
+		})
+
+		It("rejects unknown versions", func() {
+			_, err := cc_client.ParseTLSVersion("1.4")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	template := certificateTemplate()
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage |= x509.KeyUsageCertSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(customize func(*x509.Certificate)) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	template := certificateTemplate()
+	customize(template)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+func certificateTemplate() *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Ω(err).ShouldNot(HaveOccurred())
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "cc-client-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/config"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+// explicitFlags returns the names of the flags given on the command line.
+func explicitFlags() map[string]bool {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// configFileSettings maps the settings of the config file onto the flags
+// they stand in for. Settings left out of the file map to "".
+func configFileSettings(cfg config.Config) map[string]string {
+	duration := func(d config.Duration) string {
+		if d.Duration == 0 {
+			return ""
+		}
+		return d.String()
+	}
+
+	settings := map[string]string{
+		"ccBaseURL":           cfg.CC.BaseURL,
+		"ccUsername":          cfg.CC.Username,
+		"ccPassword":          cfg.CC.Password,
+		"ccClientCert":        cfg.CC.ClientCert,
+		"ccClientKey":         cfg.CC.ClientKey,
+		"ccCACert":            cfg.CC.CACert,
+		"ccMinTLSVersion":     cfg.CC.MinTLSVersion,
+		"ccOAuthTokenURL":     cfg.CC.OAuthTokenURL,
+		"ccOAuthClientID":     cfg.CC.OAuthClientID,
+		"ccOAuthClientSecret": cfg.CC.OAuthClientSecret,
+		"ccOAuthCACert":       cfg.CC.OAuthCACert,
+		"diegoAPIURL":         cfg.Diego.APIURL,
+		"fileServerURL":       cfg.FileServer.URL,
+		"stagerURL":           cfg.Stager.URL,
+		"listenAddress":       cfg.Stager.ListenAddress,
+		"tlsCert":             cfg.Stager.TLSCert,
+		"tlsKey":              cfg.Stager.TLSKey,
+		"tlsClientCA":         cfg.Stager.TLSClientCA,
+
+		"stagingTimeout":             duration(cfg.Timeouts.Staging),
+		"ccDeliveryBaseBackoff":      duration(cfg.Timeouts.CCDeliveryBaseBackoff),
+		"ccDeliveryMaxBackoff":       duration(cfg.Timeouts.CCDeliveryMaxBackoff),
+		"failedStagingTaskRetention": duration(cfg.Timeouts.FailedTaskRetention),
+		"reconcileInterval":          duration(cfg.Timeouts.ReconcileInterval),
+		"outboxDrainInterval":        duration(cfg.Timeouts.OutboxDrainInterval),
+		"callbackURLTTL":             duration(cfg.Timeouts.CallbackURLTTL),
+		"stagingRetryAfter":          duration(cfg.Admission.RetryAfter),
+		"stagingQueueAging":          duration(cfg.Admission.QueueAging),
+	}
+
+	if cfg.Admission.MaxInFlight != 0 {
+		settings["maxInFlightStagings"] = strconv.Itoa(cfg.Admission.MaxInFlight)
+	}
+
+	if cfg.Admission.QueueSize != 0 {
+		settings["stagingQueueSize"] = strconv.Itoa(cfg.Admission.QueueSize)
+	}
+
+	if cfg.Admission.MaxInFlightPerLifecycle != nil {
+		limitsJSON, _ := json.Marshal(cfg.Admission.MaxInFlightPerLifecycle)
+		settings["maxInFlightStagingsPerLifecycle"] = string(limitsJSON)
+	}
+
+	if cfg.Admission.OrganizationQuota != nil {
+		quotaJSON, _ := json.Marshal(cfg.Admission.OrganizationQuota)
+		settings["organizationStagingQuota"] = string(quotaJSON)
+	}
+
+	if cfg.Admission.SpaceQuota != nil {
+		quotaJSON, _ := json.Marshal(cfg.Admission.SpaceQuota)
+		settings["spaceStagingQuota"] = string(quotaJSON)
+	}
+
+	if cfg.CC.SkipCertVerify {
+		settings["skipCertVerify"] = strconv.FormatBool(cfg.CC.SkipCertVerify)
+	}
+
+	if cfg.Lifecycles != nil {
+		lifecyclesJSON, _ := json.Marshal(cfg.Lifecycles)
+		settings["lifecycles"] = string(lifecyclesJSON)
+	}
+
+	return settings
+}
+
+// applyConfigFile sets the flags that the command line left alone from the
+// config file.
+func applyConfigFile(cfg config.Config, explicit map[string]bool) error {
+	for name, value := range configFileSettings(cfg) {
+		if value == "" || explicit[name] {
+			continue
+		}
+
+		err := flag.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("applying config file setting for -%s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// reloadBackendConfig returns current with the reloadable settings of cfg:
+// lifecycles, the staging timeout and the sanitizer rules. Settings given on
+// the command line keep their value, and a staging timeout left out of cfg
+// falls back to flagStagingTimeout, the value of -stagingTimeout.
+func reloadBackendConfig(current backend.Config, cfg config.Config, explicit map[string]bool, flagStagingTimeout time.Duration) (backend.Config, error) {
+	reloaded := current
+
+	if !explicit["lifecycles"] {
+		reloaded.Lifecycles = cfg.Lifecycles
+		if reloaded.Lifecycles == nil {
+			reloaded.Lifecycles = map[string]string{}
+		}
+	}
+
+	if !explicit["stagingTimeout"] {
+		reloaded.StagingTimeout = cfg.Timeouts.Staging.Duration
+		if reloaded.StagingTimeout == 0 {
+			reloaded.StagingTimeout = flagStagingTimeout
+		}
+	}
+
+	sanitizer, err := backend.NewSanitizer(cfg.SanitizerRules, cc_messages.SanitizeErrorMessage)
+	if err != nil {
+		return backend.Config{}, err
+	}
+	reloaded.Sanitizer = sanitizer
+
+	err = checkLifecycles(reloaded)
+	if err != nil {
+		return backend.Config{}, err
+	}
+
+	return reloaded, nil
+}
+
+// newConfigReloader swaps in backends built from the reloaded config file on
+// every hangup. Requests already inside a backend finish with the
+// configuration they started with.
+func newConfigReloader(
+	logger lager.Logger,
+	path string,
+	hangups <-chan os.Signal,
+	backendConfig backend.Config,
+	swappableBackends map[string]*backend.SwappableBackend,
+	explicit map[string]bool,
+	flagStagingTimeout time.Duration,
+) ifrit.Runner {
+	return config.NewReloader(logger, path, hangups, func(cfg config.Config) error {
+		reloaded, err := reloadBackendConfig(backendConfig, cfg, explicit, flagStagingTimeout)
+		if err != nil {
+			return err
+		}
+
+		for lifecycle, b := range newBackends(reloaded, logger) {
+			swappableBackends[lifecycle].Swap(b)
+		}
+
+		backendConfig = reloaded
+		logger.Info("backends-reloaded", lager.Data{"lifecycles": reloaded.Lifecycles})
+		return nil
+	})
+}
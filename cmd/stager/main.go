@@ -1,11 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry/dropsonde"
 	"github.com/pivotal-golang/clock"
@@ -14,14 +26,30 @@ import (
 	"github.com/tedsuo/ifrit/grouper"
 	"github.com/tedsuo/ifrit/http_server"
 	"github.com/tedsuo/ifrit/sigmon"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 
 	"github.com/cloudfoundry-incubator/cf-debug-server"
 	cf_lager "github.com/cloudfoundry-incubator/cf-lager"
 	"github.com/cloudfoundry-incubator/receptor"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/auth"
 	"github.com/cloudfoundry-incubator/stager/backend"
 	"github.com/cloudfoundry-incubator/stager/cc_client"
+	"github.com/cloudfoundry-incubator/stager/config"
 	"github.com/cloudfoundry-incubator/stager/handlers"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/queue"
+	"github.com/cloudfoundry-incubator/stager/reconciler"
+	"github.com/cloudfoundry-incubator/stager/tracing"
+)
+
+var configFile = flag.String(
+	"config",
+	"",
+	"JSON config file; flags given on the command line take precedence over its settings. Lifecycles, the staging timeout and sanitizer rules are reloaded on SIGHUP",
 )
 
 var ccBaseURL = flag.String(
@@ -42,16 +70,286 @@ var ccPassword = flag.String(
 	"Basic auth password for CC internal API",
 )
 
+var ccOAuthTokenURL = flag.String(
+	"ccOAuthTokenURL",
+	"",
+	"OAuth2 token endpoint (e.g. the UAA's /oauth/token); when set, the CC is called with a client credentials token instead of basic auth",
+)
+
+var ccOAuthClientID = flag.String(
+	"ccOAuthClientID",
+	"",
+	"OAuth2 client id used to obtain tokens for the CC",
+)
+
+var ccOAuthClientSecret = flag.String(
+	"ccOAuthClientSecret",
+	"",
+	"OAuth2 client secret used to obtain tokens for the CC",
+)
+
+var ccOAuthCACert = flag.String(
+	"ccOAuthCACert",
+	"",
+	"PEM file of the CAs trusted to sign the OAuth2 token endpoint's certificate; the system roots are used when empty",
+)
+
+var ccClientCert = flag.String(
+	"ccClientCert",
+	"",
+	"PEM file of the client certificate presented to the CC; reloaded when it changes",
+)
+
+var ccClientKey = flag.String(
+	"ccClientKey",
+	"",
+	"PEM file of the private key of ccClientCert; reloaded when it changes",
+)
+
+var ccCACert = flag.String(
+	"ccCACert",
+	"",
+	"PEM file of the CAs trusted to sign the CC's certificate; reloaded when it changes",
+)
+
+var ccMinTLSVersion = flag.String(
+	"ccMinTLSVersion",
+	"1.0",
+	"Lowest TLS version negotiated with the CC (1.0, 1.1, 1.2 or 1.3)",
+)
+
 var skipCertVerify = flag.Bool(
 	"skipCertVerify",
 	false,
 	"skip SSL certificate verification",
 )
 
+var ccDeliveryAttempts = flag.Int(
+	"ccDeliveryAttempts",
+	cc_client.DefaultMaxDeliveryAttempts,
+	"Maximum number of attempts to deliver a staging response to the CC",
+)
+
+var ccDeliveryBaseBackoff = flag.Duration(
+	"ccDeliveryBaseBackoff",
+	cc_client.DefaultDeliveryBaseBackoff,
+	"Initial backoff between attempts to deliver a staging response to the CC",
+)
+
+var ccDeliveryMaxBackoff = flag.Duration(
+	"ccDeliveryMaxBackoff",
+	cc_client.DefaultDeliveryMaxBackoff,
+	"Maximum backoff between attempts to deliver a staging response to the CC",
+)
+
+var ccDeliveryMaxElapsed = flag.Duration(
+	"ccDeliveryMaxElapsed",
+	cc_client.DefaultDeliveryMaxElapsed,
+	"Maximum time spent delivering a staging response to the CC before leaving it to the outbox drainer (must be less than -outboxDrainInterval)",
+)
+
+var outboxDir = flag.String(
+	"outboxDir",
+	"",
+	"Directory in which staging responses are persisted until their tasks are deleted, and queued stagings until their tasks are created (required)",
+)
+
+var outboxDrainInterval = flag.Duration(
+	"outboxDrainInterval",
+	outbox.DefaultDrainInterval,
+	"Interval at which undelivered staging responses are redelivered to the CC",
+)
+
+var failedStagingTaskRetention = flag.Duration(
+	"failedStagingTaskRetention",
+	0,
+	"How long failed staging tasks are kept in Diego after their result has been delivered to the CC",
+)
+
+var reconcileInterval = flag.Duration(
+	"reconcileInterval",
+	reconciler.DefaultReconcileInterval,
+	"Interval at which delivered staging tasks are deleted and completed ones whose result never reached the CC are replayed; tasks are deleted up to one interval after the CC has accepted their result, and lost results are first replayed one interval after startup",
+)
+
+var imageRegistry = flag.String(
+	"imageRegistry",
+	"",
+	"Registry (host[:port]/namespace) to which images built by the dockerfile lifecycle are pushed",
+)
+
+var dockerRegistryCredentialsFile = flag.String(
+	"dockerRegistryCredentialsFile",
+	"",
+	"Path to a JSON file of named docker registry credentials (name => {user, password, email}) that docker staging requests may refer to",
+)
+
+var imageRegistryCredentials = flag.String(
+	"imageRegistryCredentials",
+	"",
+	"Name of the credentials in -dockerRegistryCredentialsFile with which images built by the dockerfile lifecycle are pushed to -imageRegistry",
+)
+
+var logSafeEnvironmentVariables = flag.String(
+	"logSafeEnvironmentVariables",
+	"LANG",
+	"Comma-separated names of environment variables whose values may be logged; all others are redacted",
+)
+
+var metricsAddress = flag.String(
+	"metricsAddress",
+	"",
+	"Address (host:port) on which Prometheus metrics are served at /metrics (disabled if empty)",
+)
+
+var tracingOTLPEndpoint = flag.String(
+	"tracingOTLPEndpoint",
+	"",
+	"host:port of an OTLP/HTTP collector to which traces are exported (disabled if empty)",
+)
+
+var tracingOTLPInsecure = flag.Bool(
+	"tracingOTLPInsecure",
+	false,
+	"Export traces to the OTLP collector over plain HTTP",
+)
+
+var tracingFile = flag.String(
+	"tracingFile",
+	"",
+	"Path of a file to which traces are appended as JSON (disabled if empty)",
+)
+
+var tracingSampleRatio = flag.Float64(
+	"tracingSampleRatio",
+	1,
+	"Fraction of staging requests that start a new trace",
+)
+
+var apiUsername = flag.String(
+	"apiUsername",
+	"",
+	"Basic auth username required of staging API callers",
+)
+
+var apiPassword = flag.String(
+	"apiPassword",
+	"",
+	"Basic auth password required of staging API callers",
+)
+
+var apiClientCA = flag.String(
+	"apiClientCA",
+	"",
+	"PEM file of CAs whose client certificates are accepted from staging API callers",
+)
+
+var callbackUsername = flag.String(
+	"callbackUsername",
+	"",
+	"Basic auth username required of Diego staging completion callbacks",
+)
+
+var callbackPassword = flag.String(
+	"callbackPassword",
+	"",
+	"Basic auth password required of Diego staging completion callbacks",
+)
+
+var callbackSigningKey = flag.String(
+	"callbackSigningKey",
+	"",
+	"Key used to sign completion callback URLs; when set, unsigned or expired callbacks are rejected",
+)
+
+var callbackURLTTL = flag.Duration(
+	"callbackURLTTL",
+	24*time.Hour,
+	"How long a signed completion callback URL is accepted from when its task is created; must outlast the longest staging",
+)
+
+var listenAddress = flag.String(
+	"listenAddress",
+	"",
+	"Address the stager listens on (defaults to 0.0.0.0 and the port of stagerURL)",
+)
+
+var tlsCert = flag.String(
+	"tlsCert",
+	"",
+	"PEM file of the certificate served by the stager; requires tlsKey and an https stagerURL",
+)
+
+var tlsKey = flag.String(
+	"tlsKey",
+	"",
+	"PEM file of the private key of tlsCert",
+)
+
+var tlsClientCA = flag.String(
+	"tlsClientCA",
+	"",
+	"PEM file of CAs one of whose client certificates every caller, Diego callbacks included, must present",
+)
+
+var stagingTimeout = flag.Duration(
+	"stagingTimeout",
+	backend.DefaultStagingTimeout,
+	"Timeout of stagings whose request does not set one",
+)
+
+var maxInFlightStagings = flag.Int(
+	"maxInFlightStagings",
+	0,
+	"Maximum number of stagings in flight; further staging requests are rejected with 429 (0 for no limit)",
+)
+
+var maxInFlightStagingsPerLifecycle = flag.String(
+	"maxInFlightStagingsPerLifecycle",
+	"",
+	"JSON map from lifecycle to the maximum number of its stagings in flight, e.g. {\"docker\": 10}",
+)
+
+var organizationStagingQuota = flag.String(
+	"organizationStagingQuota",
+	"",
+	"JSON quota on the stagings of each organization, e.g. {\"max_in_flight\": 5, \"max_memory_mb\": 8192, \"max_disk_mb\": 16384}",
+)
+
+var spaceStagingQuota = flag.String(
+	"spaceStagingQuota",
+	"",
+	"JSON quota on the stagings of each space, in the format of -organizationStagingQuota",
+)
+
+var stagingRetryAfter = flag.Duration(
+	"stagingRetryAfter",
+	admission.DefaultRetryAfter,
+	"How long the CC is told to wait before retrying a rejected staging request",
+)
+
+var stagingQueueSize = flag.Int(
+	"stagingQueueSize",
+	0,
+	"Maximum number of staging requests queued for room under the staging limits; further requests are rejected with 429 (0 to reject rather than queue)",
+)
+
+var stagingQueueAging = flag.Duration(
+	"stagingQueueAging",
+	queue.DefaultAging,
+	"How long a queued staging waits for its priority to go up by one",
+)
+
+var checkLifecycleDownloads = flag.Bool(
+	"checkLifecycleDownloads",
+	false,
+	"HEAD the download URL of every lifecycle at startup and on reload, and refuse lifecycles that are not there",
+)
+
 var lifecycles = flag.String(
 	"lifecycles",
 	"{}",
-	"Map of lifecycles for different stacks (name => compiler_name)",
+	"Map of lifecycles for different stacks (lifecycle/stack => compiler_name), e.g. buildpack/cflinuxfs2, cnb/cflinuxfs2 or docker",
 )
 
 var diegoAPIURL = flag.String(
@@ -80,12 +378,99 @@ const (
 func main() {
 	cf_debug_server.AddFlags(flag.CommandLine)
 	cf_lager.AddFlags(flag.CommandLine)
+
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		err := validateConfig(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		fmt.Println("config is valid")
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "recipe" {
+		err := renderRecipe(os.Args[2:], os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	flag.Parse()
 
 	logger, reconfigurableSink := cf_lager.New("stager")
 	initializeDropsonde(logger)
 
-	ccClient := cc_client.NewCcClient(*ccBaseURL, *ccUsername, *ccPassword, *skipCertVerify)
+	explicit := explicitFlags()
+
+	// A reloaded config file that leaves the staging timeout out falls back
+	// to the flag, not to whatever the previous file said.
+	flagStagingTimeout := *stagingTimeout
+
+	var fileConfig config.Config
+	if *configFile != "" {
+		var err error
+		fileConfig, err = config.Load(*configFile)
+		if err != nil {
+			logger.Fatal("Error loading config file", err)
+		}
+
+		err = applyConfigFile(fileConfig, explicit)
+		if err != nil {
+			logger.Fatal("Error applying config file", err)
+		}
+	}
+
+	clock := clock.NewClock()
+
+	minTLSVersion, err := cc_client.ParseTLSVersion(*ccMinTLSVersion)
+	if err != nil {
+		logger.Fatal("Invalid CC minimum TLS version", err)
+	}
+
+	ccClientOptions := []cc_client.Option{cc_client.WithMinTLSVersion(minTLSVersion)}
+
+	if *ccClientCert != "" || *ccClientKey != "" || *ccCACert != "" {
+		tlsFiles, err := cc_client.NewTLSFiles(*ccClientCert, *ccClientKey, *ccCACert, logger)
+		if err != nil {
+			logger.Fatal("Error loading CC TLS files", err)
+		}
+
+		ccClientOptions = append(ccClientOptions, cc_client.WithTLSFiles(tlsFiles))
+	}
+
+	if *ccOAuthTokenURL != "" {
+		var tokenCAs *x509.CertPool
+		if *ccOAuthCACert != "" {
+			tokenCAs = x509.NewCertPool()
+			loadCertPool(logger, tokenCAs, *ccOAuthCACert)
+		}
+
+		ccClientOptions = append(ccClientOptions, cc_client.WithOAuth2ClientCredentials(*ccOAuthTokenURL, *ccOAuthClientID, *ccOAuthClientSecret, tokenCAs, clock))
+	}
+
+	if *reconcileInterval <= 0 {
+		logger.Fatal("Invalid reconcile interval", errors.New("reconcileInterval must be positive"))
+	}
+
+	if *ccDeliveryMaxElapsed <= 0 || *ccDeliveryMaxElapsed >= *outboxDrainInterval {
+		logger.Fatal("Invalid CC delivery window", errors.New("ccDeliveryMaxElapsed must be positive and less than outboxDrainInterval"))
+	}
+
+	ccClient := cc_client.NewRetryingCcClient(
+		cc_client.NewCcClient(*ccBaseURL, *ccUsername, *ccPassword, *skipCertVerify, ccClientOptions...),
+		cc_client.RetryPolicy{
+			MaxAttempts: *ccDeliveryAttempts,
+			BaseBackoff: *ccDeliveryBaseBackoff,
+			MaxBackoff:  *ccDeliveryMaxBackoff,
+			MaxElapsed:  *ccDeliveryMaxElapsed,
+		},
+		clock,
+	)
 	diegoAPIClient := receptor.NewClient(*diegoAPIURL)
 
 	address, err := getStagerAddress()
@@ -93,14 +478,112 @@ func main() {
 		logger.Fatal("Invalid stager URL", err)
 	}
 
-	backends := initializeBackends(logger)
+	redactor := backend.NewRedactor(strings.Split(*logSafeEnvironmentVariables, ","))
+
+	var callbackSigner *backend.CallbackSigner
+	if *callbackSigningKey != "" {
+		callbackSigner = backend.NewCallbackSigner([]byte(*callbackSigningKey), *callbackURLTTL, clock)
+	}
+
+	backendConfig, err := initializeBackendConfig(redactor, callbackSigner, fileConfig.SanitizerRules)
+	if err != nil {
+		logger.Fatal("Error initializing backends", err)
+	}
+
+	err = checkLifecycles(backendConfig)
+	if err != nil {
+		logger.Fatal("Invalid lifecycles", err)
+	}
+
+	// The handlers and the reconciler keep these for the life of the process;
+	// a config reload swaps the backends behind them.
+	swappableBackends := map[string]*backend.SwappableBackend{}
+	backends := map[string]backend.Backend{}
+	for lifecycle, b := range newBackends(backendConfig, logger) {
+		swappableBackends[lifecycle] = backend.NewSwappableBackend(b)
+		backends[lifecycle] = swappableBackends[lifecycle]
+	}
+
+	if *outboxDir == "" {
+		logger.Fatal("Invalid outbox directory", errors.New("outboxDir is required, as the reconciler cannot tell the results the CC already has from lost ones without it"))
+	}
+
+	stagingOutbox, err := outbox.NewFileOutbox(*outboxDir, logger)
+	if err != nil {
+		logger.Fatal("Error initializing outbox", err)
+	}
+
+	emitter := metrics.NewDropsondeEmitter()
+	var prometheusEmitter *metrics.PrometheusEmitter
+	if *metricsAddress != "" {
+		prometheusEmitter = metrics.NewPrometheusEmitter()
+		emitter = metrics.NewFanOut(emitter, prometheusEmitter)
+	}
 
-	handler := handlers.New(logger, ccClient, diegoAPIClient, backends, clock.NewClock())
+	var tracerProvider trace.TracerProvider = noop.NewTracerProvider()
+	sdkTracerProvider, err := tracing.NewTracerProvider(tracing.Config{
+		OTLPEndpoint: *tracingOTLPEndpoint,
+		OTLPInsecure: *tracingOTLPInsecure,
+		File:         *tracingFile,
+		SampleRatio:  *tracingSampleRatio,
+	})
+	switch err {
+	case nil:
+		tracerProvider = sdkTracerProvider
+		defer sdkTracerProvider.Shutdown(context.Background())
+	case tracing.ErrNoExporter:
+	default:
+		logger.Fatal("Error initializing tracing", err)
+	}
+
+	apiAuthenticator, callbackAuthenticator := initializeAuthenticators(logger)
+
+	admissionController := initializeAdmission(logger, diegoAPIClient)
+	inFlight := metrics.NewInFlightGauge(emitter, admissionController)
+
+	var stagingQueue *queue.Queue
+	if *stagingQueueSize > 0 {
+		stagingQueue = initializeQueue(logger, emitter, clock)
+	}
+
+	handler := handlers.New(logger, ccClient, diegoAPIClient, backends, stagingOutbox, redactor, emitter, tracerProvider, apiAuthenticator, callbackAuthenticator, callbackSigner, inFlight, admissionController, stagingQueue, clock)
 
 	members := grouper.Members{
-		{"server", http_server.New(address, handler)},
+		{"server", newServer(logger, address, handler)},
+	}
+
+	if prometheusEmitter != nil {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", prometheusEmitter.Handler())
+
+		members = append(members, grouper.Member{
+			"metrics-server", http_server.New(*metricsAddress, metricsMux),
+		})
+	}
+
+	if stagingQueue != nil {
+		members = append(members, grouper.Member{
+			"queue-dispatcher", queue.NewDispatcher(logger, stagingQueue, admissionController, diegoAPIClient, stagingOutbox, callbackSigner, inFlight, emitter, tracerProvider.Tracer(tracing.TracerName), clock),
+		})
 	}
 
+	members = append(members, grouper.Member{
+		"reconciler", reconciler.New(logger, diegoAPIClient, backends, stagingOutbox, admissionController, inFlight, *failedStagingTaskRetention, emitter, clock, *reconcileInterval),
+	})
+
+	if *configFile != "" {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+
+		members = append(members, grouper.Member{
+			"config-reloader", newConfigReloader(logger, *configFile, hangups, backendConfig, swappableBackends, explicit, flagStagingTimeout),
+		})
+	}
+
+	members = append(members, grouper.Member{
+		"outbox-drainer", outbox.NewDrainer(logger, stagingOutbox, ccClient, clock, *outboxDrainInterval),
+	})
+
 	if dbgAddr := cf_debug_server.DebugAddress(flag.CommandLine); dbgAddr != "" {
 		members = append(grouper.Members{
 			{"debug-server", cf_debug_server.Runner(dbgAddr, reconfigurableSink)},
@@ -130,29 +613,156 @@ func initializeDropsonde(logger lager.Logger) {
 	}
 }
 
-func initializeBackends(logger lager.Logger) map[string]backend.Backend {
+func initializeAuthenticators(logger lager.Logger) (auth.Authenticator, auth.Authenticator) {
+	apiAuthenticators := []auth.Authenticator{}
+
+	if *apiUsername != "" {
+		apiAuthenticators = append(apiAuthenticators, auth.NewBasicAuthenticator(*apiUsername, *apiPassword))
+	}
+
+	if *apiClientCA != "" {
+		clientCAs := x509.NewCertPool()
+		loadCertPool(logger, clientCAs, *apiClientCA)
+
+		apiAuthenticators = append(apiAuthenticators, auth.NewClientCertAuthenticator(clientCAs))
+	}
+
+	var apiAuthenticator auth.Authenticator
+	if len(apiAuthenticators) > 0 {
+		apiAuthenticator = auth.Any(apiAuthenticators...)
+	}
+
+	var callbackAuthenticator auth.Authenticator
+	if *callbackUsername != "" {
+		callbackAuthenticator = auth.NewBasicAuthenticator(*callbackUsername, *callbackPassword)
+	}
+
+	return apiAuthenticator, callbackAuthenticator
+}
+
+// initializeAdmission counts the staging tasks already running on Diego
+// against the limits, if there are any. If Diego cannot be reached the count
+// starts at zero.
+func initializeAdmission(logger lager.Logger, diegoClient receptor.Client) *admission.Controller {
+	limits := admission.Limits{MaxInFlight: *maxInFlightStagings}
+
+	jsonFlags := []struct {
+		name  string
+		value string
+		into  interface{}
+	}{
+		{"maxInFlightStagingsPerLifecycle", *maxInFlightStagingsPerLifecycle, &limits.MaxInFlightPerLifecycle},
+		{"organizationStagingQuota", *organizationStagingQuota, &limits.OrganizationQuota},
+		{"spaceStagingQuota", *spaceStagingQuota, &limits.SpaceQuota},
+	}
+	for _, f := range jsonFlags {
+		if f.value == "" {
+			continue
+		}
+
+		err := json.Unmarshal([]byte(f.value), f.into)
+		if err != nil {
+			logger.Fatal("Error parsing "+f.name+" flag", err)
+		}
+	}
+
+	controller := admission.NewController(limits, *stagingRetryAfter)
+	if limits.MaxInFlight == 0 && len(limits.MaxInFlightPerLifecycle) == 0 &&
+		limits.OrganizationQuota == (admission.Quota{}) && limits.SpaceQuota == (admission.Quota{}) {
+		return controller
+	}
+
+	mark := controller.Mark()
+	tasks, err := diegoClient.TasksByDomain(backend.StagingTaskDomain)
+	if err != nil {
+		logger.Error("failed-to-reconcile-stagings-in-flight", err)
+		return controller
+	}
+
+	controller.Reconcile(tasks, mark)
+	logger.Info("reconciled-stagings-in-flight", lager.Data{"in-flight": controller.InFlight("")})
+
+	return controller
+}
+
+// initializeQueue restores the stagings queued before the stager restarted,
+// which the CC was told had been accepted.
+func initializeQueue(logger lager.Logger, emitter metrics.Emitter, clock clock.Clock) *queue.Queue {
+	store, err := outbox.NewFileOutbox(filepath.Join(*outboxDir, "queue"), logger)
+	if err != nil {
+		logger.Fatal("Error initializing staging queue", err)
+	}
+
+	stagingQueue := queue.New(*stagingQueueSize, *stagingQueueAging, *stagingRetryAfter, store, emitter, clock)
+
+	err = stagingQueue.Restore(logger)
+	if err != nil {
+		logger.Fatal("Error restoring staging queue", err)
+	}
+
+	return stagingQueue
+}
+
+func initializeBackendConfig(redactor backend.Redactor, callbackSigner *backend.CallbackSigner, sanitizerRules []backend.SanitizerRule) (backend.Config, error) {
 	lifecyclesMap := make(map[string]string)
 	err := json.Unmarshal([]byte(*lifecycles), &lifecyclesMap)
 	if err != nil {
-		logger.Fatal("Error parsing lifecycles flag", err)
+		return backend.Config{}, fmt.Errorf("parsing lifecycles flag: %s", err)
 	}
 	_, err = url.Parse(*stagerURL)
 	if err != nil {
-		logger.Fatal("Error parsing stager URL", err)
+		return backend.Config{}, fmt.Errorf("parsing stager URL: %s", err)
+	}
+
+	dockerRegistryCredentials := make(map[string]backend.DockerCredentials)
+	if *dockerRegistryCredentialsFile != "" {
+		credentialsJSON, err := ioutil.ReadFile(*dockerRegistryCredentialsFile)
+		if err != nil {
+			return backend.Config{}, fmt.Errorf("reading docker registry credentials file: %s", err)
+		}
+
+		err = json.Unmarshal(credentialsJSON, &dockerRegistryCredentials)
+		if err != nil {
+			return backend.Config{}, fmt.Errorf("parsing docker registry credentials file: %s", err)
+		}
 	}
 
-	config := backend.Config{
+	if *imageRegistryCredentials != "" {
+		if _, ok := dockerRegistryCredentials[*imageRegistryCredentials]; !ok {
+			return backend.Config{}, fmt.Errorf("image registry credentials %q are not in the docker registry credentials file", *imageRegistryCredentials)
+		}
+	}
+
+	sanitizer, err := backend.NewSanitizer(sanitizerRules, cc_messages.SanitizeErrorMessage)
+	if err != nil {
+		return backend.Config{}, err
+	}
+
+	return backend.Config{
 		TaskDomain:     backend.StagingTaskDomain,
 		StagerURL:      *stagerURL,
 		FileServerURL:  *fileServerURL,
 		Lifecycles:     lifecyclesMap,
 		SkipCertVerify: *skipCertVerify,
-		Sanitizer:      cc_messages.SanitizeErrorMessage,
-	}
+		Sanitizer:      sanitizer,
+		ImageRegistry:  *imageRegistry,
+		StagingTimeout: *stagingTimeout,
+
+		DockerRegistryCredentials: dockerRegistryCredentials,
+		ImageRegistryCredentials:  *imageRegistryCredentials,
+		Redactor:                  redactor,
+		CallbackUsername:          *callbackUsername,
+		CallbackPassword:          *callbackPassword,
+		CallbackSigner:            callbackSigner,
+	}, nil
+}
 
+func newBackends(backendConfig backend.Config, logger lager.Logger) map[string]backend.Backend {
 	return map[string]backend.Backend{
-		"buildpack": backend.NewTraditionalBackend(config, logger),
-		"docker":    backend.NewDockerBackend(config, logger),
+		backend.TraditionalLifecycleName: backend.NewTraditionalBackend(backendConfig, logger),
+		backend.DockerLifecycleName:      backend.NewDockerBackend(backendConfig, logger),
+		backend.CNBLifecycleName:         backend.NewCNBBackend(backendConfig, logger),
+		backend.DockerfileLifecycleName:  backend.NewDockerfileBackend(backendConfig, logger),
 	}
 }
 
@@ -162,10 +772,71 @@ func getStagerAddress() (string, error) {
 		return "", err
 	}
 
-	_, port, err := net.SplitHostPort(url.Host)
+	// Diego calls back on stagerURL, so it has to speak what we serve.
+	if *tlsCert != "" && url.Scheme != "https" {
+		return "", errors.New("stagerURL must be https when serving TLS")
+	}
+
+	if *listenAddress != "" {
+		return *listenAddress, nil
+	}
+
+	port := url.Port()
+	if port == "" {
+		port = "80"
+		if url.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	return net.JoinHostPort("0.0.0.0", port), nil
+}
+
+func newServer(logger lager.Logger, address string, handler http.Handler) ifrit.Runner {
+	if *tlsCert == "" && *tlsKey == "" {
+		return http_server.New(address, handler)
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
 	if err != nil {
-		return "", err
+		logger.Fatal("Error loading TLS certificate", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// With tlsClientCA every caller must present a client certificate. With
+	// only apiClientCA, client certificates are optional at the TLS layer, as
+	// Diego callbacks and basic auth callers do not present one, and whether
+	// a caller is allowed in is decided by the authenticators.
+	clientCAs := x509.NewCertPool()
+	for _, caFile := range []string{*tlsClientCA, *apiClientCA} {
+		if caFile != "" {
+			loadCertPool(logger, clientCAs, caFile)
+		}
 	}
 
-	return "0.0.0.0:" + port, nil
+	switch {
+	case *tlsClientCA != "":
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case *apiClientCA != "":
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return http_server.NewTLSServer(address, handler, tlsConfig)
+}
+
+func loadCertPool(logger lager.Logger, pool *x509.CertPool, caFile string) {
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		logger.Fatal("Error reading CA file", err, lager.Data{"file": caFile})
+	}
+
+	if !pool.AppendCertsFromPEM(caPEM) {
+		logger.Fatal("Error parsing CA file", errors.New("no certificates found"), lager.Data{"file": caFile})
+	}
 }
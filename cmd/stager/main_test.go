@@ -4,8 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry-incubator/receptor"
 	"github.com/cloudfoundry-incubator/runtime-schema/models"
@@ -14,11 +21,16 @@ import (
 	"github.com/cloudfoundry-incubator/stager/cmd/stager/testrunner"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"github.com/onsi/gomega/ghttp"
 	"github.com/tedsuo/rata"
 )
 
+// fileServerURL is where the stager is told its lifecycles are; the tests
+// that download them start a file server of their own.
+const fileServerURL = "http://file-server.example.com"
+
 var _ = Describe("Stager", func() {
 	var (
 		fakeReceptor *ghttp.Server
@@ -28,6 +40,7 @@ var _ = Describe("Stager", func() {
 		httpClient       *http.Client
 
 		callbackURL string
+		outboxDir   string
 	)
 
 	BeforeEach(func() {
@@ -38,11 +51,21 @@ var _ = Describe("Stager", func() {
 		fakeReceptor = ghttp.NewServer()
 		fakeCC = ghttp.NewServer()
 
+		var err error
+		outboxDir, err = ioutil.TempDir("", "stager-outbox")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fakeReceptor.RouteToHandler("GET", "/v1/domains/"+backend.StagingTaskDomain+"/tasks",
+			ghttp.RespondWithJSONEncoded(http.StatusOK, []receptor.TaskResponse{}),
+		)
+
 		runner = testrunner.New(testrunner.Config{
-			StagerBin:   stagerPath,
-			StagerURL:   stagerURL,
-			DiegoAPIURL: fakeReceptor.URL(),
-			CCBaseURL:   fakeCC.URL(),
+			StagerBin:     stagerPath,
+			StagerURL:     stagerURL,
+			DiegoAPIURL:   fakeReceptor.URL(),
+			CCBaseURL:     fakeCC.URL(),
+			FileServerURL: fileServerURL,
+			OutboxDir:     outboxDir,
 		})
 
 		requestGenerator = rata.NewRequestGenerator(stagerURL, stager.Routes)
@@ -51,8 +74,21 @@ var _ = Describe("Stager", func() {
 
 	AfterEach(func() {
 		runner.Stop()
+		os.RemoveAll(outboxDir)
 	})
 
+	// taskRequests are the requests to Diego other than the reconciler's
+	// periodic listing of the staging tasks.
+	taskRequests := func() []*http.Request {
+		requests := []*http.Request{}
+		for _, req := range fakeReceptor.ReceivedRequests() {
+			if req.URL.Path != "/v1/domains/"+backend.StagingTaskDomain+"/tasks" {
+				requests = append(requests, req)
+			}
+		}
+		return requests
+	}
+
 	Context("when started", func() {
 		BeforeEach(func() {
 			lifecycles := `{
@@ -94,7 +130,7 @@ var _ = Describe("Stager", func() {
 				Ω(err).ShouldNot(HaveOccurred())
 				Ω(resp.StatusCode).Should(Equal(http.StatusAccepted))
 
-				Eventually(fakeReceptor.ReceivedRequests).Should(HaveLen(1))
+				Eventually(taskRequests).Should(HaveLen(1))
 				Consistently(runner.Session()).ShouldNot(gexec.Exit())
 			})
 		})
@@ -130,7 +166,7 @@ var _ = Describe("Stager", func() {
 				Ω(err).ShouldNot(HaveOccurred())
 				Ω(resp.StatusCode).Should(Equal(http.StatusAccepted))
 
-				Eventually(fakeReceptor.ReceivedRequests).Should(HaveLen(1))
+				Eventually(taskRequests).Should(HaveLen(1))
 				Consistently(runner.Session()).ShouldNot(gexec.Exit())
 			})
 		})
@@ -231,4 +267,559 @@ var _ = Describe("Stager", func() {
 			})
 		})
 	})
+
+	Context("when started with a reconcile interval", func() {
+		BeforeEach(func() {
+			runner.Start("--lifecycles", `{"docker": "docker/lifecycle.tgz"}`, "--reconcileInterval", "1h")
+		})
+
+		It("lists the staging tasks on startup", func() {
+			Eventually(fakeReceptor.ReceivedRequests).Should(HaveLen(1))
+			Ω(taskRequests()).Should(BeEmpty())
+			Consistently(runner.Session()).ShouldNot(gexec.Exit())
+		})
+	})
+
+	Context("when started without a reconcile interval", func() {
+		It("exits, as nothing would delete the staging tasks", func() {
+			session, err := gexec.Start(exec.Command(stagerPath, "--fileServerURL", fileServerURL, "--lifecycles", `{"docker": "docker/lifecycle.tgz"}`, "--reconcileInterval", "0"), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(session).Should(gexec.Exit())
+			Ω(session.ExitCode()).ShouldNot(BeZero())
+			Ω(session).Should(gbytes.Say("Invalid reconcile interval"))
+		})
+	})
+
+	Context("when started without an outbox directory", func() {
+		It("exits, as results the CC already has would be replayed after a restart", func() {
+			session, err := gexec.Start(exec.Command(stagerPath, "--fileServerURL", fileServerURL, "--lifecycles", `{"docker": "docker/lifecycle.tgz"}`), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(session).Should(gexec.Exit())
+			Ω(session.ExitCode()).ShouldNot(BeZero())
+			Ω(session).Should(gbytes.Say("Invalid outbox directory"))
+		})
+	})
+
+	Context("when started with API credentials", func() {
+		BeforeEach(func() {
+			runner.Start("--lifecycles", `{"docker": "docker/lifecycle.tgz"}`, "--apiUsername", "cc", "--apiPassword", "secret")
+		})
+
+		stopStaging := func(username, password string) *http.Response {
+			req, err := requestGenerator.CreateRequest(stager.StopStagingRoute, rata.Params{"staging_guid": "my-task-guid"}, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			if username != "" {
+				req.SetBasicAuth(username, password)
+			}
+
+			resp, err := httpClient.Do(req)
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			return resp
+		}
+
+		It("rejects requests without the credentials", func() {
+			Ω(stopStaging("", "").StatusCode).Should(Equal(http.StatusUnauthorized))
+			Ω(stopStaging("cc", "guess").StatusCode).Should(Equal(http.StatusUnauthorized))
+			Ω(taskRequests()).Should(BeEmpty())
+		})
+
+		It("serves requests with the credentials", func() {
+			fakeReceptor.RouteToHandler("GET", "/v1/tasks/my-task-guid", ghttp.RespondWith(http.StatusNotFound, `{}`))
+
+			Ω(stopStaging("cc", "secret").StatusCode).ShouldNot(Equal(http.StatusUnauthorized))
+			Ω(taskRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Context("when started with a callback signing key", func() {
+		BeforeEach(func() {
+			runner.Start("--lifecycles", `{"docker": "docker/lifecycle.tgz"}`, "--callbackSigningKey", "signing-key")
+		})
+
+		It("rejects unsigned staging completion callbacks", func() {
+			taskJSON, err := json.Marshal(receptor.TaskResponse{
+				TaskGuid:   "the-task-guid",
+				Domain:     backend.StagingTaskDomain,
+				Annotation: `{"lifecycle": "docker"}`,
+				Result:     `{}`,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			req, err := requestGenerator.CreateRequest(stager.StagingCompletedRoute, rata.Params{"staging_guid": "the-task-guid"}, bytes.NewReader(taskJSON))
+			Ω(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := httpClient.Do(req)
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+
+			Ω(resp.StatusCode).Should(Equal(http.StatusForbidden))
+			Consistently(fakeCC.ReceivedRequests).Should(BeEmpty())
+		})
+	})
+
+	Context("when started with TLS", func() {
+		var (
+			certificates testrunner.Certificates
+			certsDir     string
+			stagerURL    string
+			tlsClientCA  string
+		)
+
+		BeforeEach(func() {
+			var err error
+			certsDir, err = ioutil.TempDir("", "stager-certs")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			certificates = testrunner.GenerateCertificates(certsDir)
+			tlsClientCA = ""
+		})
+
+		JustBeforeEach(func() {
+			stagerURL = fmt.Sprintf("https://127.0.0.1:%d", 8888+GinkgoParallelNode())
+			runner = testrunner.New(testrunner.Config{
+				StagerBin:     stagerPath,
+				StagerURL:     stagerURL,
+				DiegoAPIURL:   fakeReceptor.URL(),
+				CCBaseURL:     fakeCC.URL(),
+				FileServerURL: fileServerURL,
+				OutboxDir:     outboxDir,
+				TLSCert:       certificates.ServerCert,
+				TLSKey:        certificates.ServerKey,
+				TLSClientCA:   tlsClientCA,
+			})
+			runner.Start("--lifecycles", `{"docker": "docker/lifecycle.tgz"}`, "--apiClientCA", certificates.CA)
+
+			requestGenerator = rata.NewRequestGenerator(stagerURL, stager.Routes)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(certsDir)
+		})
+
+		stagingRequest := func() *http.Request {
+			req, err := requestGenerator.CreateRequest(stager.StageRoute, rata.Params{"staging_guid": "my-task-guid"}, strings.NewReader(`{
+				"app_id":"my-app-guid",
+				"stack":"lucid64",
+				"file_descriptors":3,
+				"memory_mb" : 1024,
+				"disk_mb" : 128,
+				"environment" : [],
+				"lifecycle": "docker",
+				"lifecycle_data": {
+				  "docker_image":"http://docker.docker/docker"
+				}
+			}`))
+			Ω(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+
+		tlsClient := func(withClientCert bool) *http.Client {
+			return &http.Client{
+				Transport: &http.Transport{TLSClientConfig: certificates.ClientTLSConfig(withClientCert)},
+			}
+		}
+
+		stage := func(withClientCert bool) *http.Response {
+			resp, err := tlsClient(withClientCert).Do(stagingRequest())
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			return resp
+		}
+
+		It("accepts staging requests from callers with a client certificate and asks for https callbacks", func() {
+			fakeReceptor.RouteToHandler("POST", "/v1/tasks", func(w http.ResponseWriter, req *http.Request) {
+				var taskRequest receptor.TaskCreateRequest
+				err := json.NewDecoder(req.Body).Decode(&taskRequest)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(taskRequest.CompletionCallbackURL).Should(Equal(stagerURL + "/v1/staging/my-task-guid/completed"))
+			})
+
+			Ω(stage(true).StatusCode).Should(Equal(http.StatusAccepted))
+			Eventually(taskRequests).Should(HaveLen(1))
+		})
+
+		It("rejects staging requests from callers without a client certificate", func() {
+			Ω(stage(false).StatusCode).Should(Equal(http.StatusUnauthorized))
+			Ω(taskRequests()).Should(BeEmpty())
+		})
+
+		Context("and a TLS client CA", func() {
+			BeforeEach(func() {
+				tlsClientCA = certificates.CA
+			})
+
+			It("accepts callers with a client certificate", func() {
+				fakeReceptor.RouteToHandler("POST", "/v1/tasks", ghttp.RespondWith(http.StatusCreated, `{}`))
+
+				Ω(stage(true).StatusCode).Should(Equal(http.StatusAccepted))
+			})
+
+			It("refuses connections from callers without a client certificate", func() {
+				_, err := tlsClient(false).Do(stagingRequest())
+				Ω(err).Should(HaveOccurred())
+				Ω(taskRequests()).Should(BeEmpty())
+			})
+		})
+	})
+
+	Context("when started with a config file", func() {
+		var (
+			configDir  string
+			configPath string
+		)
+
+		writeConfig := func(contents string) {
+			Ω(ioutil.WriteFile(configPath, []byte(contents), 0600)).Should(Succeed())
+		}
+
+		stageBuildpack := func() int {
+			req, err := requestGenerator.CreateRequest(stager.StageRoute, rata.Params{"staging_guid": "my-task-guid"}, strings.NewReader(`{
+				"app_id":"my-app-guid",
+				"stack":"lucid64",
+				"file_descriptors":3,
+				"memory_mb" : 1024,
+				"disk_mb" : 128,
+				"environment" : [],
+				"lifecycle": "buildpack",
+				"lifecycle_data": {
+				  "buildpacks" : [],
+				  "app_bits_download_uri":"http://example.com/app_bits"
+				}
+			}`))
+			Ω(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := httpClient.Do(req)
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = ioutil.TempDir("", "stager-config")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			configPath = filepath.Join(configDir, "stager.json")
+			writeConfig(`{"lifecycles": {"docker": "docker/lifecycle.tgz"}}`)
+
+			fakeReceptor.RouteToHandler("POST", "/v1/tasks", ghttp.RespondWith(http.StatusCreated, `{}`))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(configDir)
+		})
+
+		Context("and the file is valid", func() {
+			BeforeEach(func() {
+				runner.Start("--config", configPath)
+			})
+
+			It("reloads the lifecycles on SIGHUP", func() {
+				Ω(stageBuildpack()).Should(Equal(http.StatusInternalServerError))
+
+				writeConfig(`{"lifecycles": {"docker": "docker/lifecycle.tgz", "buildpack/lucid64": "lifecycle.zip"}}`)
+				runner.Session().Signal(syscall.SIGHUP)
+				Eventually(runner.Session()).Should(gbytes.Say("backends-reloaded"))
+
+				Ω(stageBuildpack()).Should(Equal(http.StatusAccepted))
+				Consistently(runner.Session()).ShouldNot(gexec.Exit())
+			})
+
+			It("falls back to the staging timeout flag when the reloaded file leaves it out", func() {
+				var timeouts []time.Duration
+				fakeReceptor.RouteToHandler("POST", "/v1/tasks", func(w http.ResponseWriter, req *http.Request) {
+					var taskRequest receptor.TaskCreateRequest
+					err := json.NewDecoder(req.Body).Decode(&taskRequest)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					timeouts = append(timeouts, taskRequest.Action.(*models.TimeoutAction).Timeout)
+					w.WriteHeader(http.StatusCreated)
+				})
+
+				writeConfig(`{"lifecycles": {"buildpack/lucid64": "lifecycle.zip"}, "timeouts": {"staging": "20m"}}`)
+				runner.Session().Signal(syscall.SIGHUP)
+				Eventually(runner.Session()).Should(gbytes.Say("backends-reloaded"))
+				Ω(stageBuildpack()).Should(Equal(http.StatusAccepted))
+
+				writeConfig(`{"lifecycles": {"buildpack/lucid64": "lifecycle.zip"}}`)
+				runner.Session().Signal(syscall.SIGHUP)
+				Eventually(runner.Session()).Should(gbytes.Say("backends-reloaded"))
+				Ω(stageBuildpack()).Should(Equal(http.StatusAccepted))
+
+				Ω(timeouts).Should(Equal([]time.Duration{20 * time.Minute, backend.DefaultStagingTimeout}))
+			})
+
+			It("keeps running with the previous config when the new file is invalid", func() {
+				writeConfig(`{"lifecycles": {"buildpack/lucid64": ""}}`)
+				runner.Session().Signal(syscall.SIGHUP)
+				Eventually(runner.Session()).Should(gbytes.Say("lifecycles.buildpack/lucid64"))
+
+				Ω(stageBuildpack()).Should(Equal(http.StatusInternalServerError))
+				Consistently(runner.Session()).ShouldNot(gexec.Exit())
+			})
+		})
+
+		Context("and the file is invalid", func() {
+			BeforeEach(func() {
+				writeConfig(`{"diego": {"api_url": "receptor"}}`)
+			})
+
+			It("exits naming the bad setting", func() {
+				session, err := gexec.Start(exec.Command(stagerPath, "--config", configPath), GinkgoWriter, GinkgoWriter)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Eventually(session).Should(gexec.Exit())
+				Ω(session.ExitCode()).ShouldNot(BeZero())
+				Ω(session).Should(gbytes.Say("diego.api_url"))
+			})
+		})
+	})
+
+	Context("when started with a limit on stagings in flight", func() {
+		var args []string
+
+		stage := func(stagingGuid string) *http.Response {
+			req, err := requestGenerator.CreateRequest(stager.StageRoute, rata.Params{"staging_guid": stagingGuid}, strings.NewReader(`{
+				"app_id":"my-app-guid",
+				"stack":"lucid64",
+				"file_descriptors":3,
+				"memory_mb" : 1024,
+				"disk_mb" : 128,
+				"environment" : [],
+				"lifecycle": "docker",
+				"lifecycle_data": {
+				  "docker_image":"http://docker.docker/docker"
+				}
+			}`))
+			Ω(err).ShouldNot(HaveOccurred())
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := httpClient.Do(req)
+			Ω(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			return resp
+		}
+
+		BeforeEach(func() {
+			fakeReceptor.RouteToHandler("GET", "/v1/domains/"+backend.StagingTaskDomain+"/tasks", ghttp.RespondWithJSONEncoded(http.StatusOK, []receptor.TaskResponse{
+				{
+					TaskGuid:   "running-guid",
+					Domain:     backend.StagingTaskDomain,
+					State:      receptor.TaskStateRunning,
+					Annotation: `{"lifecycle": "docker"}`,
+				},
+			}))
+			fakeReceptor.RouteToHandler("POST", "/v1/tasks", ghttp.RespondWith(http.StatusCreated, `{}`))
+
+			args = []string{
+				"--lifecycles", `{"docker": "docker/lifecycle.tgz"}`,
+				"--maxInFlightStagingsPerLifecycle", `{"docker": 2}`,
+				"--stagingRetryAfter", "1m",
+			}
+		})
+
+		JustBeforeEach(func() {
+			runner.Start(args...)
+		})
+
+		It("rejects stagings over the limit, counting the tasks already running", func() {
+			Ω(stage("first-guid").StatusCode).Should(Equal(http.StatusAccepted))
+
+			resp := stage("second-guid")
+			Ω(resp.StatusCode).Should(Equal(http.StatusTooManyRequests))
+			Ω(resp.Header.Get("Retry-After")).Should(Equal("60"))
+		})
+
+		Context("and a staging queue", func() {
+			createdTasks := func() int {
+				created := 0
+				for _, req := range fakeReceptor.ReceivedRequests() {
+					if req.Method == "POST" && req.URL.Path == "/v1/tasks" {
+						created++
+					}
+				}
+				return created
+			}
+
+			BeforeEach(func() {
+				args = append(args, "--stagingQueueSize", "1")
+
+				fakeReceptor.RouteToHandler("GET", regexp.MustCompile(`^/v1/tasks/[^/]+$`), ghttp.RespondWithJSONEncoded(http.StatusNotFound, receptor.Error{
+					Type:    receptor.TaskNotFound,
+					Message: "task not found",
+				}))
+			})
+
+			It("queues stagings over the limit until the queue is full", func() {
+				Ω(stage("first-guid").StatusCode).Should(Equal(http.StatusAccepted))
+				Eventually(createdTasks).Should(Equal(1))
+
+				Ω(stage("second-guid").StatusCode).Should(Equal(http.StatusAccepted))
+				Consistently(createdTasks).Should(Equal(1))
+
+				resp := stage("third-guid")
+				Ω(resp.StatusCode).Should(Equal(http.StatusTooManyRequests))
+				Ω(resp.Header.Get("Retry-After")).Should(Equal("60"))
+			})
+
+			It("dispatches the stagings queued before a restart", func() {
+				Ω(stage("first-guid").StatusCode).Should(Equal(http.StatusAccepted))
+				Eventually(createdTasks).Should(Equal(1))
+
+				Ω(stage("second-guid").StatusCode).Should(Equal(http.StatusAccepted))
+				Consistently(createdTasks).Should(Equal(1))
+
+				runner.KillWithFire()
+				runner.Start(args...)
+
+				Eventually(createdTasks).Should(Equal(2))
+			})
+		})
+	})
+
+	Context("when started with an invalid lifecycle key", func() {
+		It("exits naming the bad lifecycle", func() {
+			session, err := gexec.Start(exec.Command(stagerPath, "--lifecycles", `{"buildpack": "lifecycle.zip"}`), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(session).Should(gexec.Exit())
+			Ω(session.ExitCode()).ShouldNot(BeZero())
+			Ω(session).Should(gbytes.Say("Invalid lifecycles"))
+		})
+	})
+
+	Describe("validate-config", func() {
+		var fileServer *ghttp.Server
+
+		validateConfig := func(args ...string) *gexec.Session {
+			args = append([]string{"validate-config", "--fileServerURL", fileServer.URL()}, args...)
+			session, err := gexec.Start(exec.Command(stagerPath, args...), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(session).Should(gexec.Exit())
+			return session
+		}
+
+		BeforeEach(func() {
+			fileServer = ghttp.NewServer()
+		})
+
+		AfterEach(func() {
+			fileServer.Close()
+		})
+
+		It("accepts valid lifecycles", func() {
+			session := validateConfig("--lifecycles", `{"buildpack/lucid64": "lifecycle.zip", "docker": "docker/lifecycle.tgz"}`)
+			Ω(session.ExitCode()).Should(BeZero())
+			Ω(session.Out).Should(gbytes.Say("config is valid"))
+		})
+
+		It("rejects a lifecycle key without a stack", func() {
+			session := validateConfig("--lifecycles", `{"buildpack": "lifecycle.zip"}`)
+			Ω(session.ExitCode()).Should(Equal(1))
+			Ω(session.Err).Should(gbytes.Say("buildpack"))
+		})
+
+		Context("when checking lifecycle downloads", func() {
+			BeforeEach(func() {
+				fileServer.RouteToHandler("HEAD", "/v1/static/lifecycle.zip", ghttp.RespondWith(http.StatusOK, nil))
+				fileServer.RouteToHandler("HEAD", "/v1/static/docker/lifecycle.tgz", ghttp.RespondWith(http.StatusNotFound, nil))
+			})
+
+			It("rejects lifecycles the file server does not have", func() {
+				session := validateConfig("--checkLifecycleDownloads", "--lifecycles", `{"buildpack/lucid64": "lifecycle.zip", "docker": "docker/lifecycle.tgz"}`)
+				Ω(session.ExitCode()).Should(Equal(1))
+				Ω(session.Err).Should(gbytes.Say("docker"))
+			})
+		})
+	})
+
+	Describe("recipe", func() {
+		var (
+			requestDir  string
+			requestPath string
+		)
+
+		recipe := func(args ...string) *gexec.Session {
+			args = append(append([]string{"recipe", "--stagingGuid", "my-staging-guid", "--fileServerURL", fileServerURL}, args...), requestPath)
+			session, err := gexec.Start(exec.Command(stagerPath, args...), GinkgoWriter, GinkgoWriter)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Eventually(session).Should(gexec.Exit())
+			return session
+		}
+
+		BeforeEach(func() {
+			var err error
+			requestDir, err = ioutil.TempDir("", "stager-recipe")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			requestPath = filepath.Join(requestDir, "request.json")
+			Ω(ioutil.WriteFile(requestPath, []byte(`{
+				"app_id": "my-app-guid",
+				"stack": "lucid64",
+				"memory_mb": 1024,
+				"disk_mb": 128,
+				"environment": [{"name": "DATABASE_PASSWORD", "value": "hunter2"}],
+				"lifecycle": "docker",
+				"lifecycle_data": {"docker_image": "http://docker.docker/docker"}
+			}`), 0600)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(requestDir)
+		})
+
+		It("prints the redacted task as JSON", func() {
+			session := recipe("--lifecycles", `{"docker": "docker/lifecycle.tgz"}`)
+			Ω(session.ExitCode()).Should(BeZero())
+
+			var task receptor.TaskCreateRequest
+			err := json.Unmarshal(session.Out.Contents(), &task)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(task.TaskGuid).Should(Equal("my-staging-guid"))
+			Ω(task.MemoryMB).Should(Equal(1024))
+			Ω(string(session.Out.Contents())).ShouldNot(ContainSubstring("hunter2"))
+		})
+
+		It("prints the action tree", func() {
+			session := recipe("--lifecycles", `{"docker": "docker/lifecycle.tgz"}`, "--format", "tree")
+			Ω(session.ExitCode()).Should(BeZero())
+			Ω(session.Out).Should(gbytes.Say("Task my-staging-guid on lucid64"))
+			Ω(session.Out).Should(gbytes.Say(`\n  Serial\n`))
+			Ω(session.Out).Should(gbytes.Say("Download .*docker/lifecycle.tgz"))
+		})
+
+		It("fails when the lifecycle has no compiler", func() {
+			session := recipe("--lifecycles", `{"buildpack/lucid64": "lifecycle.zip"}`)
+			Ω(session.ExitCode()).Should(Equal(1))
+			Ω(session.Err).Should(gbytes.Say("building recipe"))
+		})
+	})
+
+	Context("when started with a metrics address", func() {
+		var metricsURL string
+
+		BeforeEach(func() {
+			metricsAddress := fmt.Sprintf("127.0.0.1:%d", 9888+GinkgoParallelNode())
+			metricsURL = "http://" + metricsAddress + "/metrics"
+
+			runner.Start("--lifecycles", `{"docker": "docker/lifecycle.tgz"}`, "--metricsAddress", metricsAddress)
+		})
+
+		It("serves Prometheus metrics", func() {
+			resp, err := httpClient.Get(metricsURL)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+
+			Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+		})
+	})
 })
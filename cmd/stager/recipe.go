@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/pivotal-golang/lager"
+)
+
+const recipeUsage = "usage: stager recipe [-format json|tree] [-stagingGuid guid] [stager flags] staging-request.json"
+
+// renderRecipe backs the recipe subcommand: it builds the task the stager
+// would desire for the staging request in the file named by args, with the
+// lifecycles of the flags and config file, and writes it redacted to out.
+// It talks to neither Diego nor the CC.
+func renderRecipe(args []string, out io.Writer) error {
+	format := flag.String("format", "json", "Output format of the recipe: json, or tree for an indented action tree")
+	stagingGuid := flag.String("stagingGuid", "staging-guid", "Staging guid to build the recipe for")
+
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flag.NArg() != 1 {
+		return errors.New(recipeUsage)
+	}
+	if *format != "json" && *format != "tree" {
+		return fmt.Errorf("unknown format %q: must be json or tree", *format)
+	}
+
+	fileConfig, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+
+	requestJSON, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var stagingRequest cc_messages.StagingRequestFromCC
+	err = json.Unmarshal(requestJSON, &stagingRequest)
+	if err != nil {
+		return fmt.Errorf("parsing staging request: %s", err)
+	}
+
+	redactor := backend.NewRedactor(strings.Split(*logSafeEnvironmentVariables, ","))
+	backendConfig, err := initializeBackendConfig(redactor, nil, fileConfig.SanitizerRules)
+	if err != nil {
+		return err
+	}
+
+	err = backend.ValidateLifecycles(backendConfig)
+	if err != nil {
+		return err
+	}
+
+	// The backends log the requests and tasks they build; nobody is listening.
+	backends := newBackends(backendConfig, lager.NewLogger("stager"))
+
+	stagingBackend, ok := backends[stagingRequest.Lifecycle]
+	if !ok {
+		return fmt.Errorf("unknown lifecycle %q", stagingRequest.Lifecycle)
+	}
+
+	task, err := stagingBackend.BuildRecipe(*stagingGuid, stagingRequest)
+	if err != nil {
+		return fmt.Errorf("building recipe: %s", err)
+	}
+
+	if *format == "tree" {
+		fmt.Fprintf(out, "Task %s on %s (%d MB memory, %d MB disk)\n", task.TaskGuid, task.Stack, task.MemoryMB, task.DiskMB)
+		_, err = io.WriteString(out, backend.FormatActionTree(task.Action, redactor))
+		return err
+	}
+
+	taskJSON, err := json.MarshalIndent(redactor.Redact(task), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%s\n", taskJSON)
+	return err
+}
@@ -0,0 +1,125 @@
+package testrunner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// Certificates are PEM files of a throwaway CA, a server certificate for
+// 127.0.0.1 and a client certificate, all issued by the CA.
+type Certificates struct {
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+// GenerateCertificates writes a fresh set of Certificates to dir.
+func GenerateCertificates(dir string) Certificates {
+	caKey, caCert, caDER := generateCertificate(nil, nil, func(template *x509.Certificate) {
+		template.Subject.CommonName = "stager-test-ca"
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	})
+
+	serverKey, _, serverDER := generateCertificate(caCert, caKey, func(template *x509.Certificate) {
+		template.Subject.CommonName = "stager"
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+
+	clientKey, _, clientDER := generateCertificate(caCert, caKey, func(template *x509.Certificate) {
+		template.Subject.CommonName = "cloud-controller"
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	})
+
+	certificates := Certificates{
+		CA:         filepath.Join(dir, "ca.crt"),
+		ServerCert: filepath.Join(dir, "server.crt"),
+		ServerKey:  filepath.Join(dir, "server.key"),
+		ClientCert: filepath.Join(dir, "client.crt"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+	}
+
+	writePEM(certificates.CA, "CERTIFICATE", caDER)
+	writePEM(certificates.ServerCert, "CERTIFICATE", serverDER)
+	writeKey(certificates.ServerKey, serverKey)
+	writePEM(certificates.ClientCert, "CERTIFICATE", clientDER)
+	writeKey(certificates.ClientKey, clientKey)
+
+	return certificates
+}
+
+// ClientTLSConfig trusts the CA and, when withClientCert is true, presents
+// the client certificate.
+func (c Certificates) ClientTLSConfig(withClientCert bool) *tls.Config {
+	caPEM, err := ioutil.ReadFile(c.CA)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	rootCAs := x509.NewCertPool()
+	Ω(rootCAs.AppendCertsFromPEM(caPEM)).Should(BeTrue())
+
+	tlsConfig := &tls.Config{RootCAs: rootCAs}
+
+	if withClientCert {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		Ω(err).ShouldNot(HaveOccurred())
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig
+}
+
+func generateCertificate(issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey, customize func(*x509.Certificate)) (*ecdsa.PrivateKey, *x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Ω(err).ShouldNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	customize(template)
+
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Ω(err).ShouldNot(HaveOccurred())
+
+	return key, cert, der
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalECPrivateKey(key)
+	Ω(err).ShouldNot(HaveOccurred())
+	writePEM(path, "EC PRIVATE KEY", der)
+}
+
+func writePEM(path, blockType string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	Ω(err).ShouldNot(HaveOccurred())
+}
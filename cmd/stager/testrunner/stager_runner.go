@@ -17,10 +17,19 @@ type StagerRunner struct {
 }
 
 type Config struct {
-	StagerBin   string
-	StagerURL   string
-	DiegoAPIURL string
-	CCBaseURL   string
+	StagerBin     string
+	StagerURL     string
+	DiegoAPIURL   string
+	CCBaseURL     string
+	FileServerURL string
+
+	// OutboxDir, ListenAddress, TLSCert, TLSKey and TLSClientCA are passed to
+	// the stager when set.
+	OutboxDir     string
+	ListenAddress string
+	TLSCert       string
+	TLSKey        string
+	TLSClientCA   string
 }
 
 func New(config Config) *StagerRunner {
@@ -34,15 +43,28 @@ func (r *StagerRunner) Start(args ...string) {
 		panic("starting more than one stager runner!!!")
 	}
 
+	stagerArgs := []string{
+		"-diegoAPIURL", r.Config.DiegoAPIURL,
+		"-stagerURL", r.Config.StagerURL,
+		"-ccBaseURL", r.Config.CCBaseURL,
+		"-fileServerURL", r.Config.FileServerURL,
+	}
+
+	optionalArgs := []struct{ flag, value string }{
+		{"-outboxDir", r.Config.OutboxDir},
+		{"-listenAddress", r.Config.ListenAddress},
+		{"-tlsCert", r.Config.TLSCert},
+		{"-tlsKey", r.Config.TLSKey},
+		{"-tlsClientCA", r.Config.TLSClientCA},
+	}
+	for _, arg := range optionalArgs {
+		if arg.value != "" {
+			stagerArgs = append(stagerArgs, arg.flag, arg.value)
+		}
+	}
+
 	stagerSession, err := gexec.Start(
-		exec.Command(
-			r.Config.StagerBin,
-			append([]string{
-				"-diegoAPIURL", r.Config.DiegoAPIURL,
-				"-stagerURL", r.Config.StagerURL,
-				"-ccBaseURL", r.Config.CCBaseURL,
-			}, args...)...,
-		),
+		exec.Command(r.Config.StagerBin, append(stagerArgs, args...)...),
 		gexec.NewPrefixedWriter("\x1b[32m[o]\x1b[95m[stager]\x1b[0m ", ginkgo.GinkgoWriter),
 		gexec.NewPrefixedWriter("\x1b[91m[e]\x1b[95m[stager]\x1b[0m ", ginkgo.GinkgoWriter),
 	)
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/config"
+)
+
+const lifecycleDownloadCheckTimeout = 10 * time.Second
+
+// validateConfig backs the validate-config subcommand: it checks the flags
+// in args, and the config file they point at, the way the stager would at
+// startup, without starting it.
+func validateConfig(args []string) error {
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	fileConfig, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+
+	_, err = getStagerAddress()
+	if err != nil {
+		return fmt.Errorf("invalid stager URL: %s", err)
+	}
+
+	redactor := backend.NewRedactor(strings.Split(*logSafeEnvironmentVariables, ","))
+	backendConfig, err := initializeBackendConfig(redactor, nil, fileConfig.SanitizerRules)
+	if err != nil {
+		return err
+	}
+
+	return checkLifecycles(backendConfig)
+}
+
+// loadConfigFile applies the config file named by -config, if any, to the
+// flags that were not set explicitly, and returns it.
+func loadConfigFile() (config.Config, error) {
+	if *configFile == "" {
+		return config.Config{}, nil
+	}
+
+	fileConfig, err := config.Load(*configFile)
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	return fileConfig, applyConfigFile(fileConfig, explicitFlags())
+}
+
+// checkLifecycles validates the lifecycles of backendConfig and, with
+// -checkLifecycleDownloads, that each of them can be downloaded.
+func checkLifecycles(backendConfig backend.Config) error {
+	err := backend.ValidateLifecycles(backendConfig)
+	if err != nil {
+		return err
+	}
+
+	if !*checkLifecycleDownloads {
+		return nil
+	}
+
+	client := &http.Client{
+		Timeout: lifecycleDownloadCheckTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: *skipCertVerify},
+		},
+	}
+
+	return backend.CheckLifecycleDownloads(backendConfig, client)
+}
@@ -0,0 +1,308 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/cc_client"
+)
+
+// Config is the stager's configuration file. Every setting except the
+// sanitizer rules has a command line flag, which takes precedence when set.
+//
+// Lifecycles, the staging timeout and the sanitizer rules are reloaded on
+// SIGHUP; everything else is read once at startup.
+type Config struct {
+	CC             CCConfig                `json:"cc"`
+	Diego          DiegoConfig             `json:"diego"`
+	FileServer     FileServerConfig        `json:"file_server"`
+	Stager         StagerConfig            `json:"stager"`
+	Lifecycles     map[string]string       `json:"lifecycles"`
+	Timeouts       TimeoutsConfig          `json:"timeouts"`
+	Admission      AdmissionConfig         `json:"admission"`
+	SanitizerRules []backend.SanitizerRule `json:"sanitizer_rules"`
+}
+
+type CCConfig struct {
+	BaseURL           string `json:"base_url"`
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+	SkipCertVerify    bool   `json:"skip_cert_verify"`
+	ClientCert        string `json:"client_cert"`
+	ClientKey         string `json:"client_key"`
+	CACert            string `json:"ca_cert"`
+	MinTLSVersion     string `json:"min_tls_version"`
+	OAuthTokenURL     string `json:"oauth_token_url"`
+	OAuthClientID     string `json:"oauth_client_id"`
+	OAuthClientSecret string `json:"oauth_client_secret"`
+	OAuthCACert       string `json:"oauth_ca_cert"`
+}
+
+type DiegoConfig struct {
+	APIURL string `json:"api_url"`
+}
+
+type FileServerConfig struct {
+	URL string `json:"url"`
+}
+
+type StagerConfig struct {
+	URL           string `json:"url"`
+	ListenAddress string `json:"listen_address"`
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	TLSClientCA   string `json:"tls_client_ca"`
+}
+
+type TimeoutsConfig struct {
+	Staging               Duration `json:"staging"`
+	CCDeliveryBaseBackoff Duration `json:"cc_delivery_base_backoff"`
+	CCDeliveryMaxBackoff  Duration `json:"cc_delivery_max_backoff"`
+	FailedTaskRetention   Duration `json:"failed_task_retention"`
+	ReconcileInterval     Duration `json:"reconcile_interval"`
+	OutboxDrainInterval   Duration `json:"outbox_drain_interval"`
+	CallbackURLTTL        Duration `json:"callback_url_ttl"`
+}
+
+// AdmissionConfig caps the stagings in flight, and what each organization and
+// space may use of them. Zero means no limit. With a queue size, stagings that
+// do not fit wait in a queue of that size rather than being rejected.
+type AdmissionConfig struct {
+	MaxInFlight             int              `json:"max_in_flight"`
+	MaxInFlightPerLifecycle map[string]int   `json:"max_in_flight_per_lifecycle"`
+	OrganizationQuota       *admission.Quota `json:"organization_quota"`
+	SpaceQuota              *admission.Quota `json:"space_quota"`
+	RetryAfter              Duration         `json:"retry_after"`
+	QueueSize               int              `json:"queue_size"`
+	QueueAging              Duration         `json:"queue_aging"`
+}
+
+// Duration is written as a Go duration string, e.g. "15m". Values that do
+// not parse are reported by Validate, with the name of their field.
+type Duration struct {
+	time.Duration
+	invalid string
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		d.invalid = string(data)
+		return nil
+	}
+
+	d.Duration, err = time.ParseDuration(s)
+	if err != nil {
+		d.invalid = s
+	}
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// FieldError names the setting that is wrong, by its path in the file.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors lists every invalid setting of a file.
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return "invalid config: " + strings.Join(messages, "; ")
+}
+
+var unknownFieldRegexp = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// Load reads and validates the config file at path.
+func Load(path string) (Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Parse(contents)
+}
+
+// Parse decodes and validates a config file. Unknown settings are errors, so
+// that a typo does not silently leave a setting at its default.
+func Parse(contents []byte) (Config, error) {
+	var config Config
+
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(&config)
+	if err != nil {
+		return Config{}, decodeError(err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+func decodeError(err error) error {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+		return ValidationErrors{{Field: typeErr.Field, Message: fmt.Sprintf("must be a %s", typeErr.Type)}}
+	}
+
+	if match := unknownFieldRegexp.FindStringSubmatch(err.Error()); match != nil {
+		return ValidationErrors{{Field: match[1], Message: "unknown setting"}}
+	}
+
+	return fmt.Errorf("invalid config: %s", err)
+}
+
+// Validate checks every setting, returning ValidationErrors if any is wrong.
+func (c Config) Validate() error {
+	var errs ValidationErrors
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	checkURL := func(field, value string) {
+		if value == "" {
+			return
+		}
+
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail(field, "must be an absolute http or https URL")
+		}
+	}
+
+	checkPair := func(field, value, otherField, otherValue string) {
+		if (value == "") != (otherValue == "") {
+			fail(field, "must be set together with %s", otherField)
+		}
+	}
+
+	checkURL("cc.base_url", c.CC.BaseURL)
+	checkURL("cc.oauth_token_url", c.CC.OAuthTokenURL)
+	checkURL("diego.api_url", c.Diego.APIURL)
+	checkURL("file_server.url", c.FileServer.URL)
+	checkURL("stager.url", c.Stager.URL)
+
+	checkPair("cc.client_cert", c.CC.ClientCert, "cc.client_key", c.CC.ClientKey)
+	checkPair("stager.tls_cert", c.Stager.TLSCert, "stager.tls_key", c.Stager.TLSKey)
+
+	if c.CC.MinTLSVersion != "" {
+		_, err := cc_client.ParseTLSVersion(c.CC.MinTLSVersion)
+		if err != nil {
+			fail("cc.min_tls_version", "must be one of 1.0, 1.1, 1.2 or 1.3")
+		}
+	}
+
+	if c.CC.OAuthTokenURL != "" && c.CC.OAuthClientID == "" {
+		fail("cc.oauth_client_id", "is required with cc.oauth_token_url")
+	}
+
+	if c.Stager.TLSCert != "" && c.Stager.URL != "" && !strings.HasPrefix(c.Stager.URL, "https://") {
+		fail("stager.url", "must be https when stager.tls_cert is set")
+	}
+
+	err := backend.ValidateLifecycles(backend.Config{FileServerURL: c.FileServer.URL, Lifecycles: c.Lifecycles})
+	if lifecycleErrs, ok := err.(backend.LifecycleErrors); ok {
+		for _, lifecycleErr := range lifecycleErrs {
+			// The file server URL may be given by -fileServerURL instead;
+			// the stager checks the lifecycles again once the flags are in.
+			if lifecycleErr.Err == backend.ErrNoFileServerURL {
+				continue
+			}
+			fail("lifecycles."+lifecycleErr.Key, "%s", lifecycleErr.Err)
+		}
+	}
+
+	durations := []struct {
+		field    string
+		duration Duration
+	}{
+		{"timeouts.staging", c.Timeouts.Staging},
+		{"timeouts.cc_delivery_base_backoff", c.Timeouts.CCDeliveryBaseBackoff},
+		{"timeouts.cc_delivery_max_backoff", c.Timeouts.CCDeliveryMaxBackoff},
+		{"timeouts.failed_task_retention", c.Timeouts.FailedTaskRetention},
+		{"timeouts.reconcile_interval", c.Timeouts.ReconcileInterval},
+		{"timeouts.outbox_drain_interval", c.Timeouts.OutboxDrainInterval},
+		{"timeouts.callback_url_ttl", c.Timeouts.CallbackURLTTL},
+		{"admission.retry_after", c.Admission.RetryAfter},
+		{"admission.queue_aging", c.Admission.QueueAging},
+	}
+	for _, d := range durations {
+		if d.duration.invalid != "" {
+			fail(d.field, "%q is not a duration, e.g. 15m", d.duration.invalid)
+		} else if d.duration.Duration < 0 {
+			fail(d.field, "must not be negative")
+		}
+	}
+
+	if c.Admission.MaxInFlight < 0 {
+		fail("admission.max_in_flight", "must not be negative")
+	}
+	if c.Admission.QueueSize < 0 {
+		fail("admission.queue_size", "must not be negative")
+	}
+	for lifecycle, limit := range c.Admission.MaxInFlightPerLifecycle {
+		if limit < 0 {
+			fail("admission.max_in_flight_per_lifecycle."+lifecycle, "must not be negative")
+		}
+	}
+
+	checkQuota := func(field string, quota *admission.Quota) {
+		if quota == nil {
+			return
+		}
+		if quota.MaxInFlight < 0 {
+			fail(field+".max_in_flight", "must not be negative")
+		}
+		if quota.MaxMemoryMB < 0 {
+			fail(field+".max_memory_mb", "must not be negative")
+		}
+		if quota.MaxDiskMB < 0 {
+			fail(field+".max_disk_mb", "must not be negative")
+		}
+	}
+	checkQuota("admission.organization_quota", c.Admission.OrganizationQuota)
+	checkQuota("admission.space_quota", c.Admission.SpaceQuota)
+
+	for i, rule := range c.SanitizerRules {
+		field := fmt.Sprintf("sanitizer_rules[%d]", i)
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			fail(field+".pattern", "is not a valid regular expression: %s", err)
+		}
+		if rule.Message == "" {
+			fail(field+".message", "must not be empty")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	Describe("Parse", func() {
+		It("reads every section of the file", func() {
+			cfg, err := config.Parse([]byte(`{
+				"cc": {
+					"base_url": "https://cc.example.com",
+					"username": "internal",
+					"password": "secret",
+					"min_tls_version": "1.2"
+				},
+				"diego": {"api_url": "http://receptor.example.com"},
+				"file_server": {"url": "http://file-server.example.com"},
+				"stager": {
+					"url": "https://stager.example.com:8888",
+					"tls_cert": "/certs/stager.crt",
+					"tls_key": "/certs/stager.key"
+				},
+				"lifecycles": {"buildpack/cflinuxfs2": "buildpack_app_lifecycle.tgz"},
+				"timeouts": {"staging": "20m", "failed_task_retention": "1h"},
+				"admission": {
+					"max_in_flight": 100,
+					"max_in_flight_per_lifecycle": {"docker": 10},
+					"organization_quota": {"max_in_flight": 5, "max_memory_mb": 8192},
+					"retry_after": "1m",
+					"queue_size": 50,
+					"queue_aging": "30s"
+				},
+				"sanitizer_rules": [{"pattern": "exit status 222", "message": "no buildpack detected the app"}]
+			}`))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(cfg.CC.BaseURL).Should(Equal("https://cc.example.com"))
+			Ω(cfg.CC.MinTLSVersion).Should(Equal("1.2"))
+			Ω(cfg.Diego.APIURL).Should(Equal("http://receptor.example.com"))
+			Ω(cfg.FileServer.URL).Should(Equal("http://file-server.example.com"))
+			Ω(cfg.Stager.TLSKey).Should(Equal("/certs/stager.key"))
+			Ω(cfg.Lifecycles).Should(Equal(map[string]string{"buildpack/cflinuxfs2": "buildpack_app_lifecycle.tgz"}))
+			Ω(cfg.Timeouts.Staging.Duration).Should(Equal(20 * time.Minute))
+			Ω(cfg.Timeouts.FailedTaskRetention.Duration).Should(Equal(time.Hour))
+			Ω(cfg.Timeouts.ReconcileInterval.Duration).Should(BeZero())
+			Ω(cfg.Admission.MaxInFlight).Should(Equal(100))
+			Ω(cfg.Admission.MaxInFlightPerLifecycle).Should(Equal(map[string]int{"docker": 10}))
+			Ω(cfg.Admission.OrganizationQuota).Should(Equal(&admission.Quota{MaxInFlight: 5, MaxMemoryMB: 8192}))
+			Ω(cfg.Admission.SpaceQuota).Should(BeNil())
+			Ω(cfg.Admission.RetryAfter.Duration).Should(Equal(time.Minute))
+			Ω(cfg.Admission.QueueSize).Should(Equal(50))
+			Ω(cfg.Admission.QueueAging.Duration).Should(Equal(30 * time.Second))
+			Ω(cfg.SanitizerRules).Should(Equal([]backend.SanitizerRule{{Pattern: "exit status 222", Message: "no buildpack detected the app"}}))
+		})
+
+		It("accepts an empty file", func() {
+			_, err := config.Parse([]byte(`{}`))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("accepts compilers on the file server without a file server URL, as it may be given as a flag", func() {
+			_, err := config.Parse([]byte(`{"lifecycles": {"docker": "docker_app_lifecycle.tgz"}}`))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("names unknown settings", func() {
+			_, err := config.Parse([]byte(`{"cc": {"base_uri": "https://cc.example.com"}}`))
+			Ω(err).Should(Equal(config.ValidationErrors{{Field: "base_uri", Message: "unknown setting"}}))
+		})
+
+		It("names settings of the wrong type", func() {
+			_, err := config.Parse([]byte(`{"cc": {"skip_cert_verify": "yes"}}`))
+			Ω(err).Should(BeAssignableToTypeOf(config.ValidationErrors{}))
+			Ω(err.Error()).Should(ContainSubstring("skip_cert_verify"))
+		})
+
+		It("reports every invalid setting by its path", func() {
+			_, err := config.Parse([]byte(`{
+				"cc": {"base_url": "cc.example.com", "client_cert": "/certs/cc.crt", "min_tls_version": "1.4"},
+				"stager": {"url": "http://stager.example.com", "tls_cert": "/certs/stager.crt", "tls_key": "/certs/stager.key"},
+				"lifecycles": {"docker": "", "windows/2012R2": "windows_app_lifecycle.tgz"},
+				"timeouts": {"staging": "fortnight", "reconcile_interval": "-1m"},
+				"admission": {"max_in_flight": -1, "max_in_flight_per_lifecycle": {"docker": -1}, "space_quota": {"max_disk_mb": -1}, "queue_size": -1},
+				"sanitizer_rules": [{"pattern": "(", "message": ""}]
+			}`))
+
+			fields := []string{}
+			for _, fieldErr := range err.(config.ValidationErrors) {
+				fields = append(fields, fieldErr.Field)
+			}
+
+			Ω(fields).Should(ConsistOf(
+				"cc.base_url",
+				"cc.client_cert",
+				"cc.min_tls_version",
+				"stager.url",
+				"lifecycles.docker",
+				"lifecycles.windows/2012R2",
+				"timeouts.staging",
+				"timeouts.reconcile_interval",
+				"admission.max_in_flight",
+				"admission.max_in_flight_per_lifecycle.docker",
+				"admission.space_quota.max_disk_mb",
+				"admission.queue_size",
+				"sanitizer_rules[0].pattern",
+				"sanitizer_rules[0].message",
+			))
+			Ω(err.Error()).Should(ContainSubstring(`timeouts.staging: "fortnight" is not a duration`))
+		})
+	})
+
+	Describe("Load", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "stager-config")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("parses the file", func() {
+			path := filepath.Join(dir, "stager.json")
+			Ω(ioutil.WriteFile(path, []byte(`{"diego": {"api_url": "http://receptor.example.com"}}`), 0600)).Should(Succeed())
+
+			cfg, err := config.Load(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(cfg.Diego.APIURL).Should(Equal("http://receptor.example.com"))
+		})
+
+		It("fails when the file is missing", func() {
+			_, err := config.Load(filepath.Join(dir, "missing.json"))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"os"
+
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+// NewReloader re-reads the config file at path on every signal received on
+// hangups, and hands it to apply. A file that does not load or validate is
+// logged and ignored, leaving the running configuration in place.
+func NewReloader(logger lager.Logger, path string, hangups <-chan os.Signal, apply func(Config) error) ifrit.Runner {
+	return &reloader{
+		logger:  logger.Session("config-reloader", lager.Data{"path": path}),
+		path:    path,
+		hangups: hangups,
+		apply:   apply,
+	}
+}
+
+type reloader struct {
+	logger  lager.Logger
+	path    string
+	hangups <-chan os.Signal
+	apply   func(Config) error
+}
+
+func (r *reloader) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	close(ready)
+
+	for {
+		select {
+		case <-r.hangups:
+			r.reload()
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+func (r *reloader) reload() {
+	r.logger.Info("reloading")
+
+	config, err := Load(r.path)
+	if err != nil {
+		r.logger.Error("failed-to-load", err)
+		return
+	}
+
+	err = r.apply(config)
+	if err != nil {
+		r.logger.Error("failed-to-apply", err)
+		return
+	}
+
+	r.logger.Info("reloaded")
+}
@@ -0,0 +1,86 @@
+package config_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/cloudfoundry-incubator/stager/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("Reloader", func() {
+	var (
+		dir      string
+		path     string
+		hangups  chan os.Signal
+		applied  chan config.Config
+		applyErr error
+		logger   *lagertest.TestLogger
+		process  ifrit.Process
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "stager-config")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		path = filepath.Join(dir, "stager.json")
+		hangups = make(chan os.Signal)
+		applied = make(chan config.Config, 1)
+		applyErr = nil
+		logger = lagertest.NewTestLogger("test")
+
+		Ω(ioutil.WriteFile(path, []byte(`{"lifecycles": {"docker": "docker_app_lifecycle.tgz"}}`), 0600)).Should(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		process = ifrit.Invoke(config.NewReloader(logger, path, hangups, func(cfg config.Config) error {
+			applied <- cfg
+			return applyErr
+		}))
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+		os.RemoveAll(dir)
+	})
+
+	It("applies the file on every hangup", func() {
+		hangups <- syscall.SIGHUP
+		Eventually(applied).Should(Receive(Equal(config.Config{
+			Lifecycles: map[string]string{"docker": "docker_app_lifecycle.tgz"},
+		})))
+	})
+
+	Context("when the file is invalid", func() {
+		BeforeEach(func() {
+			Ω(ioutil.WriteFile(path, []byte(`{"timeouts": {"staging": "soon"}}`), 0600)).Should(Succeed())
+		})
+
+		It("keeps the running configuration", func() {
+			hangups <- syscall.SIGHUP
+			Eventually(logger).Should(gbytes.Say("failed-to-load"))
+			Consistently(applied).ShouldNot(Receive())
+		})
+	})
+
+	Context("when applying the file fails", func() {
+		BeforeEach(func() {
+			applyErr = errors.New("boom")
+		})
+
+		It("logs the failure", func() {
+			hangups <- syscall.SIGHUP
+			Eventually(applied).Should(Receive())
+			Eventually(logger).Should(gbytes.Say("failed-to-apply"))
+		})
+	})
+})
@@ -5,22 +5,61 @@ import (
 
 	"github.com/cloudfoundry-incubator/receptor"
 	"github.com/cloudfoundry-incubator/stager"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/auth"
 	"github.com/cloudfoundry-incubator/stager/backend"
 	"github.com/cloudfoundry-incubator/stager/cc_client"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/queue"
+	"github.com/cloudfoundry-incubator/stager/tracing"
 	"github.com/pivotal-golang/clock"
 	"github.com/pivotal-golang/lager"
 	"github.com/tedsuo/rata"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func New(logger lager.Logger, ccClient cc_client.CcClient, diegoClient receptor.Client, backends map[string]backend.Backend, clock clock.Clock) http.Handler {
+func New(
+	logger lager.Logger,
+	ccClient cc_client.CcClient,
+	diegoClient receptor.Client,
+	backends map[string]backend.Backend,
+	outbox outbox.Outbox,
+	redactor backend.Redactor,
+	emitter metrics.Emitter,
+	tracerProvider trace.TracerProvider,
+	apiAuthenticator auth.Authenticator,
+	callbackAuthenticator auth.Authenticator,
+	callbackSigner *backend.CallbackSigner,
+	inFlight *metrics.InFlightGauge,
+	admission *admission.Controller,
+	stagingQueue *queue.Queue,
+	clock clock.Clock,
+) http.Handler {
 
-	stagingHandler := NewStagingHandler(logger, backends, ccClient, diegoClient)
-	stagingCompletedHandler := NewStagingCompletionHandler(logger, ccClient, backends, clock)
+	tracer := tracerProvider.Tracer(tracing.TracerName)
+
+	stagingHandler := NewStagingHandler(logger, backends, ccClient, outbox, diegoClient, redactor, emitter, inFlight, admission, stagingQueue, tracer, clock)
+	stagingCompletedHandler := NewStagingCompletionHandler(logger, ccClient, backends, outbox, redactor, callbackSigner, emitter, inFlight, admission, tracer, clock)
+	stagingStatusHandler := NewStagingStatusHandler(logger, backends, diegoClient, stagingQueue, clock)
 
 	actions := rata.Handlers{
 		stager.StageRoute:            http.HandlerFunc(stagingHandler.Stage),
 		stager.StopStagingRoute:      http.HandlerFunc(stagingHandler.StopStaging),
+		stager.RenderRecipeRoute:     http.HandlerFunc(stagingHandler.RenderRecipe),
 		stager.StagingCompletedRoute: http.HandlerFunc(stagingCompletedHandler.StagingComplete),
+		stager.StagingStatusRoute:    http.HandlerFunc(stagingStatusHandler.StagingStatus),
+		stager.ListStagingsRoute:     http.HandlerFunc(stagingStatusHandler.ListStagings),
+	}
+
+	// Diego calls back with the credential embedded in the callback URL;
+	// everything else is the CC's API.
+	for route, handler := range actions {
+		authenticator := apiAuthenticator
+		if route == stager.StagingCompletedRoute {
+			authenticator = callbackAuthenticator
+		}
+		actions[route] = auth.Wrap(logger, authenticator, handler)
 	}
 
 	handler, err := rata.NewRouter(stager.Routes, actions)
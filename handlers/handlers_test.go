@@ -0,0 +1,100 @@
+package handlers_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor/fake_receptor"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/auth/fakes"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	fake_cc_client "github.com/cloudfoundry-incubator/stager/cc_client/fakes"
+	"github.com/cloudfoundry-incubator/stager/handlers"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	fake_metrics "github.com/cloudfoundry-incubator/stager/metrics/fakes"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handlers", func() {
+	var (
+		apiAuthenticator      *fakes.FakeAuthenticator
+		callbackAuthenticator *fakes.FakeAuthenticator
+		handler               http.Handler
+	)
+
+	BeforeEach(func() {
+		apiAuthenticator = &fakes.FakeAuthenticator{}
+		callbackAuthenticator = &fakes.FakeAuthenticator{}
+		admissionController := admission.NewController(admission.Limits{}, admission.DefaultRetryAfter)
+
+		handler = handlers.New(
+			lagertest.NewTestLogger("test"),
+			&fake_cc_client.FakeCcClient{},
+			&fake_receptor.FakeClient{},
+			map[string]backend.Backend{},
+			outbox.NewMemoryOutbox(),
+			backend.NewRedactor(nil),
+			&fake_metrics.FakeEmitter{},
+			noop.NewTracerProvider(),
+			apiAuthenticator,
+			callbackAuthenticator,
+			nil,
+			metrics.NewInFlightGauge(&fake_metrics.FakeEmitter{}, admissionController),
+			admissionController,
+			nil,
+			fakeclock.NewFakeClock(time.Now()),
+		)
+	})
+
+	serve := func(method, path string) int {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString("{}"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	Context("when the API authenticator rejects the request", func() {
+		BeforeEach(func() {
+			apiAuthenticator.AuthenticateReturns(false)
+			callbackAuthenticator.AuthenticateReturns(true)
+		})
+
+		It("rejects staging API requests", func() {
+			Ω(serve("PUT", "/v1/staging/a-staging-guid")).Should(Equal(http.StatusUnauthorized))
+			Ω(serve("DELETE", "/v1/staging/a-staging-guid")).Should(Equal(http.StatusUnauthorized))
+			Ω(serve("GET", "/v1/staging/a-staging-guid")).Should(Equal(http.StatusUnauthorized))
+			Ω(serve("GET", "/v1/staging")).Should(Equal(http.StatusUnauthorized))
+		})
+
+		It("authenticates completion callbacks with the callback authenticator", func() {
+			Ω(serve("POST", "/v1/staging/a-staging-guid/completed")).ShouldNot(Equal(http.StatusUnauthorized))
+			Ω(callbackAuthenticator.AuthenticateCallCount()).Should(Equal(1))
+			Ω(apiAuthenticator.AuthenticateCallCount()).Should(Equal(0))
+		})
+	})
+
+	Context("when the callback authenticator rejects the request", func() {
+		BeforeEach(func() {
+			apiAuthenticator.AuthenticateReturns(true)
+			callbackAuthenticator.AuthenticateReturns(false)
+		})
+
+		It("rejects completion callbacks", func() {
+			Ω(serve("POST", "/v1/staging/a-staging-guid/completed")).Should(Equal(http.StatusUnauthorized))
+		})
+
+		It("serves staging API requests", func() {
+			Ω(serve("PUT", "/v1/staging/a-staging-guid")).ShouldNot(Equal(http.StatusUnauthorized))
+		})
+	})
+})
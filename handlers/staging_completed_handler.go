@@ -7,19 +7,16 @@ import (
 
 	"github.com/cloudfoundry-incubator/receptor"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
-	"github.com/cloudfoundry-incubator/runtime-schema/metric"
+	"github.com/cloudfoundry-incubator/stager/admission"
 	"github.com/cloudfoundry-incubator/stager/backend"
 	"github.com/cloudfoundry-incubator/stager/cc_client"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/tracing"
 	"github.com/pivotal-golang/clock"
 	"github.com/pivotal-golang/lager"
-)
-
-const (
-	// Metrics
-	stagingSuccessCounter  = metric.Counter("StagingRequestsSucceeded")
-	stagingSuccessDuration = metric.Duration("StagingRequestSucceededDuration")
-	stagingFailureCounter  = metric.Counter("StagingRequestsFailed")
-	stagingFailureDuration = metric.Duration("StagingRequestFailedDuration")
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type CompletionHandler interface {
@@ -27,18 +24,52 @@ type CompletionHandler interface {
 }
 
 type completionHandler struct {
-	ccClient cc_client.CcClient
-	backends map[string]backend.Backend
-	logger   lager.Logger
-	clock    clock.Clock
+	ccClient       cc_client.CcClient
+	backends       map[string]backend.Backend
+	outbox         outbox.Outbox
+	redactor       backend.Redactor
+	callbackSigner *backend.CallbackSigner
+	emitter        metrics.Emitter
+	inFlight       *metrics.InFlightGauge
+	admission      *admission.Controller
+	tracer         trace.Tracer
+	logger         lager.Logger
+	clock          clock.Clock
 }
 
-func NewStagingCompletionHandler(logger lager.Logger, ccClient cc_client.CcClient, backends map[string]backend.Backend, clock clock.Clock) CompletionHandler {
+// NewStagingCompletionHandler returns a handler for Diego's task completion
+// callbacks. Staging responses are put in outbox before they are delivered,
+// so that the drainer can deliver them if the CC is unavailable, and are
+// marked delivered once the CC has accepted them. The reconciler deletes the
+// task from Diego after that.
+//
+// When callbackSigner is not nil, callbacks whose URL does not carry a valid
+// signature for the staging guid are rejected before the task is looked at.
+func NewStagingCompletionHandler(
+	logger lager.Logger,
+	ccClient cc_client.CcClient,
+	backends map[string]backend.Backend,
+	outbox outbox.Outbox,
+	redactor backend.Redactor,
+	callbackSigner *backend.CallbackSigner,
+	emitter metrics.Emitter,
+	inFlight *metrics.InFlightGauge,
+	admission *admission.Controller,
+	tracer trace.Tracer,
+	clock clock.Clock,
+) CompletionHandler {
 	return &completionHandler{
-		ccClient: ccClient,
-		backends: backends,
-		logger:   logger.Session("completion-handler"),
-		clock:    clock,
+		ccClient:       ccClient,
+		backends:       backends,
+		outbox:         outbox,
+		redactor:       redactor,
+		callbackSigner: callbackSigner,
+		emitter:        emitter,
+		inFlight:       inFlight,
+		admission:      admission,
+		tracer:         tracer,
+		logger:         logger.Session("completion-handler"),
+		clock:          clock,
 	}
 }
 
@@ -48,6 +79,15 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		"guid": taskGuid,
 	})
 
+	if handler.callbackSigner != nil {
+		err := handler.callbackSigner.Verify(taskGuid, req.URL.Query())
+		if err != nil {
+			logger.Error("invalid-callback-signature", err)
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
 	var task receptor.TaskResponse
 	err := json.NewDecoder(req.Body).Decode(&task)
 	if err != nil {
@@ -62,7 +102,10 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		return
 	}
 
-	var annotation cc_messages.StagingTaskAnnotation
+	handler.admission.Release(taskGuid)
+	handler.inFlight.Update()
+
+	var annotation backend.StagingTaskAnnotation
 	err = json.Unmarshal([]byte(task.Annotation), &annotation)
 	if err != nil {
 		res.WriteHeader(http.StatusBadRequest)
@@ -70,6 +113,17 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		return
 	}
 
+	ctx, span := handler.tracer.Start(
+		tracing.Extract(req.Context(), annotation.TraceContext),
+		"staging-complete",
+		trace.WithAttributes(
+			attribute.String("staging_guid", taskGuid),
+			attribute.String("lifecycle", annotation.Lifecycle),
+			attribute.Bool("failed", task.Failed),
+		),
+	)
+	defer span.End()
+
 	backend := handler.backends[annotation.Lifecycle]
 	if backend == nil {
 		res.WriteHeader(http.StatusNotFound)
@@ -97,34 +151,89 @@ func (handler *completionHandler) StagingComplete(res http.ResponseWriter, req *
 		return
 	}
 
+	entry := outbox.Entry{
+		StagingGuid: taskGuid,
+		Payload:     responseJson,
+		CreatedAt:   handler.clock.Now().UnixNano(),
+	}
+
+	err = handler.outbox.Put(entry)
+	if err != nil {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		logger.Error("outbox-put-failed", err)
+		return
+	}
+
 	logger.Info("posting-staging-complete", lager.Data{
-		"payload": responseJson,
+		"payload": handler.redactor.RedactJSON(responseJson),
 	})
 
+	_, ccSpan := handler.tracer.Start(ctx, "cc-staging-complete")
 	err = handler.ccClient.StagingComplete(taskGuid, responseJson, logger)
+	tracing.RecordError(ccSpan, err)
+	ccSpan.End()
+
 	if err != nil {
+		tracing.RecordError(span, err)
 		logger.Error("cc-staging-complete-failed", err)
-		if responseErr, ok := err.(*cc_client.BadResponseError); ok {
+
+		// The entry stays pending whatever the CC answered, but Diego need
+		// not keep calling back with a response the CC has rejected.
+		responseErr, rejected := err.(*cc_client.BadResponseError)
+		if rejected && !cc_client.IsRetryable(err) {
+			logger.Info("deferred-rejected-staging-complete-to-outbox")
 			res.WriteHeader(responseErr.StatusCode)
-		} else {
-			res.WriteHeader(http.StatusServiceUnavailable)
+			return
 		}
+
+		handler.reportMetrics(task, annotation, response)
+
+		logger.Info("deferred-staging-complete-to-outbox")
+		res.WriteHeader(http.StatusAccepted)
 		return
 	}
 
-	handler.reportMetrics(task)
+	handler.markDelivered(logger, entry)
+	handler.reportMetrics(task, annotation, response)
 
 	logger.Info("posted-staging-complete")
 	res.WriteHeader(http.StatusOK)
 }
 
-func (handler *completionHandler) reportMetrics(task receptor.TaskResponse) {
+// markDelivered keeps the entry in the outbox, so that the reconciler knows
+// the task can be deleted, but stops the drainer from delivering it again.
+func (handler *completionHandler) markDelivered(logger lager.Logger, entry outbox.Entry) {
+	entry.DeliveredAt = handler.clock.Now().UnixNano()
+
+	err := handler.outbox.Put(entry)
+	if err != nil {
+		logger.Error("outbox-mark-delivered-failed", err)
+	}
+}
+
+func (handler *completionHandler) reportMetrics(task receptor.TaskResponse, annotation backend.StagingTaskAnnotation, response cc_messages.StagingResponseForCC) {
 	duration := handler.clock.Now().Sub(time.Unix(0, task.CreatedAt))
+	labels := metrics.Labels{
+		Lifecycle: annotation.Lifecycle,
+		Stack:     task.Stack,
+	}
+
 	if task.Failed {
-		stagingFailureCounter.Increment()
-		stagingFailureDuration.Send(duration)
+		labels.FailureCategory = failureCategory(response)
+		handler.emitter.IncrementCounter(metrics.StagingRequestsFailed, labels)
+		handler.emitter.ObserveDuration(metrics.StagingRequestFailedDuration, duration, labels)
 	} else {
-		stagingSuccessDuration.Send(duration)
-		stagingSuccessCounter.Increment()
+		handler.emitter.ObserveDuration(metrics.StagingRequestSucceededDuration, duration, labels)
+		handler.emitter.IncrementCounter(metrics.StagingRequestsSucceeded, labels)
 	}
 }
+
+// failureCategory is the id of the sanitized staging error, e.g.
+// InsufficientResources or NoCompatibleCell.
+func failureCategory(response cc_messages.StagingResponseForCC) string {
+	if response.Error == nil {
+		return ""
+	}
+
+	return response.Error.Id
+}
@@ -2,6 +2,7 @@ package handlers_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,16 +15,24 @@ import (
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/cloudfoundry-incubator/runtime-schema/models"
 	"github.com/cloudfoundry-incubator/stager"
+	"github.com/cloudfoundry-incubator/stager/admission"
 	"github.com/cloudfoundry-incubator/stager/backend"
 	"github.com/cloudfoundry-incubator/stager/backend/fake_backend"
 	"github.com/cloudfoundry-incubator/stager/cc_client"
 	"github.com/cloudfoundry-incubator/stager/cc_client/fakes"
 	"github.com/cloudfoundry-incubator/stager/handlers"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	fake_metrics "github.com/cloudfoundry-incubator/stager/metrics/fakes"
+	outbox_fakes "github.com/cloudfoundry-incubator/stager/outbox/fakes"
+	"github.com/cloudfoundry-incubator/stager/tracing"
 	"github.com/cloudfoundry/dropsonde/metric_sender/fake"
-	"github.com/cloudfoundry/dropsonde/metrics"
+	dropsonde_metrics "github.com/cloudfoundry/dropsonde/metrics"
 	"github.com/pivotal-golang/clock/fakeclock"
 	"github.com/pivotal-golang/lager"
 	"github.com/tedsuo/rata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -36,11 +45,17 @@ var _ = Describe("StagingCompletedHandler", func() {
 		taskId string
 
 		fakeCCClient        *fakes.FakeCcClient
+		fakeOutbox          *outbox_fakes.FakeOutbox
 		fakeBackend         *fake_backend.FakeBackend
 		backendResponse     cc_messages.StagingResponseForCC
 		backendError        error
 		fakeClock           *fakeclock.FakeClock
 		metricSender        *fake.FakeMetricSender
+		emitter             metrics.Emitter
+		admissionController *admission.Controller
+		spanRecorder        *tracetest.SpanRecorder
+		tracerProvider      *sdktrace.TracerProvider
+		callbackSigner      *backend.CallbackSigner
 		stagingDurationNano time.Duration
 
 		responseRecorder *httptest.ResponseRecorder
@@ -56,16 +71,40 @@ var _ = Describe("StagingCompletedHandler", func() {
 
 		stagingDurationNano = 900900
 		metricSender = fake.NewFakeMetricSender()
-		metrics.Initialize(metricSender)
+		dropsonde_metrics.Initialize(metricSender)
+		emitter = metrics.NewDropsondeEmitter()
+		admissionController = admission.NewController(admission.Limits{}, admission.DefaultRetryAfter)
+
+		spanRecorder = tracetest.NewSpanRecorder()
+		tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder))
 
 		fakeCCClient = &fakes.FakeCcClient{}
 		fakeBackend = &fake_backend.FakeBackend{}
 		backendError = nil
 
 		fakeClock = fakeclock.NewFakeClock(time.Now())
+		fakeOutbox = &outbox_fakes.FakeOutbox{}
+		callbackSigner = nil
 
 		responseRecorder = httptest.NewRecorder()
-		handler := handlers.NewStagingCompletionHandler(logger, fakeCCClient, map[string]backend.Backend{"fake": fakeBackend}, fakeClock)
+	})
+
+	JustBeforeEach(func() {
+		fakeBackend.BuildStagingResponseReturns(backendResponse, backendError)
+
+		handler := handlers.NewStagingCompletionHandler(
+			logger,
+			fakeCCClient,
+			map[string]backend.Backend{"fake": fakeBackend},
+			fakeOutbox,
+			backend.NewRedactor(nil),
+			callbackSigner,
+			emitter,
+			metrics.NewInFlightGauge(emitter, admissionController),
+			admissionController,
+			tracerProvider.Tracer("test"),
+			fakeClock,
+		)
 
 		var routes rata.Routes
 		for _, r := range stager.Routes {
@@ -81,10 +120,6 @@ var _ = Describe("StagingCompletedHandler", func() {
 		Ω(err).ShouldNot(HaveOccurred())
 	})
 
-	JustBeforeEach(func() {
-		fakeBackend.BuildStagingResponseReturns(backendResponse, backendError)
-	})
-
 	postTask := func(task receptor.TaskResponse) *http.Request {
 		taskJSON, err := json.Marshal(task)
 		Ω(err).ShouldNot(HaveOccurred())
@@ -135,6 +170,59 @@ var _ = Describe("StagingCompletedHandler", func() {
 			Ω(fakeBackend.BuildStagingResponseArgsForCall(0)).Should(Equal(taskResponse))
 		})
 
+		It("traces the delivery to the CC", func() {
+			ended := spanRecorder.Ended()
+			Ω(ended).Should(HaveLen(2))
+			Ω(ended[0].Name()).Should(Equal("cc-staging-complete"))
+			Ω(ended[1].Name()).Should(Equal("staging-complete"))
+			Ω(ended[0].Parent().SpanID()).Should(Equal(ended[1].SpanContext().SpanID()))
+		})
+
+		Context("when the annotation carries the trace context of the staging request", func() {
+			var stageSpan trace.Span
+
+			BeforeEach(func() {
+				var ctx context.Context
+				ctx, stageSpan = tracerProvider.Tracer("test").Start(context.Background(), "stage")
+				stageSpan.End()
+
+				var err error
+				annotationJson, err = json.Marshal(backend.StagingTaskAnnotation{
+					Lifecycle:    "fake",
+					TraceContext: tracing.Inject(ctx),
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("joins the trace of the staging request", func() {
+				var callbackSpan sdktrace.ReadOnlySpan
+				for _, span := range spanRecorder.Ended() {
+					if span.Name() == "staging-complete" {
+						callbackSpan = span
+					}
+				}
+
+				Ω(callbackSpan).ShouldNot(BeNil())
+				Ω(callbackSpan.SpanContext().TraceID()).Should(Equal(stageSpan.SpanContext().TraceID()))
+				Ω(callbackSpan.Parent().SpanID()).Should(Equal(stageSpan.SpanContext().SpanID()))
+			})
+		})
+
+		Context("when the staging is in flight", func() {
+			BeforeEach(func() {
+				_, err := admissionController.Admit(admission.Staging{Guid: "the-task-guid", Lifecycle: "fake"})
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("is no longer counted as in flight", func() {
+				Ω(metricSender.GetValue("StagingsInFlight.fake").Value).Should(BeEquivalentTo(0))
+			})
+
+			It("makes room for another staging", func() {
+				Ω(admissionController.InFlight("fake")).Should(Equal(0))
+			})
+		})
+
 		Context("when the guid in the url does not match the task guid", func() {
 			BeforeEach(func() {
 				taskJSON, err := json.Marshal(taskResponse)
@@ -226,6 +314,16 @@ var _ = Describe("StagingCompletedHandler", func() {
 				Ω(payload).Should(Equal(backendResponseJson))
 			})
 
+			It("persists the response before posting it to the CC", func() {
+				Ω(fakeOutbox.PutCallCount()).Should(BeNumerically(">=", 1))
+
+				entry := fakeOutbox.PutArgsForCall(0)
+				Ω(entry.StagingGuid).Should(Equal("the-task-guid"))
+				Ω([]byte(entry.Payload)).Should(Equal(backendResponseJson))
+				Ω(entry.CreatedAt).Should(Equal(fakeClock.Now().UnixNano()))
+				Ω(entry.Delivered()).Should(BeFalse())
+			})
+
 			Context("when the CC request succeeds", func() {
 				It("increments the staging success counter", func() {
 					Ω(metricSender.GetCounter("StagingRequestsSucceeded")).Should(BeEquivalentTo(1))
@@ -241,33 +339,112 @@ var _ = Describe("StagingCompletedHandler", func() {
 				It("returns a 200", func() {
 					Ω(responseRecorder.Code).Should(Equal(200))
 				})
+
+				It("marks the entry delivered", func() {
+					Ω(fakeOutbox.PutCallCount()).Should(Equal(2))
+
+					entry := fakeOutbox.PutArgsForCall(1)
+					Ω(entry.StagingGuid).Should(Equal("the-task-guid"))
+					Ω(entry.DeliveredAt).Should(Equal(fakeClock.Now().UnixNano()))
+				})
+
+				It("does not remove the entry before the task is deleted", func() {
+					Ω(fakeOutbox.RemoveCallCount()).Should(Equal(0))
+				})
+			})
+
+			Context("when the CC cannot be reached", func() {
+				BeforeEach(func() {
+					fakeCCClient.StagingCompleteReturns(errors.New("connection refused"))
+				})
+
+				It("leaves the entry pending for the drainer", func() {
+					Ω(fakeOutbox.PutCallCount()).Should(Equal(1))
+				})
+
+				It("accepts the callback", func() {
+					Ω(responseRecorder.Code).Should(Equal(http.StatusAccepted))
+				})
+
+				It("reports the staging metrics", func() {
+					Ω(metricSender.GetCounter("StagingRequestsSucceeded")).Should(BeEquivalentTo(1))
+				})
 			})
 
-			Context("when the CC request fails", func() {
+			Context("when the CC is temporarily unavailable", func() {
 				BeforeEach(func() {
 					fakeCCClient.StagingCompleteReturns(&cc_client.BadResponseError{504})
 				})
 
-				It("responds with the status code that the CC returned", func() {
-					Ω(responseRecorder.Code).Should(Equal(504))
+				It("leaves the entry pending for the drainer", func() {
+					Ω(fakeOutbox.PutCallCount()).Should(Equal(1))
+				})
+
+				It("accepts the callback", func() {
+					Ω(responseRecorder.Code).Should(Equal(http.StatusAccepted))
+				})
+			})
+
+			Context("when the CC fails", func() {
+				BeforeEach(func() {
+					fakeCCClient.StagingCompleteReturns(&cc_client.BadResponseError{500})
+				})
+
+				It("leaves the entry pending for the drainer", func() {
+					Ω(fakeOutbox.PutCallCount()).Should(Equal(1))
+					Ω(fakeOutbox.PutArgsForCall(0).Delivered()).Should(BeFalse())
+				})
+
+				It("accepts the callback", func() {
+					Ω(responseRecorder.Code).Should(Equal(http.StatusAccepted))
+				})
+			})
+
+			Context("when the CC is rate limiting", func() {
+				BeforeEach(func() {
+					fakeCCClient.StagingCompleteReturns(&cc_client.BadResponseError{429})
+				})
+
+				It("leaves the entry pending for the drainer", func() {
+					Ω(fakeOutbox.PutCallCount()).Should(Equal(1))
+					Ω(fakeOutbox.PutArgsForCall(0).Delivered()).Should(BeFalse())
+				})
+
+				It("accepts the callback", func() {
+					Ω(responseRecorder.Code).Should(Equal(http.StatusAccepted))
 				})
 			})
 
-			Context("When an error occurs in making the CC request", func() {
+			Context("when the CC rejects the response", func() {
 				BeforeEach(func() {
-					fakeCCClient.StagingCompleteReturns(errors.New("whoops"))
+					fakeCCClient.StagingCompleteReturns(&cc_client.BadResponseError{400})
+				})
+
+				It("leaves the entry pending for the drainer", func() {
+					Ω(fakeOutbox.PutCallCount()).Should(Equal(1))
+					Ω(fakeOutbox.PutArgsForCall(0).Delivered()).Should(BeFalse())
 				})
 
-				It("responds with a 503 error", func() {
-					Ω(responseRecorder.Code).Should(Equal(503))
+				It("responds with the status code that the CC returned", func() {
+					Ω(responseRecorder.Code).Should(Equal(400))
 				})
 
 				It("does not update the staging counter", func() {
 					Ω(metricSender.GetCounter("StagingRequestsSucceeded")).Should(BeEquivalentTo(0))
 				})
+			})
 
-				It("does not update the staging duration", func() {
-					Ω(metricSender.GetValue("StagingRequestSucceededDuration")).Should(Equal(fake.Metric{}))
+			Context("when the response cannot be persisted", func() {
+				BeforeEach(func() {
+					fakeOutbox.PutReturns(errors.New("disk full"))
+				})
+
+				It("does not post staging complete to the CC", func() {
+					Ω(fakeCCClient.StagingCompleteCallCount()).Should(Equal(0))
+				})
+
+				It("responds with a 503 so that Diego retries", func() {
+					Ω(responseRecorder.Code).Should(Equal(http.StatusServiceUnavailable))
 				})
 			})
 		})
@@ -291,6 +468,7 @@ var _ = Describe("StagingCompletedHandler", func() {
 			taskResponse := receptor.TaskResponse{
 				TaskGuid:      "the-task-guid",
 				Domain:        "fake-domain",
+				Stack:         "rabbit_hole",
 				Failed:        true,
 				CreatedAt:     createdAt,
 				FailureReason: "because I said so",
@@ -330,6 +508,38 @@ var _ = Describe("StagingCompletedHandler", func() {
 				Unit:  "nanos",
 			}))
 		})
+
+		Context("when the emitter supports labels", func() {
+			var fakeEmitter *fake_metrics.FakeEmitter
+
+			BeforeEach(func() {
+				fakeEmitter = &fake_metrics.FakeEmitter{}
+				emitter = fakeEmitter
+
+				backendResponse = cc_messages.StagingResponseForCC{
+					Error: &cc_messages.StagingError{Id: "InsufficientResources", Message: "insufficient resources"},
+				}
+			})
+
+			It("labels the failure metrics with the lifecycle, stack and failure category", func() {
+				labels := metrics.Labels{
+					Lifecycle:       "fake",
+					Stack:           "rabbit_hole",
+					FailureCategory: "InsufficientResources",
+				}
+
+				Ω(fakeEmitter.IncrementCounterCallCount()).Should(BeNumerically(">=", 1))
+				name, counterLabels := fakeEmitter.IncrementCounterArgsForCall(0)
+				Ω(name).Should(Equal(metrics.StagingRequestsFailed))
+				Ω(counterLabels).Should(Equal(labels))
+
+				Ω(fakeEmitter.ObserveDurationCallCount()).Should(Equal(1))
+				name, duration, durationLabels := fakeEmitter.ObserveDurationArgsForCall(0)
+				Ω(name).Should(Equal(metrics.StagingRequestFailedDuration))
+				Ω(duration).Should(Equal(stagingDurationNano))
+				Ω(durationLabels).Should(Equal(labels))
+			})
+		})
 	})
 
 	Context("when a non-staging task is reported", func() {
@@ -353,6 +563,69 @@ var _ = Describe("StagingCompletedHandler", func() {
 		})
 	})
 
+	Context("when callback URLs are signed", func() {
+		var request *http.Request
+
+		BeforeEach(func() {
+			callbackSigner = backend.NewCallbackSigner([]byte("signing-key"), time.Hour, fakeClock)
+
+			request = postTask(receptor.TaskResponse{
+				TaskGuid:   "the-task-guid",
+				Domain:     "fake-domain",
+				Annotation: `{"lifecycle": "fake"}`,
+				Result:     `{}`,
+			})
+		})
+
+		JustBeforeEach(func() {
+			rataHandler.ServeHTTP(responseRecorder, request)
+		})
+
+		Context("and the callback carries the signature for its staging guid", func() {
+			BeforeEach(func() {
+				request.URL.RawQuery = callbackSigner.Sign("the-task-guid").Encode()
+			})
+
+			It("reports the staging result to the CC", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusOK))
+				Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(1))
+				Ω(fakeCCClient.StagingCompleteCallCount()).Should(Equal(1))
+			})
+		})
+
+		Context("and the callback carries the signature for another staging guid", func() {
+			BeforeEach(func() {
+				request.URL.RawQuery = callbackSigner.Sign("another-task-guid").Encode()
+			})
+
+			It("responds with a 403 without reporting to the CC", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusForbidden))
+				Ω(fakeBackend.BuildStagingResponseCallCount()).Should(BeZero())
+				Ω(fakeCCClient.StagingCompleteCallCount()).Should(BeZero())
+			})
+		})
+
+		Context("and the callback is not signed", func() {
+			It("responds with a 403 without reporting to the CC", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusForbidden))
+				Ω(fakeBackend.BuildStagingResponseCallCount()).Should(BeZero())
+				Ω(fakeCCClient.StagingCompleteCallCount()).Should(BeZero())
+			})
+		})
+
+		Context("and the signature has expired", func() {
+			BeforeEach(func() {
+				request.URL.RawQuery = callbackSigner.Sign("the-task-guid").Encode()
+				fakeClock.Increment(2 * time.Hour)
+			})
+
+			It("responds with a 403", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusForbidden))
+				Ω(fakeCCClient.StagingCompleteCallCount()).Should(BeZero())
+			})
+		})
+	})
+
 	Context("when invalid JSON is posted instead of a task", func() {
 		JustBeforeEach(func() {
 			request, err := http.NewRequest("POST", "/v1/staging/an-invalid-guid/completed", strings.NewReader("{"))
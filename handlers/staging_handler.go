@@ -1,40 +1,90 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/cloudfoundry-incubator/receptor"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
-	"github.com/cloudfoundry-incubator/runtime-schema/metric"
+	"github.com/cloudfoundry-incubator/stager/admission"
 	"github.com/cloudfoundry-incubator/stager/backend"
 	"github.com/cloudfoundry-incubator/stager/cc_client"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/queue"
+	"github.com/cloudfoundry-incubator/stager/tracing"
+	"github.com/pivotal-golang/clock"
 	"github.com/pivotal-golang/lager"
-)
-
-const (
-	StagingStartRequestsReceivedCounter = metric.Counter("StagingStartRequestsReceived")
-	StagingStopRequestsReceivedCounter  = metric.Counter("StagingStopRequestsReceived")
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type StagingHandler interface {
 	Stage(resp http.ResponseWriter, req *http.Request)
 	StopStaging(resp http.ResponseWriter, req *http.Request)
+	RenderRecipe(resp http.ResponseWriter, req *http.Request)
+}
+
+// RecipeErrorResponse is returned by RenderRecipe when the backend cannot
+// build a task from the staging request.
+type RecipeErrorResponse struct {
+	Error RecipeError `json:"error"`
+}
+
+type RecipeError struct {
+	Id      string `json:"id"`
+	Message string `json:"message"`
+}
+
+// recipeErrorIds names the errors the backends return for staging requests
+// they cannot build a task from. Other errors are RecipeBuildingFailed.
+var recipeErrorIds = map[error]string{
+	backend.ErrNoCompilerDefined:            "NoCompilerDefined",
+	backend.ErrMissingAppId:                 "MissingAppId",
+	backend.ErrMissingAppBitsDownloadUri:    "MissingAppBitsDownloadUri",
+	backend.ErrMissingLifecycleData:         "MissingLifecycleData",
+	backend.ErrMissingDockerImageUrl:        "MissingDockerImageUrl",
+	backend.ErrUnknownDockerCredentials:     "UnknownDockerCredentials",
+	backend.ErrConflictingDockerCredentials: "ConflictingDockerCredentials",
+	backend.ErrIncompleteDockerCredentials:  "IncompleteDockerCredentials",
+	backend.ErrNoImageRegistry:              "NoImageRegistry",
+	backend.ErrInvalidDockerfilePath:        "InvalidDockerfilePath",
+	backend.ErrCustomBuildpackNotSupported:  "CustomBuildpackNotSupported",
 }
 
 type stagingHandler struct {
 	logger      lager.Logger
 	backends    map[string]backend.Backend
 	ccClient    cc_client.CcClient
+	outbox      outbox.Outbox
 	diegoClient receptor.Client
+	redactor    backend.Redactor
+	emitter     metrics.Emitter
+	inFlight    *metrics.InFlightGauge
+	admission   *admission.Controller
+	queue       *queue.Queue
+	tracer      trace.Tracer
+	clock       clock.Clock
 }
 
 func NewStagingHandler(
 	logger lager.Logger,
 	backends map[string]backend.Backend,
 	ccClient cc_client.CcClient,
+	outbox outbox.Outbox,
 	diegoClient receptor.Client,
+	redactor backend.Redactor,
+	emitter metrics.Emitter,
+	inFlight *metrics.InFlightGauge,
+	admission *admission.Controller,
+	stagingQueue *queue.Queue,
+	tracer trace.Tracer,
+	clock clock.Clock,
 ) StagingHandler {
 	logger = logger.Session("staging-handler")
 
@@ -42,7 +92,15 @@ func NewStagingHandler(
 		logger:      logger,
 		backends:    backends,
 		ccClient:    ccClient,
+		outbox:      outbox,
 		diegoClient: diegoClient,
+		redactor:    redactor,
+		emitter:     emitter,
+		inFlight:    inFlight,
+		admission:   admission,
+		queue:       stagingQueue,
+		tracer:      tracer,
+		clock:       clock,
 	}
 }
 
@@ -50,8 +108,16 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 	stagingGuid := req.FormValue(":staging_guid")
 	logger := handler.logger.Session("staging-request", lager.Data{"staging-guid": stagingGuid})
 
+	ctx, span := handler.tracer.Start(
+		tracing.ExtractHeaders(req.Context(), req.Header),
+		"stage",
+		trace.WithAttributes(attribute.String("staging_guid", stagingGuid)),
+	)
+	defer span.End()
+
 	requestBody, err := ioutil.ReadAll(req.Body)
 	if err != nil {
+		tracing.RecordError(span, err)
 		logger.Error("read-body-failed", err)
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
@@ -60,11 +126,31 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 	var stagingRequest cc_messages.StagingRequestFromCC
 	err = json.Unmarshal(requestBody, &stagingRequest)
 	if err != nil {
+		tracing.RecordError(span, err)
 		logger.Error("unmarshal-request-failed", err)
 		resp.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	var options stagingOptions
+	err = json.Unmarshal(requestBody, &options)
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.Error("unmarshal-options-failed", err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if priority := req.Header.Get(queue.PriorityHeader); priority != "" {
+		options.Priority, err = strconv.Atoi(priority)
+		if err != nil {
+			tracing.RecordError(span, err)
+			logger.Error("invalid-priority", err)
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
 	backend, ok := handler.backends[stagingRequest.Lifecycle]
 	if !ok {
 		logger.Error("backend-not-found", err, lager.Data{"backend": stagingRequest.Lifecycle})
@@ -72,36 +158,171 @@ func (handler *stagingHandler) Stage(resp http.ResponseWriter, req *http.Request
 		return
 	}
 
-	StagingStartRequestsReceivedCounter.Increment()
+	span.SetAttributes(
+		attribute.String("app_id", stagingRequest.AppId),
+		attribute.String("lifecycle", stagingRequest.Lifecycle),
+		attribute.String("stack", stagingRequest.Stack),
+	)
+
+	labels := metrics.Labels{
+		Lifecycle: stagingRequest.Lifecycle,
+		Stack:     stagingRequest.Stack,
+	}
+	handler.emitter.IncrementCounter(metrics.StagingStartRequestsReceived, labels)
+
+	staging := admission.Staging{
+		Guid:      stagingGuid,
+		Lifecycle: stagingRequest.Lifecycle,
+		Tenant:    options.Tenant,
+		MemoryMB:  stagingRequest.MemoryMB,
+		DiskMB:    stagingRequest.DiskMB,
+	}
+
+	// A CC retry of a staging whose task has already been created is
+	// accepted again, as creating the task would be, rather than queued.
+	if handler.queue != nil && handler.taskExists(logger, stagingGuid) {
+		logger.Info("task-already-exists")
+		resp.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// Queued stagings are admitted when they are dispatched; until then only
+	// stagings that could never be admitted are turned away.
+	cancelAdmission := func() {}
+	if handler.queue == nil {
+		cancelAdmission, err = handler.admission.Admit(staging)
+	} else {
+		err = handler.admission.Fits(staging)
+	}
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.Info("staging-rejected", lager.Data{"reason": err.Error()})
+		handler.emitter.IncrementCounter(metrics.StagingRequestsRejected, labels)
+		handler.doRejectedResponse(resp, err)
+		return
+	}
 
+	_, recipeSpan := handler.tracer.Start(ctx, "build-recipe")
 	taskRequest, err := backend.BuildRecipe(stagingGuid, stagingRequest)
+	tracing.RecordError(recipeSpan, err)
+	recipeSpan.End()
+
 	if err != nil {
-		logger.Error("recipe-building-failed", err, lager.Data{"staging-request": stagingRequest})
+		cancelAdmission()
+		tracing.RecordError(span, err)
+		logger.Error("recipe-building-failed", err, lager.Data{"staging-request": handler.redactor.Redact(stagingRequest)})
 		handler.doErrorResponse(resp, "Recipe building failed: "+err.Error())
 		return
 	}
 
+	annotation, err := annotateTask(ctx, taskRequest.Annotation, options.Tenant)
+	if err != nil {
+		logger.Error("failed-to-annotate-trace-context", err)
+	} else {
+		taskRequest.Annotation = annotation
+	}
+
+	if handler.queue != nil {
+		err = handler.queue.Push(queue.Item{
+			Staging:  staging,
+			AppId:    stagingRequest.AppId,
+			Stack:    stagingRequest.Stack,
+			Priority: options.Priority,
+			Task:     taskRequest,
+
+			TraceContext: tracing.Inject(ctx),
+		})
+		if _, ok := err.(*queue.FullError); ok {
+			tracing.RecordError(span, err)
+			logger.Info("staging-rejected", lager.Data{"reason": err.Error()})
+			handler.emitter.IncrementCounter(metrics.StagingRequestsRejected, labels)
+			handler.doRejectedResponse(resp, err)
+			return
+		}
+		if err != nil {
+			tracing.RecordError(span, err)
+			logger.Error("failed-to-queue-staging", err)
+			handler.doErrorResponse(resp, "Staging failed: "+err.Error())
+			return
+		}
+
+		logger.Info("queued-staging", lager.Data{"priority": options.Priority})
+		resp.WriteHeader(http.StatusAccepted)
+		return
+	}
+
 	logger.Info("desiring-task", lager.Data{
 		"task_guid":    taskRequest.TaskGuid,
-		"callback_url": taskRequest.CompletionCallbackURL,
+		"callback_url": handler.redactor.RedactURL(taskRequest.CompletionCallbackURL),
 	})
 
+	_, createSpan := handler.tracer.Start(ctx, "create-task")
 	err = handler.diegoClient.CreateTask(taskRequest)
 	if receptorErr, ok := err.(receptor.Error); ok {
 		if receptorErr.Type == receptor.TaskGuidAlreadyExists {
 			err = nil
 		}
 	}
+	tracing.RecordError(createSpan, err)
+	createSpan.End()
 
 	if err != nil {
-		logger.Error("staging-failed", err, lager.Data{"staging-request": stagingRequest})
+		cancelAdmission()
+		tracing.RecordError(span, err)
+		logger.Error("staging-failed", err, lager.Data{"staging-request": handler.redactor.Redact(stagingRequest)})
 		handler.doErrorResponse(resp, "Staging failed: "+err.Error())
 		return
 	}
 
+	handler.inFlight.Update()
+
 	resp.WriteHeader(http.StatusAccepted)
 }
 
+// taskExists tells whether the task of the staging has been created. When
+// Diego cannot tell, the staging is queued anyway, as the dispatcher treats an
+// existing task as created.
+func (handler *stagingHandler) taskExists(logger lager.Logger, stagingGuid string) bool {
+	_, err := handler.diegoClient.GetTask(stagingGuid)
+	if err == nil {
+		return true
+	}
+
+	if receptorErr, ok := err.(receptor.Error); !ok || receptorErr.Type != receptor.TaskNotFound {
+		logger.Error("failed-to-get-task", err)
+	}
+
+	return false
+}
+
+// stagingOptions are sent by the CC alongside the staging request.
+type stagingOptions struct {
+	admission.Tenant
+	Priority int `json:"priority"`
+}
+
+// annotateTask adds the trace context of ctx to the task annotation, so that
+// the completion callback joins the trace, and the tenant, so that the
+// staging counts against its quotas after a restart.
+func annotateTask(ctx context.Context, annotationJSON string, tenant admission.Tenant) (string, error) {
+	var annotation backend.StagingTaskAnnotation
+	err := json.Unmarshal([]byte(annotationJSON), &annotation)
+	if err != nil {
+		return "", err
+	}
+
+	annotation.TraceContext = tracing.Inject(ctx)
+	annotation.OrganizationGuid = tenant.OrganizationGuid
+	annotation.SpaceGuid = tenant.SpaceGuid
+
+	annotated, err := json.Marshal(annotation)
+	if err != nil {
+		return "", err
+	}
+
+	return string(annotated), nil
+}
+
 func (handler *stagingHandler) doErrorResponse(resp http.ResponseWriter, message string) {
 	response := cc_messages.StagingResponseForCC{
 		Error: cc_messages.SanitizeErrorMessage(message),
@@ -112,10 +333,60 @@ func (handler *stagingHandler) doErrorResponse(resp http.ResponseWriter, message
 	resp.Write(responseJson)
 }
 
+// doRejectedResponse tells the CC why the staging was not admitted, and when
+// to retry it if there will be room for it later.
+func (handler *stagingHandler) doRejectedResponse(resp http.ResponseWriter, rejection error) {
+	response := cc_messages.StagingResponseForCC{
+		Error: &cc_messages.StagingError{
+			Id:      cc_messages.STAGING_ERROR,
+			Message: "Staging rejected: " + rejection.Error(),
+		},
+	}
+	responseJson, _ := json.Marshal(response)
+
+	var retryAfter time.Duration
+	switch rejection := rejection.(type) {
+	case *admission.CapacityError:
+		retryAfter = rejection.RetryAfter
+	case *admission.QuotaError:
+		if rejection.RetryAfter == 0 {
+			resp.WriteHeader(http.StatusUnprocessableEntity)
+			resp.Write(responseJson)
+			return
+		}
+		retryAfter = rejection.RetryAfter
+	case *queue.FullError:
+		retryAfter = rejection.RetryAfter
+	}
+
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+
+	resp.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	resp.WriteHeader(http.StatusTooManyRequests)
+	resp.Write(responseJson)
+}
+
 func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.Request) {
 	taskGuid := req.FormValue(":staging_guid")
 	logger := handler.logger.Session("stop-staging-request", lager.Data{"staging-guid": taskGuid})
 
+	if handler.queue != nil {
+		if queued, ok := handler.queue.Remove(taskGuid); ok {
+			resp.WriteHeader(http.StatusAccepted)
+			handler.emitter.IncrementCounter(metrics.StagingStopRequestsReceived, metrics.Labels{
+				Lifecycle: queued.Staging.Lifecycle,
+				Stack:     queued.Stack,
+			})
+
+			logger.Info("cancelling-queued-staging")
+			queue.ReportFailure(logger, handler.outbox, handler.clock, taskGuid, "Staging cancelled")
+			return
+		}
+	}
+
 	task, err := handler.diegoClient.GetTask(taskGuid)
 	if err != nil {
 		if receptorErr, ok := err.(receptor.Error); ok {
@@ -130,7 +401,7 @@ func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.R
 		return
 	}
 
-	var annotation cc_messages.StagingTaskAnnotation
+	var annotation backend.StagingTaskAnnotation
 	err = json.Unmarshal([]byte(task.Annotation), &annotation)
 	if err != nil {
 		logger.Error("failed-to-unmarshal-task-annotation", err)
@@ -139,7 +410,10 @@ func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.R
 	}
 
 	resp.WriteHeader(http.StatusAccepted)
-	StagingStopRequestsReceivedCounter.Increment()
+	handler.emitter.IncrementCounter(metrics.StagingStopRequestsReceived, metrics.Labels{
+		Lifecycle: annotation.Lifecycle,
+		Stack:     task.Stack,
+	})
 
 	logger.Info("cancelling", lager.Data{"task_guid": taskGuid})
 
@@ -148,3 +422,85 @@ func (handler *stagingHandler) StopStaging(resp http.ResponseWriter, req *http.R
 		logger.Error("stop-staging-failed", err)
 	}
 }
+
+// RenderRecipe builds the task for a staging request the way Stage would,
+// and returns it redacted instead of desiring it.
+func (handler *stagingHandler) RenderRecipe(resp http.ResponseWriter, req *http.Request) {
+	stagingGuid := req.FormValue(":staging_guid")
+	logger := handler.logger.Session("render-recipe-request", lager.Data{"staging-guid": stagingGuid})
+
+	ctx, span := handler.tracer.Start(
+		tracing.ExtractHeaders(req.Context(), req.Header),
+		"render-recipe",
+		trace.WithAttributes(attribute.String("staging_guid", stagingGuid)),
+	)
+	defer span.End()
+
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.Error("read-body-failed", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var stagingRequest cc_messages.StagingRequestFromCC
+	err = json.Unmarshal(requestBody, &stagingRequest)
+	if err != nil {
+		logger.Error("unmarshal-request-failed", err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var options stagingOptions
+	err = json.Unmarshal(requestBody, &options)
+	if err != nil {
+		logger.Error("unmarshal-options-failed", err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	backend, ok := handler.backends[stagingRequest.Lifecycle]
+	if !ok {
+		logger.Error("backend-not-found", err, lager.Data{"backend": stagingRequest.Lifecycle})
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	taskRequest, err := backend.BuildRecipe(stagingGuid, stagingRequest)
+	if err != nil {
+		tracing.RecordError(span, err)
+		logger.Info("recipe-building-failed", lager.Data{"reason": err.Error()})
+
+		id, ok := recipeErrorIds[err]
+		if !ok {
+			id = "RecipeBuildingFailed"
+		}
+		handler.writeJSON(logger, resp, http.StatusUnprocessableEntity, RecipeErrorResponse{
+			Error: RecipeError{Id: id, Message: err.Error()},
+		})
+		return
+	}
+
+	annotation, err := annotateTask(ctx, taskRequest.Annotation, options.Tenant)
+	if err != nil {
+		logger.Error("failed-to-annotate-trace-context", err)
+	} else {
+		taskRequest.Annotation = annotation
+	}
+
+	logger.Info("rendered-recipe")
+	handler.writeJSON(logger, resp, http.StatusOK, handler.redactor.Redact(taskRequest))
+}
+
+func (handler *stagingHandler) writeJSON(logger lager.Logger, resp http.ResponseWriter, statusCode int, body interface{}) {
+	responseJson, err := json.Marshal(body)
+	if err != nil {
+		logger.Error("failed-to-marshal-response", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(statusCode)
+	resp.Write(responseJson)
+}
@@ -6,20 +6,30 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/cloudfoundry-incubator/receptor"
 	"github.com/cloudfoundry-incubator/receptor/fake_receptor"
 	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
 	"github.com/cloudfoundry-incubator/stager"
+	"github.com/cloudfoundry-incubator/stager/admission"
 	"github.com/cloudfoundry-incubator/stager/backend"
 	"github.com/cloudfoundry-incubator/stager/backend/fake_backend"
 	"github.com/cloudfoundry-incubator/stager/cc_client/fakes"
 	"github.com/cloudfoundry-incubator/stager/handlers"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	outbox_fakes "github.com/cloudfoundry-incubator/stager/outbox/fakes"
+	"github.com/cloudfoundry-incubator/stager/queue"
 	fake_metric_sender "github.com/cloudfoundry/dropsonde/metric_sender/fake"
-	"github.com/cloudfoundry/dropsonde/metrics"
+	dropsonde_metrics "github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/pivotal-golang/clock/fakeclock"
 	"github.com/pivotal-golang/lager"
 	"github.com/pivotal-golang/lager/lagertest"
 	"github.com/tedsuo/rata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -30,12 +40,19 @@ var _ = Describe("StagingHandler", func() {
 
 	var (
 		fakeMetricSender *fake_metric_sender.FakeMetricSender
+		spanRecorder     *tracetest.SpanRecorder
 
 		logger          lager.Logger
 		fakeDiegoClient *fake_receptor.FakeClient
 		fakeCcClient    *fakes.FakeCcClient
+		stagingOutbox   outbox.Outbox
 		fakeBackend     *fake_backend.FakeBackend
 
+		admissionController *admission.Controller
+		stagingQueue        *queue.Queue
+		emitter             metrics.Emitter
+		tracer              trace.Tracer
+
 		responseRecorder *httptest.ResponseRecorder
 		rataHandler      http.Handler
 	)
@@ -44,15 +61,29 @@ var _ = Describe("StagingHandler", func() {
 		logger = lagertest.NewTestLogger("test")
 
 		fakeMetricSender = fake_metric_sender.NewFakeMetricSender()
-		metrics.Initialize(fakeMetricSender)
+		dropsonde_metrics.Initialize(fakeMetricSender)
+		emitter = metrics.NewDropsondeEmitter()
+
+		spanRecorder = tracetest.NewSpanRecorder()
+		tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)).Tracer("test")
 
 		fakeCcClient = &fakes.FakeCcClient{}
+		stagingOutbox = outbox.NewMemoryOutbox()
 
 		fakeBackend = &fake_backend.FakeBackend{}
 		fakeDiegoClient = &fake_receptor.FakeClient{}
 
+		admissionController = admission.NewController(admission.Limits{
+			MaxInFlightPerLifecycle: map[string]int{"fake-backend": 1},
+			OrganizationQuota:       admission.Quota{MaxMemoryMB: 2048},
+		}, 15*time.Second)
+		stagingQueue = nil
+
 		responseRecorder = httptest.NewRecorder()
-		handler := handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeCcClient, fakeDiegoClient)
+	})
+
+	JustBeforeEach(func() {
+		handler := handlers.NewStagingHandler(logger, map[string]backend.Backend{"fake-backend": fakeBackend}, fakeCcClient, stagingOutbox, fakeDiegoClient, backend.NewRedactor(nil), emitter, metrics.NewInFlightGauge(emitter, admissionController), admissionController, stagingQueue, tracer, fakeclock.NewFakeClock(time.Now()))
 
 		var routes rata.Routes
 		for _, r := range stager.Routes {
@@ -62,12 +93,16 @@ var _ = Describe("StagingHandler", func() {
 			if r.Name == stager.StopStagingRoute {
 				routes = append(routes, r)
 			}
+			if r.Name == stager.RenderRecipeRoute {
+				routes = append(routes, r)
+			}
 		}
 
 		var err error
 		rataHandler, err = rata.NewRouter(routes, rata.Handlers{
-			stager.StageRoute:       http.HandlerFunc(handler.Stage),
-			stager.StopStagingRoute: http.HandlerFunc(handler.StopStaging),
+			stager.StageRoute:        http.HandlerFunc(handler.Stage),
+			stager.StopStagingRoute:  http.HandlerFunc(handler.StopStaging),
+			stager.RenderRecipeRoute: http.HandlerFunc(handler.RenderRecipe),
 		})
 		Ω(err).ShouldNot(HaveOccurred())
 	})
@@ -75,11 +110,19 @@ var _ = Describe("StagingHandler", func() {
 	Describe("Stage", func() {
 		var (
 			stagingRequestJson []byte
+			requestHeader      http.Header
 		)
 
+		BeforeEach(func() {
+			requestHeader = http.Header{}
+		})
+
 		JustBeforeEach(func() {
 			req, err := http.NewRequest("PUT", "/v1/staging/a-staging-guid", bytes.NewReader(stagingRequestJson))
 			Ω(err).ShouldNot(HaveOccurred())
+			for name, values := range requestHeader {
+				req.Header[name] = values
+			}
 
 			rataHandler.ServeHTTP(responseRecorder, req)
 		})
@@ -102,6 +145,10 @@ var _ = Describe("StagingHandler", func() {
 				Ω(fakeMetricSender.GetCounter("StagingStartRequestsReceived")).Should(Equal(uint64(1)))
 			})
 
+			It("increments the counter for the lifecycle", func() {
+				Ω(fakeMetricSender.GetCounter("StagingStartRequestsReceived.fake-backend")).Should(Equal(uint64(1)))
+			})
+
 			It("returns an Accepted response", func() {
 				Ω(responseRecorder.Code).Should(Equal(http.StatusAccepted))
 			})
@@ -133,6 +180,51 @@ var _ = Describe("StagingHandler", func() {
 					It("does not send a staging failure response", func() {
 						Ω(fakeCcClient.StagingCompleteCallCount()).To(Equal(0))
 					})
+
+					It("counts the staging as in flight for the lifecycle", func() {
+						Ω(fakeMetricSender.GetValue("StagingsInFlight.fake-backend").Value).Should(BeEquivalentTo(1))
+					})
+
+					It("keeps the staging admitted until it completes", func() {
+						Ω(admissionController.InFlight("fake-backend")).Should(Equal(1))
+					})
+
+					It("traces building the recipe and creating the task as part of the staging request", func() {
+						ended := spanRecorder.Ended()
+						Ω(ended).Should(HaveLen(3))
+						Ω(ended[0].Name()).Should(Equal("build-recipe"))
+						Ω(ended[1].Name()).Should(Equal("create-task"))
+						Ω(ended[2].Name()).Should(Equal("stage"))
+
+						stageSpan := ended[2].SpanContext()
+						for _, child := range ended[:2] {
+							Ω(child.Parent().TraceID()).Should(Equal(stageSpan.TraceID()))
+							Ω(child.Parent().SpanID()).Should(Equal(stageSpan.SpanID()))
+						}
+					})
+				})
+
+				Context("when the recipe is annotated as a staging task", func() {
+					BeforeEach(func() {
+						fakeBackend.BuildRecipeReturns(receptor.TaskCreateRequest{
+							Annotation: `{"lifecycle":"fake-backend","app_id":"myapp"}`,
+						}, nil)
+					})
+
+					It("carries the trace context of the staging request in the annotation", func() {
+						Ω(fakeDiegoClient.CreateTaskCallCount()).Should(Equal(1))
+
+						var annotation backend.StagingTaskAnnotation
+						err := json.Unmarshal([]byte(fakeDiegoClient.CreateTaskArgsForCall(0).Annotation), &annotation)
+						Ω(err).ShouldNot(HaveOccurred())
+
+						Ω(annotation.Lifecycle).Should(Equal("fake-backend"))
+						Ω(annotation.AppId).Should(Equal("myapp"))
+
+						stageSpan := spanRecorder.Ended()[2].SpanContext()
+						Ω(annotation.TraceContext).Should(HaveKeyWithValue("traceparent", ContainSubstring(stageSpan.TraceID().String())))
+						Ω(annotation.TraceContext["traceparent"]).Should(ContainSubstring(stageSpan.SpanID().String()))
+					})
 				})
 
 				Context("when the task has already been created", func() {
@@ -146,6 +238,10 @@ var _ = Describe("StagingHandler", func() {
 					It("does not log a failure", func() {
 						Ω(logger).ShouldNot(gbytes.Say("staging-failed"))
 					})
+
+					It("keeps the staging admitted", func() {
+						Ω(admissionController.InFlight("fake-backend")).Should(Equal(1))
+					})
 				})
 
 				Context("create task fails for any other reason", func() {
@@ -168,6 +264,10 @@ var _ = Describe("StagingHandler", func() {
 						Ω(fakeCcClient.StagingCompleteCallCount()).To(Equal(0))
 					})
 
+					It("gives back the room the staging was admitted to", func() {
+						Ω(admissionController.InFlight("fake-backend")).Should(Equal(0))
+					})
+
 					Context("when the response builder succeeds", func() {
 						var responseForCC cc_messages.StagingResponseForCC
 
@@ -189,6 +289,222 @@ var _ = Describe("StagingHandler", func() {
 				})
 			})
 
+			Context("when the lifecycle has no room for another staging", func() {
+				BeforeEach(func() {
+					_, err := admissionController.Admit(admission.Staging{Guid: "another-staging-guid", Lifecycle: "fake-backend"})
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+
+				It("rejects the request without building a recipe", func() {
+					Ω(responseRecorder.Code).Should(Equal(http.StatusTooManyRequests))
+					Ω(fakeBackend.BuildRecipeCallCount()).Should(Equal(0))
+					Ω(fakeDiegoClient.CreateTaskCallCount()).Should(Equal(0))
+				})
+
+				It("tells the CC when to retry", func() {
+					Ω(responseRecorder.Header().Get("Retry-After")).Should(Equal("15"))
+
+					var response cc_messages.StagingResponseForCC
+					err := json.NewDecoder(responseRecorder.Body).Decode(&response)
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(response.Error.Id).Should(Equal(cc_messages.STAGING_ERROR))
+					Ω(response.Error.Message).Should(ContainSubstring("too many fake-backend stagings in flight"))
+				})
+
+				It("counts the rejection", func() {
+					Ω(fakeMetricSender.GetCounter("StagingRequestsRejected.fake-backend")).Should(Equal(uint64(1)))
+				})
+			})
+
+			Context("when the request names the tenant", func() {
+				BeforeEach(func() {
+					stagingRequest.MemoryMB = 1024
+
+					requestJSON, err := json.Marshal(stagingRequest)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					var body map[string]interface{}
+					err = json.Unmarshal(requestJSON, &body)
+					Ω(err).ShouldNot(HaveOccurred())
+					body["organization_guid"] = "org-guid"
+					body["space_guid"] = "space-guid"
+
+					stagingRequestJson, err = json.Marshal(body)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					fakeBackend.BuildRecipeReturns(receptor.TaskCreateRequest{
+						Annotation: `{"lifecycle":"fake-backend","app_id":"myapp"}`,
+					}, nil)
+				})
+
+				It("records the tenant in the task annotation", func() {
+					Ω(fakeDiegoClient.CreateTaskCallCount()).Should(Equal(1))
+
+					var annotation backend.StagingTaskAnnotation
+					err := json.Unmarshal([]byte(fakeDiegoClient.CreateTaskArgsForCall(0).Annotation), &annotation)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(annotation.OrganizationGuid).Should(Equal("org-guid"))
+					Ω(annotation.SpaceGuid).Should(Equal("space-guid"))
+				})
+
+				Context("and the organization is over its quota", func() {
+					BeforeEach(func() {
+						_, err := admissionController.Admit(admission.Staging{
+							Guid:      "another-staging-guid",
+							Lifecycle: "other-backend",
+							Tenant:    admission.Tenant{OrganizationGuid: "org-guid"},
+							MemoryMB:  2048,
+						})
+						Ω(err).ShouldNot(HaveOccurred())
+					})
+
+					It("rejects the request with a staging error naming the quota", func() {
+						Ω(responseRecorder.Code).Should(Equal(http.StatusTooManyRequests))
+						Ω(responseRecorder.Header().Get("Retry-After")).Should(Equal("15"))
+						Ω(fakeBackend.BuildRecipeCallCount()).Should(Equal(0))
+
+						var response cc_messages.StagingResponseForCC
+						err := json.NewDecoder(responseRecorder.Body).Decode(&response)
+						Ω(err).ShouldNot(HaveOccurred())
+						Ω(response.Error).Should(Equal(&cc_messages.StagingError{
+							Id:      cc_messages.STAGING_ERROR,
+							Message: "Staging rejected: organization org-guid is over its staging memory quota (limit 2048 MB)",
+						}))
+					})
+				})
+
+				Context("and the staging does not fit in the quota on its own", func() {
+					BeforeEach(func() {
+						var body map[string]interface{}
+						err := json.Unmarshal(stagingRequestJson, &body)
+						Ω(err).ShouldNot(HaveOccurred())
+						body["memory_mb"] = 4096
+
+						stagingRequestJson, err = json.Marshal(body)
+						Ω(err).ShouldNot(HaveOccurred())
+					})
+
+					It("rejects the request without asking for a retry", func() {
+						Ω(responseRecorder.Code).Should(Equal(http.StatusUnprocessableEntity))
+						Ω(responseRecorder.Header().Get("Retry-After")).Should(BeEmpty())
+					})
+				})
+			})
+
+			Context("when stagings are queued", func() {
+				var fakeClock *fakeclock.FakeClock
+
+				BeforeEach(func() {
+					fakeClock = fakeclock.NewFakeClock(time.Now())
+					stagingQueue = queue.New(1, time.Minute, 20*time.Second, outbox.NewMemoryOutbox(), emitter, fakeClock)
+
+					fakeDiegoClient.GetTaskReturns(receptor.TaskResponse{}, receptor.Error{Type: receptor.TaskNotFound})
+
+					fakeBackend.BuildRecipeReturns(receptor.TaskCreateRequest{
+						TaskGuid:   "a-staging-guid",
+						Annotation: `{"lifecycle":"fake-backend","app_id":"myapp"}`,
+					}, nil)
+				})
+
+				It("queues the task instead of creating it", func() {
+					Ω(responseRecorder.Code).Should(Equal(http.StatusAccepted))
+					Ω(fakeDiegoClient.CreateTaskCallCount()).Should(BeZero())
+
+					queued, ok := stagingQueue.Get("a-staging-guid")
+					Ω(ok).Should(BeTrue())
+					Ω(queued.Task.TaskGuid).Should(Equal("a-staging-guid"))
+					Ω(queued.AppId).Should(Equal("myapp"))
+					Ω(queued.Priority).Should(BeZero())
+				})
+
+				It("carries the trace of the request to the dispatcher", func() {
+					queued, ok := stagingQueue.Get("a-staging-guid")
+					Ω(ok).Should(BeTrue())
+					Ω(queued.TraceContext).Should(HaveKey("traceparent"))
+				})
+
+				It("leaves admission to the dispatcher", func() {
+					Ω(admissionController.InFlight("fake-backend")).Should(BeZero())
+				})
+
+				Context("when the request sets a priority", func() {
+					BeforeEach(func() {
+						stagingRequestJson = []byte(`{"app_id": "myapp", "lifecycle": "fake-backend", "priority": 3}`)
+					})
+
+					It("queues the staging with that priority", func() {
+						queued, ok := stagingQueue.Get("a-staging-guid")
+						Ω(ok).Should(BeTrue())
+						Ω(queued.Priority).Should(Equal(3))
+					})
+
+					Context("and the priority header overrides it", func() {
+						BeforeEach(func() {
+							requestHeader.Set(queue.PriorityHeader, "10")
+						})
+
+						It("queues the staging with the priority of the header", func() {
+							queued, ok := stagingQueue.Get("a-staging-guid")
+							Ω(ok).Should(BeTrue())
+							Ω(queued.Priority).Should(Equal(10))
+						})
+					})
+				})
+
+				Context("when the priority header is not a number", func() {
+					BeforeEach(func() {
+						requestHeader.Set(queue.PriorityHeader, "urgent")
+					})
+
+					It("returns bad request", func() {
+						Ω(responseRecorder.Code).Should(Equal(http.StatusBadRequest))
+					})
+				})
+
+				Context("when the queue is full", func() {
+					BeforeEach(func() {
+						err := stagingQueue.Push(queue.Item{Staging: admission.Staging{Guid: "another-staging-guid"}})
+						Ω(err).ShouldNot(HaveOccurred())
+					})
+
+					It("rejects the request", func() {
+						Ω(responseRecorder.Code).Should(Equal(http.StatusTooManyRequests))
+						Ω(responseRecorder.Header().Get("Retry-After")).Should(Equal("20"))
+
+						_, ok := stagingQueue.Get("a-staging-guid")
+						Ω(ok).Should(BeFalse())
+					})
+
+					Context("and the CC retries a staging whose task already exists", func() {
+						BeforeEach(func() {
+							fakeDiegoClient.GetTaskReturns(receptor.TaskResponse{TaskGuid: "a-staging-guid"}, nil)
+						})
+
+						It("accepts the request without queuing it", func() {
+							Ω(responseRecorder.Code).Should(Equal(http.StatusAccepted))
+							Ω(fakeDiegoClient.GetTaskArgsForCall(0)).Should(Equal("a-staging-guid"))
+
+							_, ok := stagingQueue.Get("a-staging-guid")
+							Ω(ok).Should(BeFalse())
+						})
+					})
+				})
+
+				Context("when the staging cannot be stored", func() {
+					BeforeEach(func() {
+						fakeStore := &outbox_fakes.FakeOutbox{}
+						fakeStore.PutReturns(errors.New("disk full"))
+						stagingQueue = queue.New(1, time.Minute, 20*time.Second, fakeStore, emitter, fakeClock)
+					})
+
+					It("fails the request", func() {
+						Ω(responseRecorder.Code).Should(Equal(http.StatusInternalServerError))
+						Ω(stagingQueue.List()).Should(BeEmpty())
+					})
+				})
+			})
+
 			Context("when the recipe failed to be built", func() {
 				var buildRecipeError error
 
@@ -209,6 +525,10 @@ var _ = Describe("StagingHandler", func() {
 					Ω(fakeCcClient.StagingCompleteCallCount()).To(Equal(0))
 				})
 
+				It("gives back the room the staging was admitted to", func() {
+					Ω(admissionController.InFlight("fake-backend")).Should(Equal(0))
+				})
+
 				Context("when the response builder succeeds", func() {
 					var responseForCC cc_messages.StagingResponseForCC
 
@@ -291,6 +611,40 @@ var _ = Describe("StagingHandler", func() {
 			rataHandler.ServeHTTP(responseRecorder, req)
 		})
 
+		Context("when the staging is queued", func() {
+			BeforeEach(func() {
+				stagingQueue = queue.New(10, time.Minute, time.Second, outbox.NewMemoryOutbox(), emitter, fakeclock.NewFakeClock(time.Now()))
+				err := stagingQueue.Push(queue.Item{
+					Staging: admission.Staging{Guid: "a-staging-guid", Lifecycle: "fake-backend"},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("takes it out of the queue without asking Diego", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusAccepted))
+				Ω(fakeDiegoClient.GetTaskCallCount()).Should(BeZero())
+				Ω(fakeDiegoClient.CancelTaskCallCount()).Should(BeZero())
+
+				_, ok := stagingQueue.Get("a-staging-guid")
+				Ω(ok).Should(BeFalse())
+			})
+
+			It("puts the failed staging in the outbox for the drainer to tell the CC", func() {
+				Ω(fakeCcClient.StagingCompleteCallCount()).Should(BeZero())
+
+				entries, err := stagingOutbox.Entries()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(entries).Should(HaveLen(1))
+				Ω(entries[0].StagingGuid).Should(Equal("a-staging-guid"))
+				Ω(entries[0].Delivered()).Should(BeFalse())
+
+				var response cc_messages.StagingResponseForCC
+				err = json.Unmarshal(entries[0].Payload, &response)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Error).ShouldNot(BeNil())
+			})
+		})
+
 		Context("when receiving a stop staging request", func() {
 			It("retrieves the current staging task by guid", func() {
 				Ω(fakeDiegoClient.GetTaskCallCount()).Should(Equal(1))
@@ -349,4 +703,122 @@ var _ = Describe("StagingHandler", func() {
 			})
 		})
 	})
+
+	Describe("RenderRecipe", func() {
+		var stagingRequestJson []byte
+
+		BeforeEach(func() {
+			stagingRequestJson = []byte(`{
+				"app_id": "myapp",
+				"lifecycle": "fake-backend",
+				"organization_guid": "org-guid"
+			}`)
+
+			fakeBackend.BuildRecipeReturns(receptor.TaskCreateRequest{
+				TaskGuid:   "a-staging-guid",
+				Annotation: `{"lifecycle": "fake-backend"}`,
+				EnvironmentVariables: []receptor.EnvironmentVariable{
+					{Name: "DATABASE_PASSWORD", Value: "hunter2"},
+				},
+			}, nil)
+		})
+
+		JustBeforeEach(func() {
+			req, err := http.NewRequest("POST", "/v1/staging/a-staging-guid/recipe", bytes.NewReader(stagingRequestJson))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			rataHandler.ServeHTTP(responseRecorder, req)
+		})
+
+		It("builds the recipe for the staging request", func() {
+			Ω(fakeBackend.BuildRecipeCallCount()).Should(Equal(1))
+
+			stagingGuid, stagingRequest := fakeBackend.BuildRecipeArgsForCall(0)
+			Ω(stagingGuid).Should(Equal("a-staging-guid"))
+			Ω(stagingRequest.AppId).Should(Equal("myapp"))
+		})
+
+		It("returns the redacted task", func() {
+			Ω(responseRecorder.Code).Should(Equal(http.StatusOK))
+			Ω(responseRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
+
+			var task receptor.TaskCreateRequest
+			err := json.Unmarshal(responseRecorder.Body.Bytes(), &task)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(task.TaskGuid).Should(Equal("a-staging-guid"))
+			Ω(task.EnvironmentVariables).Should(Equal([]receptor.EnvironmentVariable{
+				{Name: "DATABASE_PASSWORD", Value: backend.RedactedValue},
+			}))
+
+			var annotation backend.StagingTaskAnnotation
+			err = json.Unmarshal([]byte(task.Annotation), &annotation)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(annotation.Lifecycle).Should(Equal("fake-backend"))
+			Ω(annotation.OrganizationGuid).Should(Equal("org-guid"))
+		})
+
+		It("does not desire the task, nor count it against the limits", func() {
+			Ω(fakeDiegoClient.CreateTaskCallCount()).Should(BeZero())
+			Ω(admissionController.InFlight("")).Should(BeZero())
+			Ω(fakeMetricSender.GetCounter("StagingStartRequestsReceived")).Should(BeZero())
+		})
+
+		Context("when the staging request is invalid", func() {
+			BeforeEach(func() {
+				fakeBackend.BuildRecipeReturns(receptor.TaskCreateRequest{}, backend.ErrMissingAppId)
+			})
+
+			It("returns an UnprocessableEntity response naming the error", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusUnprocessableEntity))
+
+				var response handlers.RecipeErrorResponse
+				err := json.Unmarshal(responseRecorder.Body.Bytes(), &response)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Error).Should(Equal(handlers.RecipeError{
+					Id:      "MissingAppId",
+					Message: backend.ErrMissingAppId.Error(),
+				}))
+			})
+		})
+
+		Context("when building the recipe fails otherwise", func() {
+			BeforeEach(func() {
+				fakeBackend.BuildRecipeReturns(receptor.TaskCreateRequest{}, errors.New("boom"))
+			})
+
+			It("returns an UnprocessableEntity response with the message", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusUnprocessableEntity))
+
+				var response handlers.RecipeErrorResponse
+				err := json.Unmarshal(responseRecorder.Body.Bytes(), &response)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Error).Should(Equal(handlers.RecipeError{
+					Id:      "RecipeBuildingFailed",
+					Message: "boom",
+				}))
+			})
+		})
+
+		Context("when the request is not JSON", func() {
+			BeforeEach(func() {
+				stagingRequestJson = []byte(`{"app_id":`)
+			})
+
+			It("returns a BadRequest response", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("when the lifecycle has no backend", func() {
+			BeforeEach(func() {
+				stagingRequestJson = []byte(`{"app_id": "myapp", "lifecycle": "unknown"}`)
+			})
+
+			It("returns a NotFound response", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusNotFound))
+				Ω(fakeBackend.BuildRecipeCallCount()).Should(BeZero())
+			})
+		})
+	})
 })
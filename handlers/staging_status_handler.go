@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/queue"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	DefaultStagingsPerPage = 50
+	MaxStagingsPerPage     = 500
+)
+
+type StagingStatusResponse struct {
+	StagingGuid     string                            `json:"staging_guid"`
+	AppId           string                            `json:"app_id,omitempty"`
+	Lifecycle       string                            `json:"lifecycle"`
+	State           string                            `json:"state"`
+	Failed          bool                              `json:"failed"`
+	FailureReason   string                            `json:"failure_reason,omitempty"`
+	StagingResponse *cc_messages.StagingResponseForCC `json:"staging_response,omitempty"`
+
+	// Set while the staging is queued.
+	Priority      int   `json:"priority,omitempty"`
+	QueuePosition int   `json:"queue_position,omitempty"`
+	QueuedSeconds int64 `json:"queued_seconds,omitempty"`
+}
+
+type StagingSummary struct {
+	StagingGuid string `json:"staging_guid"`
+	AppId       string `json:"app_id,omitempty"`
+	Lifecycle   string `json:"lifecycle"`
+	Stack       string `json:"stack"`
+	State       string `json:"state"`
+	AgeSeconds  int64  `json:"age_seconds"`
+	CellId      string `json:"cell_id,omitempty"`
+}
+
+type StagingListResponse struct {
+	Stagings []StagingSummary `json:"stagings"`
+	Total    int              `json:"total"`
+	Page     int              `json:"page"`
+	PerPage  int              `json:"per_page"`
+}
+
+type StatusHandler interface {
+	StagingStatus(resp http.ResponseWriter, req *http.Request)
+	ListStagings(resp http.ResponseWriter, req *http.Request)
+}
+
+type statusHandler struct {
+	logger      lager.Logger
+	backends    map[string]backend.Backend
+	diegoClient receptor.Client
+	queue       *queue.Queue
+	clock       clock.Clock
+}
+
+// NewStagingStatusHandler returns a handler for the status of stagings. When
+// stagingQueue is not nil, the stagings waiting in it are reported as
+// queue.StateQueued.
+func NewStagingStatusHandler(logger lager.Logger, backends map[string]backend.Backend, diegoClient receptor.Client, stagingQueue *queue.Queue, clock clock.Clock) StatusHandler {
+	return &statusHandler{
+		logger:      logger.Session("status-handler"),
+		backends:    backends,
+		diegoClient: diegoClient,
+		queue:       stagingQueue,
+		clock:       clock,
+	}
+}
+
+func (handler *statusHandler) StagingStatus(resp http.ResponseWriter, req *http.Request) {
+	taskGuid := req.FormValue(":staging_guid")
+	logger := handler.logger.Session("staging-status-request", lager.Data{"staging-guid": taskGuid})
+
+	if handler.queue != nil {
+		if queued, ok := handler.queue.Get(taskGuid); ok {
+			handler.writeJSON(logger, resp, StagingStatusResponse{
+				StagingGuid:   taskGuid,
+				AppId:         queued.AppId,
+				Lifecycle:     queued.Staging.Lifecycle,
+				State:         queue.StateQueued,
+				Priority:      queued.Priority,
+				QueuePosition: queued.Position,
+				QueuedSeconds: int64(handler.clock.Now().Sub(queued.EnqueuedAt) / time.Second),
+			})
+			return
+		}
+	}
+
+	task, err := handler.diegoClient.GetTask(taskGuid)
+	if err != nil {
+		if receptorErr, ok := err.(receptor.Error); ok {
+			if receptorErr.Type == receptor.TaskNotFound {
+				resp.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+
+		logger.Error("failed-to-get-task", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if task.Domain != backend.StagingTaskDomain {
+		logger.Info("not-a-staging-task", lager.Data{"domain": task.Domain})
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var annotation backend.StagingTaskAnnotation
+	err = json.Unmarshal([]byte(task.Annotation), &annotation)
+	if err != nil {
+		logger.Error("failed-to-unmarshal-task-annotation", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := StagingStatusResponse{
+		StagingGuid:   task.TaskGuid,
+		AppId:         annotation.AppId,
+		Lifecycle:     annotation.Lifecycle,
+		State:         task.State,
+		Failed:        task.Failed,
+		FailureReason: task.FailureReason,
+	}
+
+	if task.State == receptor.TaskStateCompleted || task.State == receptor.TaskStateResolving {
+		status.StagingResponse = handler.stagingResponse(logger, annotation.Lifecycle, task)
+	}
+
+	handler.writeJSON(logger, resp, status)
+}
+
+func (handler *statusHandler) ListStagings(resp http.ResponseWriter, req *http.Request) {
+	logger := handler.logger.Session("list-stagings-request")
+
+	page, err := positiveIntParam(req, "page", 1)
+	if err != nil {
+		logger.Error("invalid-page", err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	perPage, err := positiveIntParam(req, "per_page", DefaultStagingsPerPage)
+	if err != nil {
+		logger.Error("invalid-per-page", err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if perPage > MaxStagingsPerPage {
+		perPage = MaxStagingsPerPage
+	}
+
+	tasks, err := handler.diegoClient.TasksByDomain(backend.StagingTaskDomain)
+	if err != nil {
+		logger.Error("failed-to-get-tasks", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sort.Sort(byCreatedAt(tasks))
+
+	lifecycleFilter := req.FormValue("lifecycle")
+	stateFilter := req.FormValue("state")
+	appIdFilter := req.FormValue("app_id")
+
+	now := handler.clock.Now()
+	summaries := []StagingSummary{}
+
+	if handler.queue != nil {
+		for _, queued := range handler.queue.List() {
+			if lifecycleFilter != "" && queued.Staging.Lifecycle != lifecycleFilter {
+				continue
+			}
+
+			if stateFilter != "" && queue.StateQueued != stateFilter {
+				continue
+			}
+
+			if appIdFilter != "" && queued.AppId != appIdFilter {
+				continue
+			}
+
+			summaries = append(summaries, StagingSummary{
+				StagingGuid: queued.Staging.Guid,
+				AppId:       queued.AppId,
+				Lifecycle:   queued.Staging.Lifecycle,
+				Stack:       queued.Stack,
+				State:       queue.StateQueued,
+				AgeSeconds:  int64(now.Sub(queued.EnqueuedAt) / time.Second),
+			})
+		}
+	}
+
+	for _, task := range tasks {
+		var annotation backend.StagingTaskAnnotation
+		err := json.Unmarshal([]byte(task.Annotation), &annotation)
+		if err != nil {
+			logger.Error("failed-to-unmarshal-task-annotation", err, lager.Data{"task-guid": task.TaskGuid})
+			continue
+		}
+
+		if lifecycleFilter != "" && annotation.Lifecycle != lifecycleFilter {
+			continue
+		}
+
+		if stateFilter != "" && task.State != stateFilter {
+			continue
+		}
+
+		if appIdFilter != "" && annotation.AppId != appIdFilter {
+			continue
+		}
+
+		summaries = append(summaries, StagingSummary{
+			StagingGuid: task.TaskGuid,
+			AppId:       annotation.AppId,
+			Lifecycle:   annotation.Lifecycle,
+			Stack:       task.Stack,
+			State:       task.State,
+			AgeSeconds:  int64(now.Sub(time.Unix(0, task.CreatedAt)) / time.Second),
+			CellId:      task.CellID,
+		})
+	}
+
+	response := StagingListResponse{
+		Stagings: []StagingSummary{},
+		Total:    len(summaries),
+		Page:     page,
+		PerPage:  perPage,
+	}
+
+	// Pages past the end are empty. Checking before multiplying keeps a huge
+	// page from overflowing into a negative index.
+	pages := (len(summaries) + perPage - 1) / perPage
+	if page <= pages {
+		start := (page - 1) * perPage
+		end := start + perPage
+		if end > len(summaries) {
+			end = len(summaries)
+		}
+		response.Stagings = summaries[start:end]
+	}
+
+	handler.writeJSON(logger, resp, response)
+}
+
+func (handler *statusHandler) writeJSON(logger lager.Logger, resp http.ResponseWriter, body interface{}) {
+	responseJson, err := json.Marshal(body)
+	if err != nil {
+		logger.Error("failed-to-marshal-response", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(responseJson)
+}
+
+func (handler *statusHandler) stagingResponse(logger lager.Logger, lifecycle string, task receptor.TaskResponse) *cc_messages.StagingResponseForCC {
+	backend := handler.backends[lifecycle]
+	if backend == nil {
+		logger.Info("backend-not-found", lager.Data{"backend": lifecycle})
+		return nil
+	}
+
+	response, err := backend.BuildStagingResponse(task)
+	if err != nil {
+		logger.Error("get-staging-response-failed", err)
+		return nil
+	}
+
+	return &response
+}
+
+func positiveIntParam(req *http.Request, name string, defaultValue int) (int, error) {
+	value := req.FormValue(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 1 {
+		return 0, fmt.Errorf("%s must be positive, got %d", name, n)
+	}
+
+	return n, nil
+}
+
+type byCreatedAt []receptor.TaskResponse
+
+func (t byCreatedAt) Len() int      { return len(t) }
+func (t byCreatedAt) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byCreatedAt) Less(i, j int) bool {
+	if t[i].CreatedAt == t[j].CreatedAt {
+		return t[i].TaskGuid < t[j].TaskGuid
+	}
+	return t[i].CreatedAt < t[j].CreatedAt
+}
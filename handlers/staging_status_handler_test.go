@@ -0,0 +1,401 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/receptor/fake_receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/backend/fake_backend"
+	"github.com/cloudfoundry-incubator/stager/handlers"
+	fake_metrics "github.com/cloudfoundry-incubator/stager/metrics/fakes"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/queue"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/rata"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StagingStatusHandler", func() {
+	var (
+		fakeDiegoClient *fake_receptor.FakeClient
+		fakeBackend     *fake_backend.FakeBackend
+		fakeClock       *fakeclock.FakeClock
+		stagingQueue    *queue.Queue
+
+		responseRecorder *httptest.ResponseRecorder
+		rataHandler      http.Handler
+	)
+
+	BeforeEach(func() {
+		fakeDiegoClient = &fake_receptor.FakeClient{}
+		fakeBackend = &fake_backend.FakeBackend{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		stagingQueue = queue.New(10, time.Minute, time.Second, outbox.NewMemoryOutbox(), &fake_metrics.FakeEmitter{}, fakeClock)
+
+		responseRecorder = httptest.NewRecorder()
+		handler := handlers.NewStagingStatusHandler(lagertest.NewTestLogger("test"), map[string]backend.Backend{"fake-backend": fakeBackend}, fakeDiegoClient, stagingQueue, fakeClock)
+
+		var routes rata.Routes
+		for _, r := range stager.Routes {
+			if r.Name == stager.StagingStatusRoute || r.Name == stager.ListStagingsRoute {
+				routes = append(routes, r)
+			}
+		}
+
+		var err error
+		rataHandler, err = rata.NewRouter(routes, rata.Handlers{
+			stager.StagingStatusRoute: http.HandlerFunc(handler.StagingStatus),
+			stager.ListStagingsRoute:  http.HandlerFunc(handler.ListStagings),
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	Describe("StagingStatus", func() {
+		var status handlers.StagingStatusResponse
+
+		JustBeforeEach(func() {
+			req, err := http.NewRequest("GET", "/v1/staging/a-staging-guid", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			rataHandler.ServeHTTP(responseRecorder, req)
+
+			status = handlers.StagingStatusResponse{}
+			if responseRecorder.Code == http.StatusOK {
+				err = json.NewDecoder(responseRecorder.Body).Decode(&status)
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		})
+
+		It("retrieves the staging task by guid", func() {
+			Ω(fakeDiegoClient.GetTaskCallCount()).Should(Equal(1))
+			Ω(fakeDiegoClient.GetTaskArgsForCall(0)).Should(Equal("a-staging-guid"))
+		})
+
+		Context("when the staging task is running", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.GetTaskReturns(receptor.TaskResponse{
+					TaskGuid:   "a-staging-guid",
+					Domain:     backend.StagingTaskDomain,
+					State:      receptor.TaskStateRunning,
+					Annotation: `{"lifecycle": "fake-backend", "app_id": "an-app-id"}`,
+				}, nil)
+			})
+
+			It("returns the lifecycle and state of the task", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusOK))
+				Ω(status).Should(Equal(handlers.StagingStatusResponse{
+					StagingGuid: "a-staging-guid",
+					AppId:       "an-app-id",
+					Lifecycle:   "fake-backend",
+					State:       receptor.TaskStateRunning,
+				}))
+			})
+
+			It("does not build a staging response", func() {
+				Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(0))
+			})
+		})
+
+		Context("when the staging task has completed", func() {
+			var task receptor.TaskResponse
+
+			BeforeEach(func() {
+				task = receptor.TaskResponse{
+					TaskGuid:      "a-staging-guid",
+					Domain:        backend.StagingTaskDomain,
+					State:         receptor.TaskStateCompleted,
+					Failed:        true,
+					FailureReason: "out of memory",
+					Annotation:    `{"lifecycle": "fake-backend"}`,
+				}
+				fakeDiegoClient.GetTaskReturns(task, nil)
+
+				fakeBackend.BuildStagingResponseReturns(cc_messages.StagingResponseForCC{
+					Error: &cc_messages.StagingError{Id: "StagingError", Message: "staging failed"},
+				}, nil)
+			})
+
+			It("builds the staging response from the task", func() {
+				Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(1))
+				Ω(fakeBackend.BuildStagingResponseArgsForCall(0)).Should(Equal(task))
+			})
+
+			It("returns the failure reason and the response for the CC", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusOK))
+				Ω(status.Failed).Should(BeTrue())
+				Ω(status.FailureReason).Should(Equal("out of memory"))
+				Ω(status.StagingResponse).ShouldNot(BeNil())
+				Ω(status.StagingResponse.Error.Message).Should(Equal("staging failed"))
+			})
+
+			Context("when the staging response cannot be built", func() {
+				BeforeEach(func() {
+					fakeBackend.BuildStagingResponseReturns(cc_messages.StagingResponseForCC{}, errors.New("bad result"))
+				})
+
+				It("returns the status without a staging response", func() {
+					Ω(responseRecorder.Code).Should(Equal(http.StatusOK))
+					Ω(status.State).Should(Equal(receptor.TaskStateCompleted))
+					Ω(status.StagingResponse).Should(BeNil())
+				})
+			})
+		})
+
+		Context("when the staging is queued", func() {
+			BeforeEach(func() {
+				err := stagingQueue.Push(queue.Item{
+					Staging:  admission.Staging{Guid: "another-staging-guid", Lifecycle: "fake-backend"},
+					Priority: 5,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = stagingQueue.Push(queue.Item{
+					Staging:  admission.Staging{Guid: "a-staging-guid", Lifecycle: "fake-backend"},
+					AppId:    "myapp",
+					Priority: 1,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				fakeClock.Increment(30 * time.Second)
+			})
+
+			It("returns its place in the queue without asking Diego", func() {
+				Ω(fakeDiegoClient.GetTaskCallCount()).Should(BeZero())
+				Ω(status).Should(Equal(handlers.StagingStatusResponse{
+					StagingGuid:   "a-staging-guid",
+					AppId:         "myapp",
+					Lifecycle:     "fake-backend",
+					State:         queue.StateQueued,
+					Priority:      1,
+					QueuePosition: 2,
+					QueuedSeconds: 30,
+				}))
+			})
+		})
+
+		Context("when the staging task is not found", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.GetTaskReturns(receptor.TaskResponse{}, receptor.Error{Type: receptor.TaskNotFound})
+			})
+
+			It("returns StatusNotFound", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("when retrieving the task fails", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.GetTaskReturns(receptor.TaskResponse{}, errors.New("boom"))
+			})
+
+			It("returns StatusInternalServerError", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusInternalServerError))
+			})
+		})
+
+		Context("when the task annotation fails to unmarshal", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.GetTaskReturns(receptor.TaskResponse{
+					TaskGuid:   "a-staging-guid",
+					Domain:     backend.StagingTaskDomain,
+					Annotation: `,"lifecycle}`,
+				}, nil)
+			})
+
+			It("returns StatusInternalServerError", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusInternalServerError))
+			})
+		})
+
+		Context("when the task is not a staging task", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.GetTaskReturns(receptor.TaskResponse{
+					TaskGuid:   "a-staging-guid",
+					Domain:     "some-other-domain",
+					State:      receptor.TaskStateRunning,
+					Annotation: `{"lifecycle": "fake-backend"}`,
+				}, nil)
+			})
+
+			It("returns StatusNotFound", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusNotFound))
+			})
+		})
+	})
+
+	Describe("ListStagings", func() {
+		var (
+			query    string
+			response handlers.StagingListResponse
+		)
+
+		BeforeEach(func() {
+			query = ""
+
+			now := fakeClock.Now()
+			fakeDiegoClient.TasksByDomainReturns([]receptor.TaskResponse{
+				{
+					TaskGuid:   "guid-2",
+					Stack:      "lucid64",
+					State:      receptor.TaskStatePending,
+					CreatedAt:  now.Add(-10 * time.Second).UnixNano(),
+					Annotation: `{"lifecycle": "docker", "app_id": "app-2"}`,
+				},
+				{
+					TaskGuid:   "guid-1",
+					Stack:      "lucid64",
+					State:      receptor.TaskStateRunning,
+					CellID:     "cell-1",
+					CreatedAt:  now.Add(-time.Minute).UnixNano(),
+					Annotation: `{"lifecycle": "buildpack", "app_id": "app-1"}`,
+				},
+				{
+					TaskGuid:   "guid-3",
+					Stack:      "cflinuxfs2",
+					State:      receptor.TaskStateRunning,
+					CellID:     "cell-2",
+					CreatedAt:  now.UnixNano(),
+					Annotation: `{"lifecycle": "buildpack", "app_id": "app-1"}`,
+				},
+				{
+					TaskGuid:   "guid-bogus",
+					Annotation: `bogus`,
+				},
+			}, nil)
+		})
+
+		JustBeforeEach(func() {
+			req, err := http.NewRequest("GET", "/v1/staging"+query, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			rataHandler.ServeHTTP(responseRecorder, req)
+
+			response = handlers.StagingListResponse{}
+			if responseRecorder.Code == http.StatusOK {
+				err = json.NewDecoder(responseRecorder.Body).Decode(&response)
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		})
+
+		It("lists the tasks in the staging domain", func() {
+			Ω(fakeDiegoClient.TasksByDomainCallCount()).Should(Equal(1))
+			Ω(fakeDiegoClient.TasksByDomainArgsForCall(0)).Should(Equal(backend.StagingTaskDomain))
+		})
+
+		It("returns the stagings oldest first, skipping tasks with invalid annotations", func() {
+			Ω(responseRecorder.Code).Should(Equal(http.StatusOK))
+			Ω(response).Should(Equal(handlers.StagingListResponse{
+				Stagings: []handlers.StagingSummary{
+					{StagingGuid: "guid-1", AppId: "app-1", Lifecycle: "buildpack", Stack: "lucid64", State: receptor.TaskStateRunning, AgeSeconds: 60, CellId: "cell-1"},
+					{StagingGuid: "guid-2", AppId: "app-2", Lifecycle: "docker", Stack: "lucid64", State: receptor.TaskStatePending, AgeSeconds: 10},
+					{StagingGuid: "guid-3", AppId: "app-1", Lifecycle: "buildpack", Stack: "cflinuxfs2", State: receptor.TaskStateRunning, AgeSeconds: 0, CellId: "cell-2"},
+				},
+				Total:   3,
+				Page:    1,
+				PerPage: handlers.DefaultStagingsPerPage,
+			}))
+		})
+
+		Context("when filtering", func() {
+			BeforeEach(func() {
+				query = "?lifecycle=buildpack&state=RUNNING&app_id=app-1"
+			})
+
+			It("returns only the matching stagings", func() {
+				Ω(response.Total).Should(Equal(2))
+				Ω(response.Stagings).Should(HaveLen(2))
+				Ω(response.Stagings[0].StagingGuid).Should(Equal("guid-1"))
+				Ω(response.Stagings[1].StagingGuid).Should(Equal("guid-3"))
+			})
+		})
+
+		Context("when stagings are queued", func() {
+			BeforeEach(func() {
+				err := stagingQueue.Push(queue.Item{
+					Staging: admission.Staging{Guid: "queued-guid", Lifecycle: "buildpack"},
+					AppId:   "app-1",
+					Stack:   "cflinuxfs2",
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				fakeClock.Increment(5 * time.Second)
+				query = "?state=QUEUED"
+			})
+
+			It("lists them as queued", func() {
+				Ω(response.Stagings).Should(Equal([]handlers.StagingSummary{
+					{StagingGuid: "queued-guid", AppId: "app-1", Lifecycle: "buildpack", Stack: "cflinuxfs2", State: queue.StateQueued, AgeSeconds: 5},
+				}))
+			})
+		})
+
+		Context("when paging", func() {
+			BeforeEach(func() {
+				query = "?page=2&per_page=2"
+			})
+
+			It("returns the requested page", func() {
+				Ω(response.Total).Should(Equal(3))
+				Ω(response.Page).Should(Equal(2))
+				Ω(response.PerPage).Should(Equal(2))
+				Ω(response.Stagings).Should(HaveLen(1))
+				Ω(response.Stagings[0].StagingGuid).Should(Equal("guid-3"))
+			})
+		})
+
+		Context("when the page is past the end", func() {
+			BeforeEach(func() {
+				query = "?page=5"
+			})
+
+			It("returns an empty page", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusOK))
+				Ω(response.Total).Should(Equal(3))
+				Ω(response.Stagings).Should(BeEmpty())
+			})
+		})
+
+		Context("when the page is too large to multiply by the page size", func() {
+			BeforeEach(func() {
+				query = "?page=9223372036854775807"
+			})
+
+			It("returns an empty page", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusOK))
+				Ω(response.Total).Should(Equal(3))
+				Ω(response.Stagings).Should(BeEmpty())
+			})
+		})
+
+		Context("when the paging parameters are invalid", func() {
+			BeforeEach(func() {
+				query = "?per_page=0"
+			})
+
+			It("returns StatusBadRequest", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("when listing the tasks fails", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.TasksByDomainReturns(nil, errors.New("boom"))
+			})
+
+			It("returns StatusInternalServerError", func() {
+				Ω(responseRecorder.Code).Should(Equal(http.StatusInternalServerError))
+			})
+		})
+	})
+})
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/runtime-schema/metric"
+)
+
+type dropsondeEmitter struct{}
+
+// NewDropsondeEmitter returns an Emitter that sends metrics through the
+// dropsonde metrics sender. Dropsonde metrics cannot be labelled, so counters
+// and durations are sent both as is and split by name, e.g.
+// StagingRequestsFailed.docker.cflinuxfs2.InsufficientResources. Gauges are
+// only sent split by name, as their per-lifecycle values do not add up to a
+// total.
+func NewDropsondeEmitter() Emitter {
+	return dropsondeEmitter{}
+}
+
+func (dropsondeEmitter) IncrementCounter(name string, labels Labels) {
+	metric.Counter(name).Increment()
+	if split, ok := splitName(name, labels); ok {
+		metric.Counter(split).Increment()
+	}
+}
+
+func (dropsondeEmitter) ObserveDuration(name string, duration time.Duration, labels Labels) {
+	metric.Duration(name).Send(duration)
+	if split, ok := splitName(name, labels); ok {
+		metric.Duration(split).Send(duration)
+	}
+}
+
+func (dropsondeEmitter) SetGauge(name string, value int, labels Labels) {
+	if split, ok := splitName(name, labels); ok {
+		name = split
+	}
+	metric.Metric(name).Send(value)
+}
+
+func splitName(name string, labels Labels) (string, bool) {
+	if labels.Lifecycle == "" {
+		return name, false
+	}
+
+	parts := []string{name, labels.Lifecycle}
+	if labels.Stack != "" {
+		parts = append(parts, labels.Stack)
+	}
+	if labels.FailureCategory != "" {
+		parts = append(parts, labels.FailureCategory)
+	}
+
+	return strings.Join(parts, "."), true
+}
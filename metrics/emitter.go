@@ -0,0 +1,59 @@
+package metrics
+
+import "time"
+
+// Names of the metrics emitted by the stager.
+const (
+	StagingStartRequestsReceived    = "StagingStartRequestsReceived"
+	StagingStopRequestsReceived     = "StagingStopRequestsReceived"
+	StagingRequestsRejected         = "StagingRequestsRejected"
+	StagingRequestsSucceeded        = "StagingRequestsSucceeded"
+	StagingRequestSucceededDuration = "StagingRequestSucceededDuration"
+	StagingRequestsFailed           = "StagingRequestsFailed"
+	StagingRequestFailedDuration    = "StagingRequestFailedDuration"
+	StagingTasksDeleted             = "StagingTasksDeleted"
+	StagingTasksReconciled          = "StagingTasksReconciled"
+	StagingsInFlight                = "StagingsInFlight"
+	StagingQueueDepth               = "StagingQueueDepth"
+	StagingQueueWaitDuration        = "StagingQueueWaitDuration"
+)
+
+// Labels describe the staging a metric is about. Emitters that cannot label
+// metrics ignore them; fields that do not apply are left empty.
+type Labels struct {
+	Lifecycle       string
+	Stack           string
+	FailureCategory string
+}
+
+//go:generate counterfeiter -o fakes/fake_emitter.go . Emitter
+type Emitter interface {
+	IncrementCounter(name string, labels Labels)
+	ObserveDuration(name string, duration time.Duration, labels Labels)
+	SetGauge(name string, value int, labels Labels)
+}
+
+type fanOut []Emitter
+
+// NewFanOut returns an Emitter that emits every metric to all of emitters.
+func NewFanOut(emitters ...Emitter) Emitter {
+	return fanOut(emitters)
+}
+
+func (emitters fanOut) IncrementCounter(name string, labels Labels) {
+	for _, emitter := range emitters {
+		emitter.IncrementCounter(name, labels)
+	}
+}
+
+func (emitters fanOut) ObserveDuration(name string, duration time.Duration, labels Labels) {
+	for _, emitter := range emitters {
+		emitter.ObserveDuration(name, duration, labels)
+	}
+}
+
+func (emitters fanOut) SetGauge(name string, value int, labels Labels) {
+	for _, emitter := range emitters {
+		emitter.SetGauge(name, value, labels)
+	}
+}
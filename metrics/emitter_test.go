@@ -0,0 +1,110 @@
+package metrics_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/metrics/fakes"
+	"github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	dropsonde_metrics "github.com/cloudfoundry/dropsonde/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Emitters", func() {
+	labels := metrics.Labels{Lifecycle: "buildpack", Stack: "cflinuxfs2"}
+
+	Describe("NewFanOut", func() {
+		var first, second *fakes.FakeEmitter
+		var emitter metrics.Emitter
+
+		BeforeEach(func() {
+			first = &fakes.FakeEmitter{}
+			second = &fakes.FakeEmitter{}
+			emitter = metrics.NewFanOut(first, second)
+		})
+
+		It("increments counters on every emitter", func() {
+			emitter.IncrementCounter(metrics.StagingStartRequestsReceived, labels)
+
+			for _, fakeEmitter := range []*fakes.FakeEmitter{first, second} {
+				Ω(fakeEmitter.IncrementCounterCallCount()).Should(Equal(1))
+				name, emittedLabels := fakeEmitter.IncrementCounterArgsForCall(0)
+				Ω(name).Should(Equal(metrics.StagingStartRequestsReceived))
+				Ω(emittedLabels).Should(Equal(labels))
+			}
+		})
+
+		It("observes durations on every emitter", func() {
+			emitter.ObserveDuration(metrics.StagingRequestSucceededDuration, time.Second, labels)
+
+			for _, fakeEmitter := range []*fakes.FakeEmitter{first, second} {
+				Ω(fakeEmitter.ObserveDurationCallCount()).Should(Equal(1))
+				name, duration, emittedLabels := fakeEmitter.ObserveDurationArgsForCall(0)
+				Ω(name).Should(Equal(metrics.StagingRequestSucceededDuration))
+				Ω(duration).Should(Equal(time.Second))
+				Ω(emittedLabels).Should(Equal(labels))
+			}
+		})
+
+		It("sets gauges on every emitter", func() {
+			emitter.SetGauge(metrics.StagingsInFlight, 2, labels)
+
+			for _, fakeEmitter := range []*fakes.FakeEmitter{first, second} {
+				Ω(fakeEmitter.SetGaugeCallCount()).Should(Equal(1))
+				name, value, emittedLabels := fakeEmitter.SetGaugeArgsForCall(0)
+				Ω(name).Should(Equal(metrics.StagingsInFlight))
+				Ω(value).Should(Equal(2))
+				Ω(emittedLabels).Should(Equal(labels))
+			}
+		})
+	})
+
+	Describe("NewDropsondeEmitter", func() {
+		var sender *fake.FakeMetricSender
+
+		BeforeEach(func() {
+			sender = fake.NewFakeMetricSender()
+			dropsonde_metrics.Initialize(sender)
+		})
+
+		It("sends counters and durations through dropsonde", func() {
+			emitter := metrics.NewDropsondeEmitter()
+			emitter.IncrementCounter(metrics.StagingRequestsSucceeded, labels)
+			emitter.ObserveDuration(metrics.StagingRequestSucceededDuration, time.Second, labels)
+
+			Ω(sender.GetCounter("StagingRequestsSucceeded")).Should(BeEquivalentTo(1))
+			Ω(sender.GetValue("StagingRequestSucceededDuration")).Should(Equal(fake.Metric{
+				Value: float64(time.Second),
+				Unit:  "nanos",
+			}))
+		})
+
+		It("also sends counters and durations split by lifecycle, stack and failure category", func() {
+			emitter := metrics.NewDropsondeEmitter()
+			failureLabels := metrics.Labels{Lifecycle: "docker", Stack: "cflinuxfs2", FailureCategory: "InsufficientResources"}
+			emitter.IncrementCounter(metrics.StagingRequestsFailed, failureLabels)
+			emitter.ObserveDuration(metrics.StagingRequestFailedDuration, time.Second, failureLabels)
+
+			Ω(sender.GetCounter("StagingRequestsFailed")).Should(BeEquivalentTo(1))
+			Ω(sender.GetCounter("StagingRequestsFailed.docker.cflinuxfs2.InsufficientResources")).Should(BeEquivalentTo(1))
+			Ω(sender.GetValue("StagingRequestFailedDuration.docker.cflinuxfs2.InsufficientResources").Value).Should(Equal(float64(time.Second)))
+		})
+
+		It("does not split unlabelled metrics", func() {
+			emitter := metrics.NewDropsondeEmitter()
+			emitter.IncrementCounter(metrics.StagingTasksDeleted, metrics.Labels{})
+
+			Ω(sender.GetCounter("StagingTasksDeleted")).Should(BeEquivalentTo(1))
+		})
+
+		It("sends gauges split by lifecycle only", func() {
+			emitter := metrics.NewDropsondeEmitter()
+			emitter.SetGauge(metrics.StagingsInFlight, 3, metrics.Labels{Lifecycle: "docker"})
+
+			Ω(sender.GetValue("StagingsInFlight.docker").Value).Should(BeEquivalentTo(3))
+			Ω(sender.GetValue("StagingsInFlight").Value).Should(BeEquivalentTo(0))
+		})
+	})
+})
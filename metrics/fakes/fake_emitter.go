@@ -0,0 +1,108 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/metrics"
+)
+
+type FakeEmitter struct {
+	IncrementCounterStub        func(name string, labels metrics.Labels)
+	incrementCounterMutex       sync.RWMutex
+	incrementCounterArgsForCall []struct {
+		name   string
+		labels metrics.Labels
+	}
+	ObserveDurationStub        func(name string, duration time.Duration, labels metrics.Labels)
+	observeDurationMutex       sync.RWMutex
+	observeDurationArgsForCall []struct {
+		name     string
+		duration time.Duration
+		labels   metrics.Labels
+	}
+	SetGaugeStub        func(name string, value int, labels metrics.Labels)
+	setGaugeMutex       sync.RWMutex
+	setGaugeArgsForCall []struct {
+		name   string
+		value  int
+		labels metrics.Labels
+	}
+}
+
+func (fake *FakeEmitter) IncrementCounter(name string, labels metrics.Labels) {
+	fake.incrementCounterMutex.Lock()
+	fake.incrementCounterArgsForCall = append(fake.incrementCounterArgsForCall, struct {
+		name   string
+		labels metrics.Labels
+	}{name, labels})
+	fake.incrementCounterMutex.Unlock()
+	if fake.IncrementCounterStub != nil {
+		fake.IncrementCounterStub(name, labels)
+	}
+}
+
+func (fake *FakeEmitter) IncrementCounterCallCount() int {
+	fake.incrementCounterMutex.RLock()
+	defer fake.incrementCounterMutex.RUnlock()
+	return len(fake.incrementCounterArgsForCall)
+}
+
+func (fake *FakeEmitter) IncrementCounterArgsForCall(i int) (string, metrics.Labels) {
+	fake.incrementCounterMutex.RLock()
+	defer fake.incrementCounterMutex.RUnlock()
+	return fake.incrementCounterArgsForCall[i].name, fake.incrementCounterArgsForCall[i].labels
+}
+
+func (fake *FakeEmitter) ObserveDuration(name string, duration time.Duration, labels metrics.Labels) {
+	fake.observeDurationMutex.Lock()
+	fake.observeDurationArgsForCall = append(fake.observeDurationArgsForCall, struct {
+		name     string
+		duration time.Duration
+		labels   metrics.Labels
+	}{name, duration, labels})
+	fake.observeDurationMutex.Unlock()
+	if fake.ObserveDurationStub != nil {
+		fake.ObserveDurationStub(name, duration, labels)
+	}
+}
+
+func (fake *FakeEmitter) ObserveDurationCallCount() int {
+	fake.observeDurationMutex.RLock()
+	defer fake.observeDurationMutex.RUnlock()
+	return len(fake.observeDurationArgsForCall)
+}
+
+func (fake *FakeEmitter) ObserveDurationArgsForCall(i int) (string, time.Duration, metrics.Labels) {
+	fake.observeDurationMutex.RLock()
+	defer fake.observeDurationMutex.RUnlock()
+	return fake.observeDurationArgsForCall[i].name, fake.observeDurationArgsForCall[i].duration, fake.observeDurationArgsForCall[i].labels
+}
+
+func (fake *FakeEmitter) SetGauge(name string, value int, labels metrics.Labels) {
+	fake.setGaugeMutex.Lock()
+	fake.setGaugeArgsForCall = append(fake.setGaugeArgsForCall, struct {
+		name   string
+		value  int
+		labels metrics.Labels
+	}{name, value, labels})
+	fake.setGaugeMutex.Unlock()
+	if fake.SetGaugeStub != nil {
+		fake.SetGaugeStub(name, value, labels)
+	}
+}
+
+func (fake *FakeEmitter) SetGaugeCallCount() int {
+	fake.setGaugeMutex.RLock()
+	defer fake.setGaugeMutex.RUnlock()
+	return len(fake.setGaugeArgsForCall)
+}
+
+func (fake *FakeEmitter) SetGaugeArgsForCall(i int) (string, int, metrics.Labels) {
+	fake.setGaugeMutex.RLock()
+	defer fake.setGaugeMutex.RUnlock()
+	return fake.setGaugeArgsForCall[i].name, fake.setGaugeArgsForCall[i].value, fake.setGaugeArgsForCall[i].labels
+}
+
+var _ metrics.Emitter = new(FakeEmitter)
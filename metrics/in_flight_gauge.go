@@ -0,0 +1,40 @@
+package metrics
+
+import "sync"
+
+// InFlightCounter counts the stagings in flight per lifecycle. It is
+// implemented by the admission controller, which tracks the stagings from the
+// staging request until Diego calls back.
+type InFlightCounter interface {
+	InFlightByLifecycle() map[string]int
+}
+
+// InFlightGauge reports the counts of an InFlightCounter as the
+// StagingsInFlight gauge, per lifecycle. It keeps no count of its own, so it
+// cannot drift from the counts admission is decided on.
+type InFlightGauge struct {
+	emitter Emitter
+	counter InFlightCounter
+
+	lock sync.Mutex
+}
+
+func NewInFlightGauge(emitter Emitter, counter InFlightCounter) *InFlightGauge {
+	return &InFlightGauge{
+		emitter: emitter,
+		counter: counter,
+	}
+}
+
+// Update reports the current count of every lifecycle that has had stagings
+// in flight. It is called whenever stagings may have started or finished.
+func (g *InFlightGauge) Update() {
+	// Concurrent updates are serialized so that an older count is never
+	// reported after a newer one.
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for lifecycle, count := range g.counter.InFlightByLifecycle() {
+		g.emitter.SetGauge(StagingsInFlight, count, Labels{Lifecycle: lifecycle})
+	}
+}
@@ -0,0 +1,63 @@
+package metrics_test
+
+import (
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/metrics/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("InFlightGauge", func() {
+	var (
+		fakeEmitter *fakes.FakeEmitter
+		controller  *admission.Controller
+		gauge       *metrics.InFlightGauge
+	)
+
+	gauges := func() map[string]int {
+		values := map[string]int{}
+		for i := 0; i < fakeEmitter.SetGaugeCallCount(); i++ {
+			name, value, labels := fakeEmitter.SetGaugeArgsForCall(i)
+			Ω(name).Should(Equal(metrics.StagingsInFlight))
+			values[labels.Lifecycle] = value
+		}
+		return values
+	}
+
+	admit := func(stagingGuid, lifecycle string) {
+		_, err := controller.Admit(admission.Staging{Guid: stagingGuid, Lifecycle: lifecycle})
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		fakeEmitter = &fakes.FakeEmitter{}
+		controller = admission.NewController(admission.Limits{}, admission.DefaultRetryAfter)
+		gauge = metrics.NewInFlightGauge(fakeEmitter, controller)
+	})
+
+	It("reports the stagings in flight per lifecycle", func() {
+		admit("guid-1", "buildpack")
+		admit("guid-2", "buildpack")
+		admit("guid-3", "docker")
+
+		gauge.Update()
+		Ω(gauges()).Should(Equal(map[string]int{"buildpack": 2, "docker": 1}))
+	})
+
+	It("reports lifecycles whose stagings have all finished as zero", func() {
+		admit("guid-1", "buildpack")
+		gauge.Update()
+
+		controller.Release("guid-1")
+		gauge.Update()
+
+		Ω(gauges()).Should(Equal(map[string]int{"buildpack": 0}))
+	})
+
+	It("reports nothing before any staging is in flight", func() {
+		gauge.Update()
+		Ω(fakeEmitter.SetGaugeCallCount()).Should(Equal(0))
+	})
+})
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const prometheusNamespace = "stager"
+
+var prometheusLabelNames = []string{"lifecycle", "stack", "failure_category"}
+
+// StagingDurationBuckets cover stagings from a few seconds up to the default
+// staging timeout.
+var StagingDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 900, 1800}
+
+// PrometheusEmitter keeps metrics in a Prometheus registry, to be scraped
+// through Handler. Counters become "stager_<name>_total", durations become
+// "stager_<name>_seconds" histograms and gauges become "stager_<name>", e.g.
+// StagingRequestFailedDuration is exported as
+// stager_staging_request_failed_duration_seconds.
+type PrometheusEmitter struct {
+	registry *prometheus.Registry
+
+	lock       sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	histograms map[string]*prometheus.HistogramVec
+	gauges     map[string]*prometheus.GaugeVec
+}
+
+func NewPrometheusEmitter() *PrometheusEmitter {
+	return &PrometheusEmitter{
+		registry:   prometheus.NewRegistry(),
+		counters:   make(map[string]*prometheus.CounterVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (e *PrometheusEmitter) Handler() http.Handler {
+	return promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{})
+}
+
+func (e *PrometheusEmitter) IncrementCounter(name string, labels Labels) {
+	e.counter(name).WithLabelValues(labelValues(labels)...).Inc()
+}
+
+func (e *PrometheusEmitter) ObserveDuration(name string, duration time.Duration, labels Labels) {
+	e.histogram(name).WithLabelValues(labelValues(labels)...).Observe(duration.Seconds())
+}
+
+func (e *PrometheusEmitter) SetGauge(name string, value int, labels Labels) {
+	e.gauge(name).WithLabelValues(labelValues(labels)...).Set(float64(value))
+}
+
+func (e *PrometheusEmitter) counter(name string) *prometheus.CounterVec {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	counter, ok := e.counters[name]
+	if !ok {
+		counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      snakeCase(name) + "_total",
+			Help:      name,
+		}, prometheusLabelNames)
+		e.registry.MustRegister(counter)
+		e.counters[name] = counter
+	}
+
+	return counter
+}
+
+func (e *PrometheusEmitter) histogram(name string) *prometheus.HistogramVec {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	histogram, ok := e.histograms[name]
+	if !ok {
+		histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      snakeCase(name) + "_seconds",
+			Help:      name,
+			Buckets:   StagingDurationBuckets,
+		}, prometheusLabelNames)
+		e.registry.MustRegister(histogram)
+		e.histograms[name] = histogram
+	}
+
+	return histogram
+}
+
+func (e *PrometheusEmitter) gauge(name string) *prometheus.GaugeVec {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	gauge, ok := e.gauges[name]
+	if !ok {
+		gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      snakeCase(name),
+			Help:      name,
+		}, prometheusLabelNames)
+		e.registry.MustRegister(gauge)
+		e.gauges[name] = gauge
+	}
+
+	return gauge
+}
+
+func labelValues(labels Labels) []string {
+	return []string{labels.Lifecycle, labels.Stack, labels.FailureCategory}
+}
+
+func snakeCase(name string) string {
+	words := []string{}
+	start := 0
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			words = append(words, name[start:i])
+			start = i
+		}
+	}
+	words = append(words, name[start:])
+
+	return strings.ToLower(strings.Join(words, "_"))
+}
@@ -0,0 +1,65 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PrometheusEmitter", func() {
+	var emitter *metrics.PrometheusEmitter
+
+	BeforeEach(func() {
+		emitter = metrics.NewPrometheusEmitter()
+	})
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "/metrics", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		emitter.Handler().ServeHTTP(recorder, request)
+		Ω(recorder.Code).Should(Equal(http.StatusOK))
+
+		return recorder.Body.String()
+	}
+
+	It("exports counters with their labels", func() {
+		labels := metrics.Labels{Lifecycle: "buildpack", Stack: "cflinuxfs2"}
+		emitter.IncrementCounter(metrics.StagingStartRequestsReceived, labels)
+		emitter.IncrementCounter(metrics.StagingStartRequestsReceived, labels)
+
+		Ω(scrape()).Should(ContainSubstring(`stager_staging_start_requests_received_total{failure_category="",lifecycle="buildpack",stack="cflinuxfs2"} 2`))
+	})
+
+	It("exports durations as histograms in seconds", func() {
+		labels := metrics.Labels{Lifecycle: "docker", Stack: "cflinuxfs2", FailureCategory: "InsufficientResources"}
+		emitter.ObserveDuration(metrics.StagingRequestFailedDuration, 90*time.Second, labels)
+
+		body := scrape()
+		Ω(body).Should(ContainSubstring(`stager_staging_request_failed_duration_seconds_bucket{failure_category="InsufficientResources",lifecycle="docker",stack="cflinuxfs2",le="60"} 0`))
+		Ω(body).Should(ContainSubstring(`stager_staging_request_failed_duration_seconds_bucket{failure_category="InsufficientResources",lifecycle="docker",stack="cflinuxfs2",le="120"} 1`))
+		Ω(body).Should(ContainSubstring(`stager_staging_request_failed_duration_seconds_sum{failure_category="InsufficientResources",lifecycle="docker",stack="cflinuxfs2"} 90`))
+	})
+
+	It("keeps separate series per label set", func() {
+		emitter.IncrementCounter(metrics.StagingRequestsFailed, metrics.Labels{Lifecycle: "buildpack", FailureCategory: "StagingError"})
+		emitter.IncrementCounter(metrics.StagingRequestsFailed, metrics.Labels{Lifecycle: "buildpack", FailureCategory: "NoCompatibleCell"})
+
+		body := scrape()
+		Ω(body).Should(ContainSubstring(`stager_staging_requests_failed_total{failure_category="StagingError",lifecycle="buildpack",stack=""} 1`))
+		Ω(body).Should(ContainSubstring(`stager_staging_requests_failed_total{failure_category="NoCompatibleCell",lifecycle="buildpack",stack=""} 1`))
+	})
+
+	It("exports gauges", func() {
+		emitter.SetGauge(metrics.StagingsInFlight, 4, metrics.Labels{Lifecycle: "buildpack"})
+		emitter.SetGauge(metrics.StagingsInFlight, 3, metrics.Labels{Lifecycle: "buildpack"})
+
+		Ω(scrape()).Should(ContainSubstring(`stager_stagings_in_flight{failure_category="",lifecycle="buildpack",stack=""} 3`))
+	})
+})
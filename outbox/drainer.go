@@ -0,0 +1,89 @@
+package outbox
+
+import (
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/cc_client"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+const DefaultDrainInterval = 30 * time.Second
+
+type drainer struct {
+	logger   lager.Logger
+	outbox   Outbox
+	ccClient cc_client.CcClient
+	clock    clock.Clock
+	interval time.Duration
+}
+
+// NewDrainer returns a runner that periodically delivers the outbox's pending
+// entries to the CC. Entries are marked delivered once the CC has accepted
+// them, and are retried on every other answer; the reconciler removes them
+// after deleting the staging task. Entries younger than interval are left alone, as the
+// completion handler that wrote them is most likely still delivering them.
+func NewDrainer(logger lager.Logger, outbox Outbox, ccClient cc_client.CcClient, clock clock.Clock, interval time.Duration) ifrit.Runner {
+	return &drainer{
+		logger:   logger.Session("outbox-drainer"),
+		outbox:   outbox,
+		ccClient: ccClient,
+		clock:    clock,
+		interval: interval,
+	}
+}
+
+func (d *drainer) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	close(ready)
+
+	d.drain()
+
+	ticker := d.clock.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C():
+			d.drain()
+		}
+	}
+}
+
+func (d *drainer) drain() {
+	logger := d.logger.Session("drain")
+
+	entries, err := d.outbox.Entries()
+	if err != nil {
+		logger.Error("failed-to-list-entries", err)
+		return
+	}
+
+	cutoff := d.clock.Now().Add(-d.interval).UnixNano()
+
+	for _, entry := range entries {
+		if entry.Delivered() || entry.CreatedAt > cutoff {
+			continue
+		}
+
+		entryLogger := logger.Session("deliver", lager.Data{"staging-guid": entry.StagingGuid})
+
+		err := d.ccClient.StagingComplete(entry.StagingGuid, entry.Payload, entryLogger)
+		if err != nil {
+			entryLogger.Error("cc-staging-complete-failed", err)
+			continue
+		}
+
+		entry.DeliveredAt = d.clock.Now().UnixNano()
+		err = d.outbox.Put(entry)
+		if err != nil {
+			entryLogger.Error("failed-to-mark-entry-delivered", err)
+			continue
+		}
+
+		entryLogger.Info("delivered")
+	}
+}
@@ -0,0 +1,138 @@
+package outbox_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/cc_client"
+	cc_fakes "github.com/cloudfoundry-incubator/stager/cc_client/fakes"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/outbox/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("Drainer", func() {
+	var (
+		fakeOutbox   *fakes.FakeOutbox
+		fakeCcClient *cc_fakes.FakeCcClient
+		fakeClock    *fakeclock.FakeClock
+		interval     time.Duration
+
+		process ifrit.Process
+	)
+
+	BeforeEach(func() {
+		fakeOutbox = &fakes.FakeOutbox{}
+		fakeCcClient = &cc_fakes.FakeCcClient{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		interval = 10 * time.Second
+
+		fakeOutbox.EntriesReturns([]outbox.Entry{
+			{StagingGuid: "delivered-guid", Payload: json.RawMessage(`{}`), CreatedAt: fakeClock.Now().Add(-time.Hour).UnixNano(), DeliveredAt: fakeClock.Now().Add(-time.Hour).UnixNano()},
+			{StagingGuid: "old-guid", Payload: json.RawMessage(`{"old":true}`), CreatedAt: fakeClock.Now().Add(-time.Minute).UnixNano()},
+			{StagingGuid: "fresh-guid", Payload: json.RawMessage(`{}`), CreatedAt: fakeClock.Now().UnixNano()},
+		}, nil)
+	})
+
+	JustBeforeEach(func() {
+		drainer := outbox.NewDrainer(lagertest.NewTestLogger("test"), fakeOutbox, fakeCcClient, fakeClock, interval)
+		process = ifrit.Invoke(drainer)
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+
+	It("delivers pending entries older than the drain interval on startup", func() {
+		Eventually(fakeCcClient.StagingCompleteCallCount).Should(Equal(1))
+
+		guid, payload, _ := fakeCcClient.StagingCompleteArgsForCall(0)
+		Ω(guid).Should(Equal("old-guid"))
+		Ω(payload).Should(MatchJSON(`{"old":true}`))
+	})
+
+	It("marks entries delivered once the CC has accepted them", func() {
+		Eventually(fakeOutbox.PutCallCount).Should(Equal(1))
+
+		entry := fakeOutbox.PutArgsForCall(0)
+		Ω(entry.StagingGuid).Should(Equal("old-guid"))
+		Ω(entry.Payload).Should(MatchJSON(`{"old":true}`))
+		Ω(entry.DeliveredAt).Should(Equal(fakeClock.Now().UnixNano()))
+	})
+
+	It("leaves the entries for the reconciler to remove", func() {
+		Eventually(fakeOutbox.PutCallCount).Should(Equal(1))
+		Ω(fakeOutbox.RemoveCallCount()).Should(Equal(0))
+	})
+
+	It("drains again every interval", func() {
+		Eventually(fakeOutbox.EntriesCallCount).Should(Equal(1))
+
+		fakeClock.Increment(interval)
+		Eventually(fakeOutbox.EntriesCallCount).Should(Equal(2))
+		Eventually(fakeCcClient.StagingCompleteCallCount).Should(Equal(3))
+	})
+
+	Context("when the CC is unavailable", func() {
+		BeforeEach(func() {
+			fakeCcClient.StagingCompleteReturns(&cc_client.BadResponseError{503})
+		})
+
+		It("keeps the entry pending", func() {
+			Eventually(fakeCcClient.StagingCompleteCallCount).Should(Equal(1))
+			Consistently(fakeOutbox.PutCallCount).Should(Equal(0))
+		})
+	})
+
+	Context("when the CC fails", func() {
+		BeforeEach(func() {
+			fakeCcClient.StagingCompleteReturns(&cc_client.BadResponseError{500})
+		})
+
+		It("keeps the entry pending", func() {
+			Eventually(fakeCcClient.StagingCompleteCallCount).Should(Equal(1))
+			Consistently(fakeOutbox.PutCallCount).Should(Equal(0))
+		})
+	})
+
+	Context("when the CC is rate limiting", func() {
+		BeforeEach(func() {
+			fakeCcClient.StagingCompleteReturns(&cc_client.BadResponseError{429})
+		})
+
+		It("keeps the entry pending", func() {
+			Eventually(fakeCcClient.StagingCompleteCallCount).Should(Equal(1))
+			Consistently(fakeOutbox.PutCallCount).Should(Equal(0))
+		})
+	})
+
+	Context("when the CC rejects the delivery", func() {
+		BeforeEach(func() {
+			fakeCcClient.StagingCompleteReturns(&cc_client.BadResponseError{404})
+		})
+
+		It("keeps the entry pending, as only a 200 means the CC has the result", func() {
+			Eventually(fakeCcClient.StagingCompleteCallCount).Should(Equal(1))
+			Consistently(fakeOutbox.PutCallCount).Should(Equal(0))
+		})
+	})
+
+	Context("when listing the entries fails", func() {
+		BeforeEach(func() {
+			fakeOutbox.EntriesReturns(nil, errors.New("disk on fire"))
+		})
+
+		It("keeps running", func() {
+			Eventually(fakeOutbox.EntriesCallCount).Should(Equal(1))
+			Consistently(process.Wait()).ShouldNot(Receive())
+			Ω(fakeCcClient.StagingCompleteCallCount()).Should(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,125 @@
+// This file was generated by counterfeiter
+package fakes
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-incubator/stager/outbox"
+)
+
+type FakeOutbox struct {
+	PutStub        func(entry outbox.Entry) error
+	putMutex       sync.RWMutex
+	putArgsForCall []struct {
+		entry outbox.Entry
+	}
+	putReturns struct {
+		result1 error
+	}
+	RemoveStub        func(stagingGuid string) error
+	removeMutex       sync.RWMutex
+	removeArgsForCall []struct {
+		stagingGuid string
+	}
+	removeReturns struct {
+		result1 error
+	}
+	EntriesStub        func() ([]outbox.Entry, error)
+	entriesMutex       sync.RWMutex
+	entriesArgsForCall []struct{}
+	entriesReturns     struct {
+		result1 []outbox.Entry
+		result2 error
+	}
+}
+
+func (fake *FakeOutbox) Put(entry outbox.Entry) error {
+	fake.putMutex.Lock()
+	fake.putArgsForCall = append(fake.putArgsForCall, struct {
+		entry outbox.Entry
+	}{entry})
+	fake.putMutex.Unlock()
+	if fake.PutStub != nil {
+		return fake.PutStub(entry)
+	} else {
+		return fake.putReturns.result1
+	}
+}
+
+func (fake *FakeOutbox) PutCallCount() int {
+	fake.putMutex.RLock()
+	defer fake.putMutex.RUnlock()
+	return len(fake.putArgsForCall)
+}
+
+func (fake *FakeOutbox) PutArgsForCall(i int) outbox.Entry {
+	fake.putMutex.RLock()
+	defer fake.putMutex.RUnlock()
+	return fake.putArgsForCall[i].entry
+}
+
+func (fake *FakeOutbox) PutReturns(result1 error) {
+	fake.PutStub = nil
+	fake.putReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeOutbox) Remove(stagingGuid string) error {
+	fake.removeMutex.Lock()
+	fake.removeArgsForCall = append(fake.removeArgsForCall, struct {
+		stagingGuid string
+	}{stagingGuid})
+	fake.removeMutex.Unlock()
+	if fake.RemoveStub != nil {
+		return fake.RemoveStub(stagingGuid)
+	} else {
+		return fake.removeReturns.result1
+	}
+}
+
+func (fake *FakeOutbox) RemoveCallCount() int {
+	fake.removeMutex.RLock()
+	defer fake.removeMutex.RUnlock()
+	return len(fake.removeArgsForCall)
+}
+
+func (fake *FakeOutbox) RemoveArgsForCall(i int) string {
+	fake.removeMutex.RLock()
+	defer fake.removeMutex.RUnlock()
+	return fake.removeArgsForCall[i].stagingGuid
+}
+
+func (fake *FakeOutbox) RemoveReturns(result1 error) {
+	fake.RemoveStub = nil
+	fake.removeReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeOutbox) Entries() ([]outbox.Entry, error) {
+	fake.entriesMutex.Lock()
+	fake.entriesArgsForCall = append(fake.entriesArgsForCall, struct{}{})
+	fake.entriesMutex.Unlock()
+	if fake.EntriesStub != nil {
+		return fake.EntriesStub()
+	} else {
+		return fake.entriesReturns.result1, fake.entriesReturns.result2
+	}
+}
+
+func (fake *FakeOutbox) EntriesCallCount() int {
+	fake.entriesMutex.RLock()
+	defer fake.entriesMutex.RUnlock()
+	return len(fake.entriesArgsForCall)
+}
+
+func (fake *FakeOutbox) EntriesReturns(result1 []outbox.Entry, result2 error) {
+	fake.EntriesStub = nil
+	fake.entriesReturns = struct {
+		result1 []outbox.Entry
+		result2 error
+	}{result1, result2}
+}
+
+var _ outbox.Outbox = new(FakeOutbox)
@@ -0,0 +1,50 @@
+package outbox
+
+import (
+	"sort"
+	"sync"
+)
+
+type memoryOutbox struct {
+	entries map[string]Entry
+	lock    sync.Mutex
+}
+
+// NewMemoryOutbox keeps entries in memory only, losing them on restart. The
+// stager itself requires a file outbox, as the reconciler would otherwise
+// replay results the CC already has.
+func NewMemoryOutbox() Outbox {
+	return &memoryOutbox{
+		entries: map[string]Entry{},
+	}
+}
+
+func (o *memoryOutbox) Put(entry Entry) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.entries[entry.StagingGuid] = entry
+	return nil
+}
+
+func (o *memoryOutbox) Remove(stagingGuid string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	delete(o.entries, stagingGuid)
+	return nil
+}
+
+func (o *memoryOutbox) Entries() ([]Entry, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	entries := make([]Entry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		entries = append(entries, entry)
+	}
+
+	sort.Sort(byCreatedAt(entries))
+
+	return entries, nil
+}
@@ -0,0 +1,57 @@
+package outbox_test
+
+import (
+	"encoding/json"
+
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryOutbox", func() {
+	var box outbox.Outbox
+
+	BeforeEach(func() {
+		box = outbox.NewMemoryOutbox()
+	})
+
+	It("lists the entries it was given, oldest first", func() {
+		err := box.Put(outbox.Entry{StagingGuid: "guid-1", Payload: json.RawMessage(`{"a":"b"}`), CreatedAt: 2})
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.Put(outbox.Entry{StagingGuid: "guid-2", Payload: json.RawMessage(`{}`), CreatedAt: 1})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		entries, err := box.Entries()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(Equal([]outbox.Entry{
+			{StagingGuid: "guid-2", Payload: json.RawMessage(`{}`), CreatedAt: 1},
+			{StagingGuid: "guid-1", Payload: json.RawMessage(`{"a":"b"}`), CreatedAt: 2},
+		}))
+	})
+
+	It("replaces an existing entry for the same staging guid", func() {
+		err := box.Put(outbox.Entry{StagingGuid: "guid-1", CreatedAt: 1})
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.Put(outbox.Entry{StagingGuid: "guid-1", CreatedAt: 1, DeliveredAt: 2})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		entries, err := box.Entries()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(HaveLen(1))
+		Ω(entries[0].Delivered()).Should(BeTrue())
+	})
+
+	It("removes entries", func() {
+		err := box.Put(outbox.Entry{StagingGuid: "guid-1"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = box.Remove("guid-1")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = box.Remove("guid-1")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		entries, err := box.Entries()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(BeEmpty())
+	})
+})
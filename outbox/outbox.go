@@ -0,0 +1,150 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pivotal-golang/lager"
+)
+
+const entryExtension = ".json"
+
+// Entry is a staging response waiting to be delivered to the CC. Once the CC
+// has accepted it with a 200, the entry is kept with DeliveredAt set until the
+// reconciler has deleted the staging task.
+type Entry struct {
+	StagingGuid string          `json:"staging_guid"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   int64           `json:"created_at"`
+	DeliveredAt int64           `json:"delivered_at,omitempty"`
+}
+
+func (e Entry) Delivered() bool {
+	return e.DeliveredAt != 0
+}
+
+//go:generate counterfeiter -o fakes/fake_outbox.go . Outbox
+type Outbox interface {
+	Put(entry Entry) error
+	Remove(stagingGuid string) error
+	Entries() ([]Entry, error)
+}
+
+type fileOutbox struct {
+	dir    string
+	logger lager.Logger
+	lock   sync.Mutex
+}
+
+// NewFileOutbox stores every entry as its own JSON file in dir. Entries are
+// written to a temporary file and renamed into place, so a crash never
+// leaves a partially written entry behind.
+func NewFileOutbox(dir string, logger lager.Logger) (Outbox, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileOutbox{
+		dir:    dir,
+		logger: logger.Session("file-outbox", lager.Data{"dir": dir}),
+	}, nil
+}
+
+func (o *fileOutbox) Put(entry Entry) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(o.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(entryJSON)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), o.entryPath(entry.StagingGuid))
+}
+
+func (o *fileOutbox) Remove(stagingGuid string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	err := os.Remove(o.entryPath(stagingGuid))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (o *fileOutbox) Entries() ([]Entry, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	files, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), entryExtension) {
+			continue
+		}
+
+		path := filepath.Join(o.dir, file.Name())
+
+		entryJSON, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var entry Entry
+		err = json.Unmarshal(entryJSON, &entry)
+		if err != nil {
+			o.logger.Error("skipping-invalid-entry", err, lager.Data{"path": path})
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Sort(byCreatedAt(entries))
+
+	return entries, nil
+}
+
+func (o *fileOutbox) entryPath(stagingGuid string) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%s%s", url.QueryEscape(stagingGuid), entryExtension))
+}
+
+type byCreatedAt []Entry
+
+func (e byCreatedAt) Len() int           { return len(e) }
+func (e byCreatedAt) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byCreatedAt) Less(i, j int) bool { return e[i].CreatedAt < e[j].CreatedAt }
@@ -0,0 +1,116 @@
+package outbox_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/lager/lagertest"
+)
+
+var _ = Describe("FileOutbox", func() {
+	var (
+		dir string
+		box outbox.Outbox
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "outbox")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		box, err = outbox.NewFileOutbox(filepath.Join(dir, "entries"), lagertest.NewTestLogger("test"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("creates the outbox directory", func() {
+		info, err := os.Stat(filepath.Join(dir, "entries"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.IsDir()).Should(BeTrue())
+	})
+
+	Describe("Put", func() {
+		It("persists entries so that a new outbox on the same directory sees them", func() {
+			err := box.Put(outbox.Entry{StagingGuid: "guid-1", Payload: json.RawMessage(`{"a":"b"}`), CreatedAt: 2})
+			Ω(err).ShouldNot(HaveOccurred())
+			err = box.Put(outbox.Entry{StagingGuid: "guid-2", Payload: json.RawMessage(`{}`), CreatedAt: 1})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			reopened, err := outbox.NewFileOutbox(filepath.Join(dir, "entries"), lagertest.NewTestLogger("test"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			entries, err := reopened.Entries()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(entries).Should(Equal([]outbox.Entry{
+				{StagingGuid: "guid-2", Payload: json.RawMessage(`{}`), CreatedAt: 1},
+				{StagingGuid: "guid-1", Payload: json.RawMessage(`{"a":"b"}`), CreatedAt: 2},
+			}))
+		})
+
+		It("replaces an existing entry for the same staging guid", func() {
+			err := box.Put(outbox.Entry{StagingGuid: "guid-1", Payload: json.RawMessage(`{"old":true}`)})
+			Ω(err).ShouldNot(HaveOccurred())
+			err = box.Put(outbox.Entry{StagingGuid: "guid-1", Payload: json.RawMessage(`{"new":true}`)})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			entries, err := box.Entries()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].Payload).Should(MatchJSON(`{"new":true}`))
+		})
+
+		It("does not let the staging guid escape the outbox directory", func() {
+			err := box.Put(outbox.Entry{StagingGuid: "../escaped", Payload: json.RawMessage(`{}`)})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = os.Stat(filepath.Join(dir, "escaped.json"))
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+
+			entries, err := box.Entries()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].StagingGuid).Should(Equal("../escaped"))
+		})
+	})
+
+	Describe("Remove", func() {
+		BeforeEach(func() {
+			err := box.Put(outbox.Entry{StagingGuid: "guid-1", Payload: json.RawMessage(`{}`)})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("removes the entry", func() {
+			err := box.Remove("guid-1")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(box.Entries()).Should(BeEmpty())
+		})
+
+		It("does not fail when the entry is already gone", func() {
+			Ω(box.Remove("unknown-guid")).Should(Succeed())
+		})
+	})
+
+	Describe("Entries", func() {
+		It("skips files that are not valid entries", func() {
+			err := ioutil.WriteFile(filepath.Join(dir, "entries", "garbage.json"), []byte("{"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(dir, "entries", ".tmp-123"), []byte("{"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = box.Put(outbox.Entry{StagingGuid: "guid-1", Payload: json.RawMessage(`{}`)})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			entries, err := box.Entries()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(entries).Should(HaveLen(1))
+		})
+	})
+})
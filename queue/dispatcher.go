@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/tracing"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type dispatcher struct {
+	logger      lager.Logger
+	queue       *Queue
+	admission   *admission.Controller
+	diegoClient receptor.Client
+	outbox      outbox.Outbox
+	signer      *backend.CallbackSigner
+	inFlight    *metrics.InFlightGauge
+	emitter     metrics.Emitter
+	tracer      trace.Tracer
+	clock       clock.Clock
+}
+
+// NewDispatcher returns a runner that creates the tasks of queued stagings, in
+// queue order, as the admission controller makes room for them. A staging
+// that is held back by the limits of its lifecycle or the quotas of its
+// tenant does not hold back the stagings behind it.
+//
+// The CC was told the staging was accepted when it was queued, so a task that
+// cannot be created is reported to the CC as a failed staging, through the
+// outbox.
+//
+// When callbackSigner is not nil, the completion callback URL is signed again
+// as the task is created, so that the time the staging spent in the queue
+// does not count against the signature's ttl.
+//
+// The task is created in a span joined to the trace of the staging request.
+func NewDispatcher(
+	logger lager.Logger,
+	queue *Queue,
+	admission *admission.Controller,
+	diegoClient receptor.Client,
+	outbox outbox.Outbox,
+	callbackSigner *backend.CallbackSigner,
+	inFlight *metrics.InFlightGauge,
+	emitter metrics.Emitter,
+	tracer trace.Tracer,
+	clock clock.Clock,
+) ifrit.Runner {
+	return &dispatcher{
+		logger:      logger.Session("queue-dispatcher"),
+		queue:       queue,
+		admission:   admission,
+		diegoClient: diegoClient,
+		outbox:      outbox,
+		signer:      callbackSigner,
+		inFlight:    inFlight,
+		emitter:     emitter,
+		tracer:      tracer,
+		clock:       clock,
+	}
+}
+
+func (d *dispatcher) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	close(ready)
+
+	for {
+		d.dispatch()
+
+		select {
+		case <-signals:
+			return nil
+		case <-d.queue.Pushed():
+		case <-d.admission.Released():
+		}
+	}
+}
+
+func (d *dispatcher) dispatch() {
+	for _, queued := range d.queue.List() {
+		cancelAdmission, err := d.admission.Admit(queued.Staging)
+		if capacityErr, ok := err.(*admission.CapacityError); ok && capacityErr.Lifecycle == "" {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		_, ok := d.queue.Take(queued.Staging.Guid)
+		if !ok {
+			cancelAdmission()
+			continue
+		}
+
+		d.emitter.ObserveDuration(metrics.StagingQueueWaitDuration, d.clock.Now().Sub(queued.EnqueuedAt), metrics.Labels{
+			Lifecycle: queued.Staging.Lifecycle,
+			Stack:     queued.Stack,
+		})
+
+		d.createTask(queued, cancelAdmission)
+	}
+}
+
+func (d *dispatcher) createTask(queued QueuedStaging, cancelAdmission func()) {
+	logger := d.logger.Session("create-task", lager.Data{"staging-guid": queued.Staging.Guid})
+
+	defer d.dispatched(logger, queued.Staging.Guid)
+
+	ctx := tracing.Extract(context.Background(), queued.TraceContext)
+	task := queued.Task
+	if d.signer != nil {
+		task.CompletionCallbackURL = d.signer.SignURL(queued.Staging.Guid, task.CompletionCallbackURL)
+	}
+
+	_, span := d.tracer.Start(ctx, "create-task")
+	err := d.diegoClient.CreateTask(task)
+	if receptorErr, ok := err.(receptor.Error); ok {
+		if receptorErr.Type == receptor.TaskGuidAlreadyExists {
+			err = nil
+		}
+	}
+	tracing.RecordError(span, err)
+	span.End()
+
+	if err != nil {
+		cancelAdmission()
+		logger.Error("staging-failed", err)
+		ReportFailure(logger, d.outbox, d.clock, queued.Staging.Guid, "Staging failed: "+err.Error())
+		return
+	}
+
+	d.inFlight.Update()
+	logger.Info("desired-task", lager.Data{"waited": d.clock.Now().Sub(queued.EnqueuedAt).String()})
+}
+
+func (d *dispatcher) dispatched(logger lager.Logger, stagingGuid string) {
+	err := d.queue.Dispatched(stagingGuid)
+	if err != nil {
+		logger.Error("failed-to-remove-dispatched-staging", err)
+	}
+}
+
+// ReportFailure puts the failure of a queued staging, e.g. because it was
+// cancelled before its task was created, in the outbox for the drainer to
+// deliver, as the CC was told the staging had been accepted.
+func ReportFailure(logger lager.Logger, stagingOutbox outbox.Outbox, clock clock.Clock, stagingGuid, message string) {
+	response := cc_messages.StagingResponseForCC{
+		Error: cc_messages.SanitizeErrorMessage(message),
+	}
+	responseJson, _ := json.Marshal(response)
+
+	err := stagingOutbox.Put(outbox.Entry{
+		StagingGuid: stagingGuid,
+		Payload:     responseJson,
+		CreatedAt:   clock.Now().UnixNano(),
+	})
+	if err != nil {
+		logger.Error("outbox-put-failed", err)
+	}
+}
@@ -0,0 +1,263 @@
+package queue_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/receptor/fake_receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/metrics/fakes"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/queue"
+	"github.com/cloudfoundry-incubator/stager/tracing"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dispatcher", func() {
+	var (
+		fakeDiegoClient *fake_receptor.FakeClient
+		stagingOutbox   outbox.Outbox
+		fakeEmitter     *fakes.FakeEmitter
+		fakeClock       *fakeclock.FakeClock
+
+		spanRecorder *tracetest.SpanRecorder
+		tracer       trace.Tracer
+		stageSpans   map[string]trace.SpanContext
+
+		limits       admission.Limits
+		controller   *admission.Controller
+		store        outbox.Outbox
+		stagingQueue *queue.Queue
+
+		callbackSigner *backend.CallbackSigner
+
+		process ifrit.Process
+	)
+
+	push := func(stagingGuid, lifecycle string, priority int) {
+		ctx, stageSpan := tracer.Start(context.Background(), "stage")
+		stageSpan.End()
+		stageSpans[stagingGuid] = stageSpan.SpanContext()
+
+		callbackURL := "http://stager.example.com/v1/staging/" + stagingGuid + "/completed"
+		if callbackSigner != nil {
+			callbackURL = callbackSigner.SignURL(stagingGuid, callbackURL)
+		}
+
+		err := stagingQueue.Push(queue.Item{
+			Staging:  admission.Staging{Guid: stagingGuid, Lifecycle: lifecycle},
+			Priority: priority,
+			Task:     receptor.TaskCreateRequest{TaskGuid: stagingGuid, CompletionCallbackURL: callbackURL},
+
+			TraceContext: tracing.Inject(ctx),
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	failures := func() []outbox.Entry {
+		entries, err := stagingOutbox.Entries()
+		Ω(err).ShouldNot(HaveOccurred())
+		return entries
+	}
+
+	createdTasks := func() []string {
+		guids := []string{}
+		for i := 0; i < fakeDiegoClient.CreateTaskCallCount(); i++ {
+			guids = append(guids, fakeDiegoClient.CreateTaskArgsForCall(i).TaskGuid)
+		}
+		return guids
+	}
+
+	BeforeEach(func() {
+		fakeDiegoClient = &fake_receptor.FakeClient{}
+		stagingOutbox = outbox.NewMemoryOutbox()
+		fakeEmitter = &fakes.FakeEmitter{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		callbackSigner = nil
+
+		spanRecorder = tracetest.NewSpanRecorder()
+		tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)).Tracer("test")
+		stageSpans = map[string]trace.SpanContext{}
+
+		limits = admission.Limits{MaxInFlight: 1}
+	})
+
+	JustBeforeEach(func() {
+		controller = admission.NewController(limits, time.Second)
+		store = outbox.NewMemoryOutbox()
+		stagingQueue = queue.New(10, time.Minute, time.Second, store, fakeEmitter, fakeClock)
+
+		push("low", "buildpack", 0)
+		push("high", "docker", 5)
+		fakeClock.Increment(time.Second)
+
+		process = ifrit.Invoke(queue.NewDispatcher(
+			lagertest.NewTestLogger("test"),
+			stagingQueue,
+			controller,
+			fakeDiegoClient,
+			stagingOutbox,
+			callbackSigner,
+			metrics.NewInFlightGauge(fakeEmitter, controller),
+			fakeEmitter,
+			tracer,
+			fakeClock,
+		))
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+
+	It("creates the task of the highest priority staging there is room for", func() {
+		Eventually(createdTasks).Should(Equal([]string{"high"}))
+		Consistently(createdTasks).Should(Equal([]string{"high"}))
+
+		Ω(controller.InFlight("docker")).Should(Equal(1))
+		_, ok := stagingQueue.Get("high")
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("forgets the staging in the store once its task is created", func() {
+		Eventually(createdTasks).Should(Equal([]string{"high"}))
+
+		Eventually(func() []outbox.Entry {
+			entries, err := store.Entries()
+			Ω(err).ShouldNot(HaveOccurred())
+			return entries
+		}).Should(HaveLen(1))
+
+		entries, err := store.Entries()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries[0].StagingGuid).Should(Equal("low"))
+	})
+
+	It("creates the task in the trace of the staging request", func() {
+		var createSpan sdktrace.ReadOnlySpan
+		Eventually(func() sdktrace.ReadOnlySpan {
+			for _, span := range spanRecorder.Ended() {
+				if span.Name() == "create-task" {
+					createSpan = span
+				}
+			}
+			return createSpan
+		}).ShouldNot(BeNil())
+
+		Ω(createSpan.SpanContext().TraceID()).Should(Equal(stageSpans["high"].TraceID()))
+		Ω(createSpan.Parent().SpanID()).Should(Equal(stageSpans["high"].SpanID()))
+	})
+
+	It("creates the next task once there is room", func() {
+		Eventually(createdTasks).Should(Equal([]string{"high"}))
+
+		controller.Release("high")
+		Eventually(createdTasks).Should(Equal([]string{"high", "low"}))
+	})
+
+	It("creates the tasks of stagings pushed later", func() {
+		Eventually(createdTasks).Should(Equal([]string{"high"}))
+		controller.Release("high")
+		Eventually(createdTasks).Should(Equal([]string{"high", "low"}))
+		controller.Release("low")
+
+		push("later", "buildpack", 0)
+		Eventually(createdTasks).Should(Equal([]string{"high", "low", "later"}))
+	})
+
+	It("reports how long the staging waited", func() {
+		Eventually(fakeEmitter.ObserveDurationCallCount).Should(Equal(1))
+
+		name, duration, labels := fakeEmitter.ObserveDurationArgsForCall(0)
+		Ω(name).Should(Equal(metrics.StagingQueueWaitDuration))
+		Ω(duration).Should(Equal(time.Second))
+		Ω(labels.Lifecycle).Should(Equal("docker"))
+	})
+
+	Context("when callback URLs are signed", func() {
+		BeforeEach(func() {
+			callbackSigner = backend.NewCallbackSigner([]byte("signing-key"), time.Hour, fakeClock)
+		})
+
+		It("signs the callback URL again when the task is created, so time in the queue does not count", func() {
+			Eventually(createdTasks).Should(Equal([]string{"high"}))
+
+			fakeClock.Increment(2 * time.Hour)
+			controller.Release("high")
+			Eventually(createdTasks).Should(Equal([]string{"high", "low"}))
+
+			callbackURL, err := url.Parse(fakeDiegoClient.CreateTaskArgsForCall(1).CompletionCallbackURL)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(callbackURL.Path).Should(Equal("/v1/staging/low/completed"))
+			Ω(callbackSigner.Verify("low", callbackURL.Query())).Should(Succeed())
+		})
+	})
+
+	Context("when the lifecycle of the first staging is at its limit", func() {
+		BeforeEach(func() {
+			limits = admission.Limits{MaxInFlightPerLifecycle: map[string]int{"docker": 1}}
+		})
+
+		JustBeforeEach(func() {
+			Eventually(createdTasks).Should(ConsistOf("high", "low"))
+			push("docker-too", "docker", 10)
+			push("buildpack-too", "buildpack", 0)
+		})
+
+		It("dispatches the stagings behind it", func() {
+			Eventually(createdTasks).Should(ContainElement("buildpack-too"))
+			Consistently(createdTasks).ShouldNot(ContainElement("docker-too"))
+		})
+	})
+
+	Context("when the task already exists", func() {
+		BeforeEach(func() {
+			fakeDiegoClient.CreateTaskReturns(receptor.Error{Type: receptor.TaskGuidAlreadyExists})
+		})
+
+		It("keeps the staging in flight", func() {
+			Eventually(createdTasks).Should(Equal([]string{"high"}))
+			Consistently(failures).Should(BeEmpty())
+			Ω(controller.InFlight("docker")).Should(Equal(1))
+		})
+	})
+
+	Context("when creating the task fails", func() {
+		BeforeEach(func() {
+			fakeDiegoClient.CreateTaskReturns(errors.New("boom"))
+		})
+
+		It("puts the failed staging in the outbox for the drainer to report to the CC", func() {
+			Eventually(failures).ShouldNot(BeEmpty())
+
+			entry := failures()[0]
+			Ω(entry.StagingGuid).Should(Equal("high"))
+			Ω(entry.Delivered()).Should(BeFalse())
+
+			var response cc_messages.StagingResponseForCC
+			err := json.Unmarshal(entry.Payload, &response)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Error).Should(Equal(cc_messages.SanitizeErrorMessage("Staging failed: boom")))
+		})
+
+		It("gives the room to the next staging", func() {
+			Eventually(createdTasks).Should(Equal([]string{"high", "low"}))
+		})
+	})
+})
@@ -0,0 +1,288 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+)
+
+const (
+	// StateQueued is reported by the status endpoints for stagings that are
+	// waiting in the queue, next to the task states of Diego.
+	StateQueued = "QUEUED"
+
+	// PriorityHeader sets the priority of a staging request, overriding the
+	// priority field of its body.
+	PriorityHeader = "X-Staging-Priority"
+
+	DefaultAging = time.Minute
+)
+
+// Item is a staging whose task is waiting to be created.
+type Item struct {
+	Staging  admission.Staging
+	AppId    string
+	Stack    string
+	Priority int
+	Task     receptor.TaskCreateRequest
+
+	// TraceContext joins the task creation to the trace of the staging
+	// request, see tracing.Inject.
+	TraceContext map[string]string
+}
+
+// QueuedStaging describes an item while it is in the queue. Position 1 is the
+// next to be dispatched.
+type QueuedStaging struct {
+	Item
+	Position   int
+	EnqueuedAt time.Time
+}
+
+// FullError is returned by Push when the queue has no room for another
+// staging.
+type FullError struct {
+	Size       int
+	RetryAfter time.Duration
+}
+
+func (e *FullError) Error() string {
+	return fmt.Sprintf("staging queue is full (%d stagings)", e.Size)
+}
+
+// Queue orders the stagings waiting for room to be dispatched. Higher
+// priorities go first; every aging interval an item waits raises its priority
+// by one, so that low priorities are not starved. Items of the same priority
+// go in the order they were pushed.
+//
+// Items are kept in the store until they have been dispatched, so that the
+// stagings the CC was told were accepted survive a restart, see Restore.
+type Queue struct {
+	maxSize    int
+	aging      time.Duration
+	retryAfter time.Duration
+	store      outbox.Outbox
+	emitter    metrics.Emitter
+	clock      clock.Clock
+
+	pushed chan struct{}
+
+	lock     sync.Mutex
+	entries  map[string]*entry
+	sequence uint64
+}
+
+type entry struct {
+	item       Item
+	enqueuedAt time.Time
+	sequence   uint64
+}
+
+func New(maxSize int, aging, retryAfter time.Duration, store outbox.Outbox, emitter metrics.Emitter, clock clock.Clock) *Queue {
+	return &Queue{
+		maxSize:    maxSize,
+		aging:      aging,
+		retryAfter: retryAfter,
+		store:      store,
+		emitter:    emitter,
+		clock:      clock,
+		pushed:     make(chan struct{}, 1),
+		entries:    make(map[string]*entry),
+	}
+}
+
+// Push queues the item, or returns a *FullError. Pushing a staging that is
+// already queued has no effect.
+func (q *Queue) Push(item Item) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, ok := q.entries[item.Staging.Guid]; ok {
+		return nil
+	}
+
+	if len(q.entries) >= q.maxSize {
+		return &FullError{Size: q.maxSize, RetryAfter: q.retryAfter}
+	}
+
+	enqueuedAt := q.clock.Now()
+
+	itemJSON, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	err = q.store.Put(outbox.Entry{
+		StagingGuid: item.Staging.Guid,
+		Payload:     itemJSON,
+		CreatedAt:   enqueuedAt.UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	q.add(item, enqueuedAt)
+	q.signalPushed()
+
+	return nil
+}
+
+// Restore queues the items left in the store by a previous run, in the order
+// they were pushed and regardless of the size of the queue.
+func (q *Queue) Restore(logger lager.Logger) error {
+	logger = logger.Session("restore-queue")
+
+	storedEntries, err := q.store.Entries()
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, stored := range storedEntries {
+		var item Item
+		err := json.Unmarshal(stored.Payload, &item)
+		if err != nil {
+			logger.Error("skipping-invalid-item", err, lager.Data{"staging-guid": stored.StagingGuid})
+			continue
+		}
+
+		if _, ok := q.entries[item.Staging.Guid]; ok {
+			continue
+		}
+
+		q.add(item, time.Unix(0, stored.CreatedAt))
+	}
+
+	logger.Info("restored", lager.Data{"queued": len(q.entries)})
+	q.signalPushed()
+
+	return nil
+}
+
+// Pushed is signalled after items have been pushed.
+func (q *Queue) Pushed() <-chan struct{} {
+	return q.pushed
+}
+
+// Remove takes the staging out of the queue and the store. A staging the store
+// fails to forget is queued again after a restart.
+func (q *Queue) Remove(stagingGuid string) (QueuedStaging, bool) {
+	queued, ok := q.Take(stagingGuid)
+	if ok {
+		q.Dispatched(stagingGuid)
+	}
+
+	return queued, ok
+}
+
+// Take takes the staging out of the queue to be dispatched, but keeps it in
+// the store until Dispatched is called, so that it is dispatched again after
+// a restart in between.
+func (q *Queue) Take(stagingGuid string) (QueuedStaging, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	e, ok := q.entries[stagingGuid]
+	if !ok {
+		return QueuedStaging{}, false
+	}
+
+	delete(q.entries, stagingGuid)
+	q.emitter.SetGauge(metrics.StagingQueueDepth, len(q.entries), metrics.Labels{})
+
+	return QueuedStaging{Item: e.item, EnqueuedAt: e.enqueuedAt}, true
+}
+
+// Dispatched removes a staging that has been taken out of the queue from the
+// store. Failing to do so only means it is dispatched again after a restart,
+// which is harmless as creating its task again has no effect.
+func (q *Queue) Dispatched(stagingGuid string) error {
+	return q.store.Remove(stagingGuid)
+}
+
+// Get returns the staging if it is queued.
+func (q *Queue) Get(stagingGuid string) (QueuedStaging, bool) {
+	for _, queued := range q.List() {
+		if queued.Staging.Guid == stagingGuid {
+			return queued, true
+		}
+	}
+
+	return QueuedStaging{}, false
+}
+
+// List returns the queued stagings in the order they would be dispatched
+// now.
+func (q *Queue) List() []QueuedStaging {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := q.clock.Now()
+
+	entries := make([]*entry, 0, len(q.entries))
+	for _, e := range q.entries {
+		entries = append(entries, e)
+	}
+	sort.Sort(byDispatchOrder{entries: entries, priority: func(e *entry) int { return q.priority(e, now) }})
+
+	queued := make([]QueuedStaging, len(entries))
+	for i, e := range entries {
+		queued[i] = QueuedStaging{
+			Item:       e.item,
+			Position:   i + 1,
+			EnqueuedAt: e.enqueuedAt,
+		}
+	}
+
+	return queued
+}
+
+func (q *Queue) add(item Item, enqueuedAt time.Time) {
+	q.sequence++
+	q.entries[item.Staging.Guid] = &entry{
+		item:       item,
+		enqueuedAt: enqueuedAt,
+		sequence:   q.sequence,
+	}
+	q.emitter.SetGauge(metrics.StagingQueueDepth, len(q.entries), metrics.Labels{})
+}
+
+func (q *Queue) signalPushed() {
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) priority(e *entry, now time.Time) int {
+	if q.aging <= 0 {
+		return e.item.Priority
+	}
+	return e.item.Priority + int(now.Sub(e.enqueuedAt)/q.aging)
+}
+
+type byDispatchOrder struct {
+	entries  []*entry
+	priority func(*entry) int
+}
+
+func (o byDispatchOrder) Len() int      { return len(o.entries) }
+func (o byDispatchOrder) Swap(i, j int) { o.entries[i], o.entries[j] = o.entries[j], o.entries[i] }
+func (o byDispatchOrder) Less(i, j int) bool {
+	pi, pj := o.priority(o.entries[i]), o.priority(o.entries[j])
+	if pi == pj {
+		return o.entries[i].sequence < o.entries[j].sequence
+	}
+	return pi > pj
+}
@@ -0,0 +1,192 @@
+package queue_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/metrics/fakes"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	outbox_fakes "github.com/cloudfoundry-incubator/stager/outbox/fakes"
+	"github.com/cloudfoundry-incubator/stager/queue"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Queue", func() {
+	var (
+		fakeEmitter  *fakes.FakeEmitter
+		fakeClock    *fakeclock.FakeClock
+		store        outbox.Outbox
+		stagingQueue *queue.Queue
+	)
+
+	item := func(stagingGuid string, priority int) queue.Item {
+		return queue.Item{
+			Staging:  admission.Staging{Guid: stagingGuid, Lifecycle: "buildpack"},
+			Priority: priority,
+		}
+	}
+
+	guids := func() []string {
+		guids := []string{}
+		for _, queued := range stagingQueue.List() {
+			guids = append(guids, queued.Staging.Guid)
+		}
+		return guids
+	}
+
+	BeforeEach(func() {
+		fakeEmitter = &fakes.FakeEmitter{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		store = outbox.NewMemoryOutbox()
+	})
+
+	JustBeforeEach(func() {
+		stagingQueue = queue.New(3, time.Minute, 10*time.Second, store, fakeEmitter, fakeClock)
+	})
+
+	It("orders stagings by priority, then by the time they were pushed", func() {
+		Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+		Ω(stagingQueue.Push(item("high", 5))).Should(Succeed())
+		Ω(stagingQueue.Push(item("also-low", 0))).Should(Succeed())
+
+		Ω(guids()).Should(Equal([]string{"high", "low", "also-low"}))
+
+		queued, ok := stagingQueue.Get("also-low")
+		Ω(ok).Should(BeTrue())
+		Ω(queued.Position).Should(Equal(3))
+	})
+
+	It("raises the priority of stagings as they wait", func() {
+		Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+		fakeClock.Increment(3 * time.Minute)
+		Ω(stagingQueue.Push(item("high", 2))).Should(Succeed())
+
+		Ω(guids()).Should(Equal([]string{"low", "high"}))
+	})
+
+	It("signals when stagings are pushed", func() {
+		Consistently(stagingQueue.Pushed()).ShouldNot(Receive())
+		Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+		Eventually(stagingQueue.Pushed()).Should(Receive())
+	})
+
+	It("queues a staging once", func() {
+		Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+		Ω(stagingQueue.Push(item("low", 7))).Should(Succeed())
+
+		queued, ok := stagingQueue.Get("low")
+		Ω(ok).Should(BeTrue())
+		Ω(queued.Priority).Should(BeZero())
+		Ω(stagingQueue.List()).Should(HaveLen(1))
+	})
+
+	It("rejects stagings once it is full", func() {
+		Ω(stagingQueue.Push(item("guid-1", 0))).Should(Succeed())
+		Ω(stagingQueue.Push(item("guid-2", 0))).Should(Succeed())
+		Ω(stagingQueue.Push(item("guid-3", 0))).Should(Succeed())
+
+		err := stagingQueue.Push(item("guid-4", 9))
+		Ω(err).Should(Equal(&queue.FullError{Size: 3, RetryAfter: 10 * time.Second}))
+	})
+
+	It("removes stagings", func() {
+		Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+		fakeClock.Increment(time.Second)
+
+		queued, ok := stagingQueue.Remove("low")
+		Ω(ok).Should(BeTrue())
+		Ω(queued.Staging.Guid).Should(Equal("low"))
+		Ω(fakeClock.Now().Sub(queued.EnqueuedAt)).Should(Equal(time.Second))
+
+		_, ok = stagingQueue.Remove("low")
+		Ω(ok).Should(BeFalse())
+		Ω(stagingQueue.List()).Should(BeEmpty())
+	})
+
+	It("reports the depth of the queue", func() {
+		Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+		Ω(stagingQueue.Push(item("high", 5))).Should(Succeed())
+		stagingQueue.Remove("low")
+
+		Ω(fakeEmitter.SetGaugeCallCount()).Should(Equal(3))
+		for i, depth := range []int{1, 2, 1} {
+			name, value, _ := fakeEmitter.SetGaugeArgsForCall(i)
+			Ω(name).Should(Equal(metrics.StagingQueueDepth))
+			Ω(value).Should(Equal(depth))
+		}
+	})
+
+	Describe("the store", func() {
+		storedGuids := func() []string {
+			entries, err := store.Entries()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			guids := []string{}
+			for _, entry := range entries {
+				guids = append(guids, entry.StagingGuid)
+			}
+			return guids
+		}
+
+		It("keeps pushed stagings until they are removed", func() {
+			Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+			Ω(stagingQueue.Push(item("high", 5))).Should(Succeed())
+			Ω(storedGuids()).Should(ConsistOf("low", "high"))
+
+			stagingQueue.Remove("low")
+			Ω(storedGuids()).Should(Equal([]string{"high"}))
+		})
+
+		It("keeps taken stagings until they are dispatched", func() {
+			Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+
+			_, ok := stagingQueue.Take("low")
+			Ω(ok).Should(BeTrue())
+			Ω(stagingQueue.List()).Should(BeEmpty())
+			Ω(storedGuids()).Should(Equal([]string{"low"}))
+
+			Ω(stagingQueue.Dispatched("low")).Should(Succeed())
+			Ω(storedGuids()).Should(BeEmpty())
+		})
+
+		It("restores the stagings left by a previous queue", func() {
+			Ω(stagingQueue.Push(item("low", 0))).Should(Succeed())
+			fakeClock.Increment(time.Second)
+			Ω(stagingQueue.Push(item("also-low", 0))).Should(Succeed())
+			Ω(stagingQueue.Push(item("high", 5))).Should(Succeed())
+			_, ok := stagingQueue.Take("high")
+			Ω(ok).Should(BeTrue())
+
+			fakeClock.Increment(time.Second)
+			stagingQueue = queue.New(3, time.Minute, 10*time.Second, store, fakeEmitter, fakeClock)
+			Ω(stagingQueue.Restore(lagertest.NewTestLogger("test"))).Should(Succeed())
+
+			Ω(guids()).Should(Equal([]string{"high", "low", "also-low"}))
+			Eventually(stagingQueue.Pushed()).Should(Receive())
+
+			queued, ok := stagingQueue.Get("low")
+			Ω(ok).Should(BeTrue())
+			Ω(fakeClock.Now().Sub(queued.EnqueuedAt)).Should(Equal(2 * time.Second))
+		})
+
+		Context("when the store fails", func() {
+			BeforeEach(func() {
+				fakeStore := &outbox_fakes.FakeOutbox{}
+				fakeStore.PutReturns(errors.New("disk full"))
+				store = fakeStore
+			})
+
+			It("does not queue the staging", func() {
+				err := stagingQueue.Push(item("low", 0))
+				Ω(err).Should(MatchError("disk full"))
+				Ω(stagingQueue.List()).Should(BeEmpty())
+			})
+		})
+	})
+})
@@ -0,0 +1,247 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/pivotal-golang/clock"
+	"github.com/pivotal-golang/lager"
+	"github.com/tedsuo/ifrit"
+)
+
+const (
+	DefaultReconcileInterval = time.Minute
+)
+
+type reconciler struct {
+	logger              lager.Logger
+	diegoClient         receptor.Client
+	backends            map[string]backend.Backend
+	outbox              outbox.Outbox
+	admission           *admission.Controller
+	inFlight            *metrics.InFlightGauge
+	failedTaskRetention time.Duration
+	emitter             metrics.Emitter
+	clock               clock.Clock
+	interval            time.Duration
+
+	previouslyCompleted map[string]struct{}
+}
+
+// New returns a runner that cleans up after completed staging tasks.
+//
+// Every pass also reconciles the admission controller and the in-flight
+// tracker with the tasks, so that stagings whose completion callback never
+// arrived give their room back and stop being counted.
+//
+// Tasks whose result the outbox records as delivered are deleted from Diego,
+// failed ones only once failedTaskRetention has passed since the delivery, so
+// that they can be inspected. The entry is removed with the task. The
+// completion handler only records the delivery, so tasks are deleted up to
+// one interval after the CC has accepted their result.
+//
+// Completed tasks the outbox knows nothing about never reached the CC, e.g.
+// because the stager was down when Diego called back. Once such a task has
+// been seen completed on two consecutive passes, including the one on
+// startup, so that callbacks still in flight are not raced, its result is
+// put in the outbox for the drainer to deliver; the first replays therefore
+// happen one interval after startup. A result that cannot be built is
+// delivered as a failed staging.
+func New(
+	logger lager.Logger,
+	diegoClient receptor.Client,
+	backends map[string]backend.Backend,
+	outbox outbox.Outbox,
+	admission *admission.Controller,
+	inFlight *metrics.InFlightGauge,
+	failedTaskRetention time.Duration,
+	emitter metrics.Emitter,
+	clock clock.Clock,
+	interval time.Duration,
+) ifrit.Runner {
+	return &reconciler{
+		logger:              logger.Session("reconciler"),
+		diegoClient:         diegoClient,
+		backends:            backends,
+		outbox:              outbox,
+		admission:           admission,
+		inFlight:            inFlight,
+		failedTaskRetention: failedTaskRetention,
+		emitter:             emitter,
+		clock:               clock,
+		interval:            interval,
+	}
+}
+
+func (r *reconciler) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	close(ready)
+
+	r.reconcile()
+
+	ticker := r.clock.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C():
+			r.reconcile()
+		}
+	}
+}
+
+func (r *reconciler) reconcile() {
+	logger := r.logger.Session("reconcile")
+
+	// The entries are listed before the tasks, so that every entry belongs
+	// to a task that had completed by the time the tasks were listed.
+	entries, err := r.outbox.Entries()
+	if err != nil {
+		logger.Error("failed-to-list-outbox-entries", err)
+		return
+	}
+
+	mark := r.admission.Mark()
+
+	tasks, err := r.diegoClient.TasksByDomain(backend.StagingTaskDomain)
+	if err != nil {
+		logger.Error("failed-to-get-tasks", err)
+		return
+	}
+
+	r.admission.Reconcile(tasks, mark)
+	r.inFlight.Update()
+
+	entriesByGuid := map[string]outbox.Entry{}
+	for _, entry := range entries {
+		entriesByGuid[entry.StagingGuid] = entry
+	}
+
+	completed := map[string]struct{}{}
+	existing := map[string]struct{}{}
+
+	for _, task := range tasks {
+		existing[task.TaskGuid] = struct{}{}
+
+		if task.State != receptor.TaskStateCompleted {
+			continue
+		}
+
+		completed[task.TaskGuid] = struct{}{}
+
+		entry, known := entriesByGuid[task.TaskGuid]
+		if known {
+			if entry.Delivered() {
+				r.cleanUp(logger, task, entry)
+			}
+			continue
+		}
+
+		if _, seen := r.previouslyCompleted[task.TaskGuid]; !seen {
+			continue
+		}
+
+		r.replay(logger, task)
+	}
+
+	for _, entry := range entries {
+		if _, exists := existing[entry.StagingGuid]; exists || !entry.Delivered() {
+			continue
+		}
+
+		err := r.outbox.Remove(entry.StagingGuid)
+		if err != nil {
+			logger.Error("failed-to-remove-entry", err, lager.Data{"task-guid": entry.StagingGuid})
+		}
+	}
+
+	r.previouslyCompleted = completed
+}
+
+func (r *reconciler) cleanUp(logger lager.Logger, task receptor.TaskResponse, entry outbox.Entry) {
+	if task.Failed && r.clock.Now().Sub(time.Unix(0, entry.DeliveredAt)) < r.failedTaskRetention {
+		return
+	}
+
+	logger = logger.Session("clean-up", lager.Data{"task-guid": task.TaskGuid})
+
+	err := r.diegoClient.DeleteTask(task.TaskGuid)
+	if err != nil {
+		logger.Error("delete-task-failed", err)
+		return
+	}
+
+	r.emitter.IncrementCounter(metrics.StagingTasksDeleted, metrics.Labels{})
+
+	err = r.outbox.Remove(task.TaskGuid)
+	if err != nil {
+		logger.Error("failed-to-remove-entry", err)
+		return
+	}
+
+	logger.Info("deleted-task")
+}
+
+func (r *reconciler) replay(logger lager.Logger, task receptor.TaskResponse) {
+	logger = logger.Session("replay", lager.Data{"task-guid": task.TaskGuid})
+
+	r.admission.Release(task.TaskGuid)
+	r.inFlight.Update()
+
+	var annotation backend.StagingTaskAnnotation
+	err := json.Unmarshal([]byte(task.Annotation), &annotation)
+	if err != nil {
+		logger.Error("parsing-annotation-failed", err)
+	}
+
+	// A result that cannot be built is reported to the CC as a failed
+	// staging, so that the task is deleted once the CC has it rather than
+	// replayed on every pass.
+	responseJson, err := r.buildResponse(annotation, task)
+	if err != nil {
+		logger.Error("get-staging-response-failed", err)
+		responseJson, _ = json.Marshal(cc_messages.StagingResponseForCC{
+			Error: cc_messages.SanitizeErrorMessage("Staging failed: " + err.Error()),
+		})
+	}
+
+	err = r.outbox.Put(outbox.Entry{
+		StagingGuid: task.TaskGuid,
+		Payload:     responseJson,
+		CreatedAt:   r.clock.Now().UnixNano(),
+	})
+	if err != nil {
+		logger.Error("outbox-put-failed", err)
+		return
+	}
+
+	r.emitter.IncrementCounter(metrics.StagingTasksReconciled, metrics.Labels{
+		Lifecycle: annotation.Lifecycle,
+		Stack:     task.Stack,
+	})
+
+	logger.Info("reconciled")
+}
+
+func (r *reconciler) buildResponse(annotation backend.StagingTaskAnnotation, task receptor.TaskResponse) ([]byte, error) {
+	backend := r.backends[annotation.Lifecycle]
+	if backend == nil {
+		return nil, fmt.Errorf("no backend for lifecycle %q", annotation.Lifecycle)
+	}
+
+	response, err := backend.BuildStagingResponse(task)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(response)
+}
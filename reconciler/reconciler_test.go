@@ -0,0 +1,374 @@
+package reconciler_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-incubator/receptor"
+	"github.com/cloudfoundry-incubator/receptor/fake_receptor"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/cloudfoundry-incubator/stager/admission"
+	"github.com/cloudfoundry-incubator/stager/backend"
+	"github.com/cloudfoundry-incubator/stager/backend/fake_backend"
+	"github.com/cloudfoundry-incubator/stager/metrics"
+	fake_metrics "github.com/cloudfoundry-incubator/stager/metrics/fakes"
+	"github.com/cloudfoundry-incubator/stager/outbox"
+	"github.com/cloudfoundry-incubator/stager/reconciler"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/pivotal-golang/lager/lagertest"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("Reconciler", func() {
+	var (
+		fakeDiegoClient     *fake_receptor.FakeClient
+		fakeBackend         *fake_backend.FakeBackend
+		fakeEmitter         *fake_metrics.FakeEmitter
+		fakeClock           *fakeclock.FakeClock
+		stagingOutbox       outbox.Outbox
+		admissionController *admission.Controller
+		inFlightEmitter     *fake_metrics.FakeEmitter
+		failedTaskRetention time.Duration
+		interval            time.Duration
+
+		completedTask receptor.TaskResponse
+		process       ifrit.Process
+	)
+
+	BeforeEach(func() {
+		fakeDiegoClient = &fake_receptor.FakeClient{}
+		fakeBackend = &fake_backend.FakeBackend{}
+		fakeEmitter = &fake_metrics.FakeEmitter{}
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		stagingOutbox = outbox.NewMemoryOutbox()
+		admissionController = admission.NewController(admission.Limits{}, admission.DefaultRetryAfter)
+		inFlightEmitter = &fake_metrics.FakeEmitter{}
+		failedTaskRetention = 0
+		interval = time.Minute
+
+		completedTask = receptor.TaskResponse{
+			TaskGuid:   "completed-guid",
+			State:      receptor.TaskStateCompleted,
+			CreatedAt:  fakeClock.Now().UnixNano(),
+			Annotation: `{"lifecycle": "fake"}`,
+		}
+
+		fakeDiegoClient.TasksByDomainReturns([]receptor.TaskResponse{
+			completedTask,
+			{
+				TaskGuid:   "running-guid",
+				State:      receptor.TaskStateRunning,
+				Annotation: `{"lifecycle": "fake"}`,
+			},
+		}, nil)
+
+		fakeBackend.BuildStagingResponseReturns(cc_messages.StagingResponseForCC{
+			DetectedStartCommand: map[string]string{"web": "start"},
+		}, nil)
+	})
+
+	JustBeforeEach(func() {
+		runner := reconciler.New(
+			lagertest.NewTestLogger("test"),
+			fakeDiegoClient,
+			map[string]backend.Backend{"fake": fakeBackend},
+			stagingOutbox,
+			admissionController,
+			metrics.NewInFlightGauge(inFlightEmitter, admissionController),
+			failedTaskRetention,
+			fakeEmitter,
+			fakeClock,
+			interval,
+		)
+		process = ifrit.Invoke(runner)
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+
+	entryFor := func(guid string) func() *outbox.Entry {
+		return func() *outbox.Entry {
+			entries, err := stagingOutbox.Entries()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			for _, entry := range entries {
+				if entry.StagingGuid == guid {
+					return &entry
+				}
+			}
+			return nil
+		}
+	}
+
+	nextPass := func() {
+		Eventually(fakeClock.WatcherCount).Should(Equal(1))
+		fakeClock.Increment(interval)
+	}
+
+	It("lists the staging tasks on startup", func() {
+		Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(1))
+		Ω(fakeDiegoClient.TasksByDomainArgsForCall(0)).Should(Equal(backend.StagingTaskDomain))
+	})
+
+	It("does not replay tasks on startup, as their callbacks may still be in flight", func() {
+		Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(1))
+		Consistently(entryFor("completed-guid")).Should(BeNil())
+		Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(0))
+	})
+
+	inFlightGauge := func() int {
+		if inFlightEmitter.SetGaugeCallCount() == 0 {
+			return 0
+		}
+		_, value, _ := inFlightEmitter.SetGaugeArgsForCall(inFlightEmitter.SetGaugeCallCount() - 1)
+		return value
+	}
+
+	It("counts the unfinished tasks as stagings in flight", func() {
+		Eventually(func() int { return admissionController.InFlight("fake") }).Should(Equal(1))
+		Eventually(inFlightGauge).Should(Equal(1))
+	})
+
+	Context("when the task of a staging in flight is gone from Diego", func() {
+		BeforeEach(func() {
+			admissionController = admission.NewController(admission.Limits{
+				MaxInFlightPerLifecycle: map[string]int{"fake": 2},
+			}, admission.DefaultRetryAfter)
+
+			_, err := admissionController.Admit(admission.Staging{Guid: "lost-guid", Lifecycle: "fake"})
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = admissionController.Admit(admission.Staging{Guid: "running-guid", Lifecycle: "fake"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = admissionController.Admit(admission.Staging{Guid: "new-guid", Lifecycle: "fake"})
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("gives its room back", func() {
+			Eventually(admissionController.Released()).Should(Receive())
+			Ω(admissionController.InFlight("fake")).Should(Equal(1))
+
+			_, err := admissionController.Admit(admission.Staging{Guid: "new-guid", Lifecycle: "fake"})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("stops counting it as in flight", func() {
+			Eventually(admissionController.Released()).Should(Receive())
+			Eventually(inFlightEmitter.SetGaugeCallCount).Should(Equal(1))
+			Ω(inFlightGauge()).Should(Equal(1))
+		})
+	})
+
+	Context("when a task is still completed on the next pass", func() {
+		JustBeforeEach(func() {
+			nextPass()
+		})
+
+		It("puts its result through the backend into the outbox for the drainer", func() {
+			Eventually(entryFor("completed-guid")).ShouldNot(BeNil())
+			Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(1))
+			Ω(fakeBackend.BuildStagingResponseArgsForCall(0)).Should(Equal(completedTask))
+
+			entry := entryFor("completed-guid")()
+			Ω(entry.Payload).Should(MatchJSON(`{"detected_start_command":{"web":"start"}}`))
+			Ω(entry.CreatedAt).Should(Equal(fakeClock.Now().UnixNano()))
+			Ω(entry.Delivered()).Should(BeFalse())
+		})
+
+		It("counts the reconciled task", func() {
+			Eventually(fakeEmitter.IncrementCounterCallCount).Should(Equal(1))
+			name, labels := fakeEmitter.IncrementCounterArgsForCall(0)
+			Ω(name).Should(Equal(metrics.StagingTasksReconciled))
+			Ω(labels).Should(Equal(metrics.Labels{Lifecycle: "fake"}))
+		})
+
+		It("does not replay it again while the drainer delivers it", func() {
+			Eventually(entryFor("completed-guid")).ShouldNot(BeNil())
+
+			nextPass()
+			Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(3))
+			Consistently(fakeBackend.BuildStagingResponseCallCount).Should(Equal(1))
+			Ω(fakeDiegoClient.DeleteTaskCallCount()).Should(Equal(0))
+		})
+
+		It("only replays tasks that were already completed on the previous pass", func() {
+			Eventually(entryFor("completed-guid")).ShouldNot(BeNil())
+
+			newlyCompleted := receptor.TaskResponse{
+				TaskGuid:   "newly-completed-guid",
+				State:      receptor.TaskStateCompleted,
+				Annotation: `{"lifecycle": "fake"}`,
+			}
+			fakeDiegoClient.TasksByDomainReturns([]receptor.TaskResponse{completedTask, newlyCompleted}, nil)
+
+			nextPass()
+			Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(3))
+			Consistently(entryFor("newly-completed-guid")).Should(BeNil())
+
+			nextPass()
+			Eventually(entryFor("newly-completed-guid")).ShouldNot(BeNil())
+		})
+
+		Context("when the task's backend is unknown", func() {
+			BeforeEach(func() {
+				completedTask.Annotation = `{"lifecycle": "unknown"}`
+				fakeDiegoClient.TasksByDomainReturns([]receptor.TaskResponse{completedTask}, nil)
+			})
+
+			It("delivers a failed staging to the CC, so that the task is deleted", func() {
+				Eventually(entryFor("completed-guid")).ShouldNot(BeNil())
+
+				var response cc_messages.StagingResponseForCC
+				err := json.Unmarshal(entryFor("completed-guid")().Payload, &response)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Error).ShouldNot(BeNil())
+				Ω(response.Error.Message).Should(ContainSubstring("Staging failed"))
+			})
+		})
+
+		Context("when the task's annotation is invalid", func() {
+			BeforeEach(func() {
+				completedTask.Annotation = `{`
+				fakeDiegoClient.TasksByDomainReturns([]receptor.TaskResponse{completedTask}, nil)
+			})
+
+			It("delivers a failed staging to the CC, so that the task is deleted", func() {
+				Eventually(entryFor("completed-guid")).ShouldNot(BeNil())
+
+				var response cc_messages.StagingResponseForCC
+				err := json.Unmarshal(entryFor("completed-guid")().Payload, &response)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Error).ShouldNot(BeNil())
+			})
+		})
+
+		Context("when the backend cannot build the result", func() {
+			BeforeEach(func() {
+				fakeBackend.BuildStagingResponseReturns(cc_messages.StagingResponseForCC{}, errors.New("bad result"))
+			})
+
+			It("delivers a failed staging to the CC, so that the task is deleted", func() {
+				Eventually(entryFor("completed-guid")).ShouldNot(BeNil())
+
+				var response cc_messages.StagingResponseForCC
+				err := json.Unmarshal(entryFor("completed-guid")().Payload, &response)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Error).Should(Equal(cc_messages.SanitizeErrorMessage("Staging failed: bad result")))
+			})
+
+			It("does not replay it again while the drainer delivers it", func() {
+				Eventually(entryFor("completed-guid")).ShouldNot(BeNil())
+
+				nextPass()
+				Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(3))
+				Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(1))
+			})
+		})
+	})
+
+	Context("when the result has already been delivered", func() {
+		BeforeEach(func() {
+			err := stagingOutbox.Put(outbox.Entry{
+				StagingGuid: "completed-guid",
+				CreatedAt:   fakeClock.Now().UnixNano(),
+				DeliveredAt: fakeClock.Now().UnixNano(),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("deletes the task without replaying it", func() {
+			Eventually(fakeDiegoClient.DeleteTaskCallCount).Should(Equal(1))
+			Ω(fakeDiegoClient.DeleteTaskArgsForCall(0)).Should(Equal("completed-guid"))
+			Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(0))
+		})
+
+		It("removes the entry and counts the deleted task", func() {
+			Eventually(entryFor("completed-guid")).Should(BeNil())
+
+			Ω(fakeEmitter.IncrementCounterCallCount()).Should(Equal(1))
+			name, _ := fakeEmitter.IncrementCounterArgsForCall(0)
+			Ω(name).Should(Equal(metrics.StagingTasksDeleted))
+		})
+
+		Context("when deleting the task fails", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.DeleteTaskReturns(errors.New("boom"))
+			})
+
+			It("keeps the entry to try again on the next pass", func() {
+				Eventually(fakeDiegoClient.DeleteTaskCallCount).Should(Equal(1))
+				Ω(entryFor("completed-guid")()).ShouldNot(BeNil())
+
+				nextPass()
+				Eventually(fakeDiegoClient.DeleteTaskCallCount).Should(Equal(2))
+			})
+		})
+
+		Context("when the task failed and is within the retention window", func() {
+			BeforeEach(func() {
+				failedTaskRetention = time.Hour
+				completedTask.Failed = true
+				fakeDiegoClient.TasksByDomainReturns([]receptor.TaskResponse{completedTask}, nil)
+			})
+
+			It("deletes it once the retention has passed since the delivery", func() {
+				Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(1))
+				Consistently(fakeDiegoClient.DeleteTaskCallCount).Should(Equal(0))
+
+				Eventually(fakeClock.WatcherCount).Should(Equal(1))
+				fakeClock.Increment(failedTaskRetention)
+
+				Eventually(fakeDiegoClient.DeleteTaskCallCount).Should(Equal(1))
+				Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(0))
+			})
+		})
+
+		Context("when the task is gone from Diego", func() {
+			BeforeEach(func() {
+				fakeDiegoClient.TasksByDomainReturns([]receptor.TaskResponse{}, nil)
+			})
+
+			It("removes the entry", func() {
+				Eventually(entryFor("completed-guid")).Should(BeNil())
+				Ω(fakeDiegoClient.DeleteTaskCallCount()).Should(Equal(0))
+			})
+		})
+	})
+
+	Context("when the result is still waiting in the outbox", func() {
+		BeforeEach(func() {
+			err := stagingOutbox.Put(outbox.Entry{
+				StagingGuid: "completed-guid",
+				CreatedAt:   fakeClock.Now().UnixNano(),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("leaves it to the drainer", func() {
+			Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(1))
+			nextPass()
+			Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(2))
+
+			Ω(fakeBackend.BuildStagingResponseCallCount()).Should(Equal(0))
+			Ω(fakeDiegoClient.DeleteTaskCallCount()).Should(Equal(0))
+			Ω(entryFor("completed-guid")()).ShouldNot(BeNil())
+		})
+	})
+
+	Context("when listing the tasks fails", func() {
+		BeforeEach(func() {
+			fakeDiegoClient.TasksByDomainReturns(nil, errors.New("boom"))
+		})
+
+		It("keeps running", func() {
+			Eventually(fakeDiegoClient.TasksByDomainCallCount).Should(Equal(1))
+			Consistently(process.Wait()).ShouldNot(Receive())
+		})
+	})
+})
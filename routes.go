@@ -5,11 +5,17 @@ import "github.com/tedsuo/rata"
 const (
 	StageRoute            = "Stage"
 	StopStagingRoute      = "StopStaging"
+	RenderRecipeRoute     = "RenderRecipe"
 	StagingCompletedRoute = "StagingCompleted"
+	StagingStatusRoute    = "StagingStatus"
+	ListStagingsRoute     = "ListStagings"
 )
 
 var Routes = rata.Routes{
 	{Path: "/v1/staging/:staging_guid", Method: "PUT", Name: StageRoute},
 	{Path: "/v1/staging/:staging_guid", Method: "DELETE", Name: StopStagingRoute},
 	{Path: "/v1/staging/:staging_guid/completed", Method: "POST", Name: StagingCompletedRoute},
+	{Path: "/v1/staging/:staging_guid/recipe", Method: "POST", Name: RenderRecipeRoute},
+	{Path: "/v1/staging/:staging_guid", Method: "GET", Name: StagingStatusRoute},
+	{Path: "/v1/staging", Method: "GET", Name: ListStagingsRoute},
 }
@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TracerName  = "github.com/cloudfoundry-incubator/stager"
+	ServiceName = "stager"
+)
+
+var ErrNoExporter = errors.New("no trace exporter configured")
+
+// propagator carries trace context as W3C traceparent/tracestate.
+var propagator = propagation.TraceContext{}
+
+type Config struct {
+	// OTLPEndpoint is the host:port of an OTLP/HTTP collector.
+	OTLPEndpoint string
+	OTLPInsecure bool
+
+	// File receives spans as JSON, one per line.
+	File string
+
+	// SampleRatio is the fraction of new traces that are sampled. Traces
+	// started by a sampled caller are always sampled.
+	SampleRatio float64
+}
+
+func (c Config) Enabled() bool {
+	return c.OTLPEndpoint != "" || c.File != ""
+}
+
+// NewTracerProvider returns a provider that exports to every configured
+// exporter. Callers must Shutdown the provider to flush buffered spans.
+func NewTracerProvider(config Config) (*sdktrace.TracerProvider, error) {
+	if !config.Enabled() {
+		return nil, ErrNoExporter
+	}
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	}
+
+	if config.OTLPEndpoint != "" {
+		otlpOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.OTLPEndpoint)}
+		if config.OTLPInsecure {
+			otlpOptions = append(otlpOptions, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err := otlptracehttp.New(context.Background(), otlpOptions...)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	if config.File != "" {
+		file, err := os.OpenFile(config.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(options...), nil
+}
+
+// Inject returns the trace context of ctx in a form that can be stored, e.g.
+// in a task annotation. It returns nil when ctx carries no trace.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	if len(carrier) == 0 {
+		return nil
+	}
+
+	return carrier
+}
+
+// Extract returns ctx joined to the trace context stored by Inject.
+func Extract(ctx context.Context, traceContext map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+// ExtractHeaders returns ctx joined to the trace of the caller that sent
+// header, if any.
+func ExtractHeaders(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// RecordError marks the span as failed with err, if err is not nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
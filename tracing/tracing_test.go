@@ -0,0 +1,123 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry-incubator/stager/tracing"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		spanRecorder *tracetest.SpanRecorder
+		tracer       trace.Tracer
+	)
+
+	BeforeEach(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)).Tracer("test")
+	})
+
+	Describe("Inject and Extract", func() {
+		It("carry the trace context through a map", func() {
+			ctx, span := tracer.Start(context.Background(), "parent")
+			defer span.End()
+
+			traceContext := tracing.Inject(ctx)
+			Ω(traceContext).Should(HaveKey("traceparent"))
+
+			extracted := trace.SpanContextFromContext(tracing.Extract(context.Background(), traceContext))
+			Ω(extracted.TraceID()).Should(Equal(span.SpanContext().TraceID()))
+			Ω(extracted.SpanID()).Should(Equal(span.SpanContext().SpanID()))
+			Ω(extracted.IsRemote()).Should(BeTrue())
+		})
+
+		It("injects nothing when there is no trace", func() {
+			Ω(tracing.Inject(context.Background())).Should(BeNil())
+		})
+
+		It("extracts nothing from an empty trace context", func() {
+			ctx := tracing.Extract(context.Background(), nil)
+			Ω(trace.SpanContextFromContext(ctx).IsValid()).Should(BeFalse())
+		})
+	})
+
+	Describe("ExtractHeaders", func() {
+		It("joins the trace of the caller", func() {
+			header := http.Header{}
+			header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+			spanContext := trace.SpanContextFromContext(tracing.ExtractHeaders(context.Background(), header))
+			Ω(spanContext.TraceID().String()).Should(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		})
+	})
+
+	Describe("RecordError", func() {
+		It("marks the span as failed", func() {
+			_, span := tracer.Start(context.Background(), "failing")
+			tracing.RecordError(span, errors.New("boom"))
+			span.End()
+
+			ended := spanRecorder.Ended()
+			Ω(ended).Should(HaveLen(1))
+			Ω(ended[0].Status().Code).Should(Equal(codes.Error))
+			Ω(ended[0].Status().Description).Should(Equal("boom"))
+		})
+
+		It("leaves the span alone when there is no error", func() {
+			_, span := tracer.Start(context.Background(), "succeeding")
+			tracing.RecordError(span, nil)
+			span.End()
+
+			Ω(spanRecorder.Ended()[0].Status().Code).Should(Equal(codes.Unset))
+		})
+	})
+
+	Describe("NewTracerProvider", func() {
+		It("fails when no exporter is configured", func() {
+			_, err := tracing.NewTracerProvider(tracing.Config{SampleRatio: 1})
+			Ω(err).Should(Equal(tracing.ErrNoExporter))
+		})
+
+		Context("with a file exporter", func() {
+			var tracesDir string
+
+			BeforeEach(func() {
+				var err error
+				tracesDir, err = ioutil.TempDir("", "traces")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(tracesDir)
+			})
+
+			It("writes the spans to the file once shut down", func() {
+				tracesFile := filepath.Join(tracesDir, "traces.json")
+
+				provider, err := tracing.NewTracerProvider(tracing.Config{File: tracesFile, SampleRatio: 1})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, span := provider.Tracer(tracing.TracerName).Start(context.Background(), "stage")
+				span.End()
+
+				Ω(provider.Shutdown(context.Background())).Should(Succeed())
+
+				contents, err := ioutil.ReadFile(tracesFile)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(contents)).Should(ContainSubstring(`"Name":"stage"`))
+			})
+		})
+	})
+})